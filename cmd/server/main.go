@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/k0ngk0ng/claude-sync/internal/service"
 )
@@ -11,21 +12,102 @@ import (
 func main() {
 	port := flag.Int("port", 8080, "监听端口")
 	dataDir := flag.String("data", "./claude-sync-data", "数据目录")
+	metaPath := flag.String("meta", "", "元数据库文件 (默认为数据目录下的 meta.db; 使用 S3 存储时必填, 需要在持久化的磁盘上)")
 	token := flag.String("token", "", "认证令牌 (必填)")
+	adminToken := flag.String("admin-token", os.Getenv("CLAUDE_SYNC_ADMIN_TOKEN"), "管理令牌, 用于管理界面和 /admin 接口 (默认读取 CLAUDE_SYNC_ADMIN_TOKEN)")
+	tombstoneRetention := flag.Duration("tombstone-retention", service.DefaultTombstoneRetention, "删除记录保留时间")
+	keepVersions := flag.Int("keep-versions", service.DefaultKeepVersions, "每个文件至少保留的历史版本数")
+	versionRetention := flag.Duration("version-retention", service.DefaultVersionRetention, "历史版本保留时间")
+	masterKey := flag.String("master-key", os.Getenv("CLAUDE_SYNC_MASTER_KEY"), "静态加密的主密钥, 64 位十六进制或 base64 (默认读取 CLAUDE_SYNC_MASTER_KEY)")
+	masterKeyFile := flag.String("master-key-file", "", "从文件读取静态加密的主密钥")
+
+	storage := flag.String("storage", "local", "存储后端: local (使用 -data 目录) 或 s3")
+	s3Endpoint := flag.String("s3-endpoint", "https://s3.amazonaws.com", "S3 服务地址")
+	s3Region := flag.String("s3-region", "us-east-1", "S3 区域")
+	s3Bucket := flag.String("s3-bucket", "", "S3 bucket")
+	s3Prefix := flag.String("s3-prefix", "", "S3 对象键前缀")
+	s3PathStyle := flag.Bool("s3-path-style", false, "使用路径形式的地址 (MinIO 等需要)")
+	s3AccessKey := flag.String("s3-access-key", os.Getenv("AWS_ACCESS_KEY_ID"), "S3 Access Key (默认读取 AWS_ACCESS_KEY_ID)")
 	flag.Parse()
 
 	if *token == "" {
 		fmt.Println("错误: 必须指定认证令牌 (-token)")
 		fmt.Println()
 		fmt.Println("用法:")
-		fmt.Println("  claude-sync-server -token <your-secret-token> [-port 8080] [-data ./data]")
+		fmt.Println("  claude-sync-server -token <your-secret-token> [-admin-token <admin-token>] [-port 8080] [-data ./data]")
 		fmt.Println()
 		fmt.Println("示例:")
-		fmt.Println("  claude-sync-server -token my-secret-123 -port 8080 -data /data/claude-sync")
+		fmt.Println("  claude-sync-server -token my-secret-123 -admin-token my-admin-456 -port 8080 -data /data/claude-sync")
+		os.Exit(1)
+	}
+
+	var store service.Storage
+	switch *storage {
+	case "local":
+		store = service.NewLocalStorage(*dataDir)
+	case "s3":
+		// Secret Key 只从环境变量读取, 避免出现在进程列表中
+		s3, err := service.NewS3Storage(service.S3Config{
+			Endpoint:     *s3Endpoint,
+			Region:       *s3Region,
+			Bucket:       *s3Bucket,
+			Prefix:       *s3Prefix,
+			AccessKey:    *s3AccessKey,
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			PathStyle:    *s3PathStyle,
+		})
+		if err != nil {
+			fmt.Printf("错误: %v\n", err)
+			os.Exit(1)
+		}
+		store = s3
+	default:
+		fmt.Printf("错误: 未知的存储后端 %q\n", *storage)
 		os.Exit(1)
 	}
 
-	server := service.NewServer(*port, *dataDir, *token)
+	if *metaPath == "" {
+		// 元数据库不保存在对象存储中, 默认的数据目录在容器中通常不是持久化的
+		if *storage != "local" {
+			fmt.Println("错误: 使用 S3 存储时必须通过 -meta 指定元数据库文件, 并放在持久化的磁盘上 (元数据库不保存在对象存储中)")
+			os.Exit(1)
+		}
+		*metaPath = filepath.Join(*dataDir, "meta.db")
+	}
+
+	server, err := service.NewServerWithStorage(*port, store, *metaPath, *token)
+	if err != nil {
+		fmt.Printf("错误: %v\n", err)
+		os.Exit(1)
+	}
+	if *adminToken != "" {
+		if err := server.SetAdminToken(*adminToken); err != nil {
+			fmt.Printf("错误: 保存管理令牌失败: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *masterKeyFile != "" {
+		data, err := os.ReadFile(*masterKeyFile)
+		if err != nil {
+			fmt.Printf("错误: 读取主密钥失败: %v\n", err)
+			os.Exit(1)
+		}
+		*masterKey = string(data)
+	}
+	if *masterKey != "" {
+		key, err := service.ParseMasterKey(*masterKey)
+		if err != nil {
+			fmt.Printf("错误: %v\n", err)
+			os.Exit(1)
+		}
+		if err := server.SetMasterKey(key); err != nil {
+			fmt.Printf("错误: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	server.SetTombstoneRetention(*tombstoneRetention)
+	server.SetVersionRetention(*keepVersions, *versionRetention)
 	if err := server.Start(); err != nil {
 		fmt.Printf("服务器错误: %v\n", err)
 		os.Exit(1)
@@ -8,19 +8,65 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"time"
 )
 
 // Config 应用配置
 type Config struct {
-	ServerURL    string            `json:"server_url"`
-	Token        string            `json:"token"`
-	MachineID    string            `json:"machine_id"`
-	MachineName  string            `json:"machine_name"`
-	SyncInterval int               `json:"sync_interval"` // 秒
-	PathMappings map[string]string `json:"path_mappings"` // remote -> local
-	AutoStart    bool              `json:"auto_start"`    // 开机自启
-	Paused       bool              `json:"paused"`        // 暂停同步
+	ServerURL    string       `json:"server_url"`
+	Token        string       `json:"token"`                  // 租户令牌, 注册设备凭据后清空
+	DeviceToken  string       `json:"device_token,omitempty"` // 本机的设备凭据
+	MachineID    string       `json:"machine_id"`
+	MachineName  string       `json:"machine_name"`
+	SyncInterval int          `json:"sync_interval"` // 秒
+	PathMappings PathMappings `json:"path_mappings"` // 远程目录 -> 本机目录, 按添加顺序
+	AutoStart    bool         `json:"auto_start"`    // 开机自启
+	Paused       bool         `json:"paused"`        // 暂停同步
+
+	// 端到端加密密钥 (由口令派生, 十六进制), 为空时不加密
+	EncryptionKey string `json:"encryption_key,omitempty"`
+	EncryptPaths  bool   `json:"encrypt_paths,omitempty"` // 同时加密文件路径
+
+	// 上传前的敏感信息处理: "mask" (默认, 替换为占位符)、"block" (不上传) 或 "off"
+	Redaction      string   `json:"redaction,omitempty"`
+	RedactPatterns []string `json:"redact_patterns,omitempty"` // 自定义的敏感信息正则表达式
+
+	// 同步范围: gitignore 风格的包含/排除规则 (相对于 ~/.claude), 以及不同步的项目目录
+	SyncRules        []string `json:"sync_rules,omitempty"`
+	ExcludedProjects []string `json:"excluded_projects,omitempty"`
+
+	// 同步的 ~/.claude 下的目录和文件 ("/" 分隔的相对路径), 为空时使用默认的同步根
+	SyncRoots []string `json:"sync_roots,omitempty"`
+}
+
+// PathMapping 一条路径映射: 远程机器上的目录对应本机的哪个目录
+type PathMapping struct {
+	Remote string `json:"remote"`
+	Local  string `json:"local"`
+}
+
+// PathMappings 按添加顺序保存的路径映射
+type PathMappings []PathMapping
+
+// UnmarshalJSON 兼容旧版本的配置: 旧版本保存为 remote -> local 的对象, 读取时按远程路径排序
+func (m *PathMappings) UnmarshalJSON(data []byte) error {
+	var list []PathMapping
+	if err := json.Unmarshal(data, &list); err == nil {
+		*m = list
+		return nil
+	}
+	var legacy map[string]string
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	list = make([]PathMapping, 0, len(legacy))
+	for remote, local := range legacy {
+		list = append(list, PathMapping{Remote: remote, Local: local})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Remote < list[j].Remote })
+	*m = list
+	return nil
 }
 
 // DefaultConfig 默认配置
@@ -28,7 +74,6 @@ func DefaultConfig() *Config {
 	return &Config{
 		MachineID:    generateMachineID(),
 		SyncInterval: 30,
-		PathMappings: make(map[string]string),
 		AutoStart:    true,
 		Paused:       false,
 	}
@@ -45,6 +90,11 @@ func GetConfigPath() string {
 	return filepath.Join(GetClaudeDir(), "sync-config.json")
 }
 
+// GetStatePath 获取同步状态数据库路径
+func GetStatePath() string {
+	return filepath.Join(GetClaudeDir(), "sync-state.json")
+}
+
 // GetLogPath 获取日志文件路径
 func GetLogPath() string {
 	return filepath.Join(GetClaudeDir(), "sync.log")
@@ -72,9 +122,6 @@ func Load() (*Config, error) {
 	if config.SyncInterval == 0 {
 		config.SyncInterval = 30
 	}
-	if config.PathMappings == nil {
-		config.PathMappings = make(map[string]string)
-	}
 
 	return config, nil
 }
@@ -95,7 +142,7 @@ func (c *Config) Save() error {
 
 // IsConfigured 检查是否已配置
 func (c *Config) IsConfigured() bool {
-	return c.ServerURL != "" && c.Token != ""
+	return c.ServerURL != "" && (c.Token != "" || c.DeviceToken != "")
 }
 
 // generateMachineID 生成机器ID
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPathMappingsUnmarshal(t *testing.T) {
+	want := PathMappings{
+		{Remote: "/Users/a", Local: "/home/a"},
+		{Remote: "/Users/b", Local: "/home/b"},
+	}
+	for _, data := range []string{
+		// 旧版本的对象形式, 按远程路径排序
+		`{"path_mappings":{"/Users/b":"/home/b","/Users/a":"/home/a"}}`,
+		// 当前的列表形式, 保持顺序
+		`{"path_mappings":[{"remote":"/Users/a","local":"/home/a"},{"remote":"/Users/b","local":"/home/b"}]}`,
+	} {
+		var cfg Config
+		if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+			t.Fatalf("%s: %v", data, err)
+		}
+		if !reflect.DeepEqual(cfg.PathMappings, want) {
+			t.Errorf("%s: got %v", data, cfg.PathMappings)
+		}
+	}
+
+	var cfg Config
+	if err := json.Unmarshal([]byte(`{"path_mappings":"bogus"}`), &cfg); err == nil {
+		t.Error("invalid mappings should fail")
+	}
+}
@@ -1,10 +1,15 @@
 package service
 
 import (
+	"crypto/subtle"
 	"embed"
+	"fmt"
 	"html/template"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 //go:embed admin.html
@@ -12,10 +17,22 @@ var adminHTML embed.FS
 
 // AdminPage 管理页面数据
 type AdminPage struct {
-	Stats       *ServerStats
-	Error       string
-	Success     string
-	AdminToken  string
+	Stats     *ServerStats
+	Error     string
+	Success   string
+	CSRFToken string // 登录后页面中所有表单携带的 CSRF 令牌
+}
+
+// adminSessionCookie 管理界面会话的 cookie 名称, 值为随机的会话 ID (不是管理令牌)
+const adminSessionCookie = "admin_session"
+
+// adminSessionTTL 管理界面登录的有效期
+const adminSessionTTL = 7 * 24 * time.Hour
+
+// adminSession 管理界面的登录会话, 只保存在服务器内存中 (重启或更换管理令牌后需要重新登录)
+type adminSession struct {
+	csrfToken string // 该会话页面中表单携带的 CSRF 令牌
+	expiresAt time.Time
 }
 
 // 注册管理界面路由
@@ -25,29 +42,37 @@ func (s *Server) registerAdminUI(mux *http.ServeMux) {
 }
 
 func (s *Server) handleAdminUI(w http.ResponseWriter, r *http.Request) {
-	adminToken := r.URL.Query().Get("token")
-	if adminToken == "" {
-		// 尝试从 cookie 获取
-		if cookie, err := r.Cookie("admin_token"); err == nil {
-			adminToken = cookie.Value
-		}
-	}
+	session := s.requestAdminSession(r)
 
 	// 如果是 POST 请求处理登录
 	if r.Method == "POST" {
 		r.ParseForm()
 		action := r.FormValue("action")
 
+		// 登录以外的操作都需要已登录的会话和该会话页面中的 CSRF 令牌,
+		// 其他网站无法借用管理员的 cookie 提交表单
+		if action != "login" {
+			if session == nil {
+				http.Redirect(w, r, "/admin", http.StatusSeeOther)
+				return
+			}
+			if !session.validCSRF(r.FormValue("csrf_token")) {
+				http.Error(w, "invalid csrf token", http.StatusForbidden)
+				return
+			}
+		}
+
 		switch action {
 		case "login":
-			adminToken = r.FormValue("token")
-			if s.validateAdminToken(adminToken) {
+			if s.validateAdminToken(r.FormValue("token")) {
 				http.SetCookie(w, &http.Cookie{
-					Name:     "admin_token",
-					Value:    adminToken,
+					Name:     adminSessionCookie,
+					Value:    s.newAdminSession(),
 					Path:     "/admin",
-					MaxAge:   86400 * 7, // 7 天
+					MaxAge:   int(adminSessionTTL.Seconds()),
 					HttpOnly: true,
+					Secure:   r.TLS != nil,
+					SameSite: http.SameSiteStrictMode,
 				})
 				http.Redirect(w, r, "/admin", http.StatusSeeOther)
 				return
@@ -56,66 +81,181 @@ func (s *Server) handleAdminUI(w http.ResponseWriter, r *http.Request) {
 			return
 
 		case "logout":
+			s.endAdminSession(r)
 			http.SetCookie(w, &http.Cookie{
-				Name:   "admin_token",
-				Value:  "",
-				Path:   "/admin",
-				MaxAge: -1,
+				Name:     adminSessionCookie,
+				Value:    "",
+				Path:     "/admin",
+				MaxAge:   -1,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
 			})
 			http.Redirect(w, r, "/admin", http.StatusSeeOther)
 			return
 
 		case "create_tenant":
-			if !s.validateAdminToken(adminToken) {
-				http.Redirect(w, r, "/admin", http.StatusSeeOther)
-				return
-			}
 			id := r.FormValue("id")
 			name := r.FormValue("name")
 			token := r.FormValue("tenant_token")
 			if id == "" || name == "" || token == "" {
-				s.renderAdminPageWithAuth(w, adminToken, "", "请填写完整信息")
+				s.renderAdminPageWithAuth(w, session, "", "请填写完整信息")
 				return
 			}
 			if _, err := s.CreateTenant(id, name, token); err != nil {
-				s.renderAdminPageWithAuth(w, adminToken, "", err.Error())
+				s.renderAdminPageWithAuth(w, session, "", err.Error())
 				return
 			}
-			s.renderAdminPageWithAuth(w, adminToken, "租户创建成功", "")
+			s.renderAdminPageWithAuth(w, session, "租户创建成功", "")
 			return
 
 		case "delete_tenant":
-			if !s.validateAdminToken(adminToken) {
-				http.Redirect(w, r, "/admin", http.StatusSeeOther)
+			id := r.FormValue("id")
+			if err := s.DeleteTenant(id); err != nil {
+				s.renderAdminPageWithAuth(w, session, "", err.Error())
 				return
 			}
+			s.renderAdminPageWithAuth(w, session, "租户已删除", "")
+			return
+
+		case "rollback_tenant":
 			id := r.FormValue("id")
-			if err := s.DeleteTenant(id); err != nil {
-				s.renderAdminPageWithAuth(w, adminToken, "", err.Error())
+			at, err := strconv.ParseInt(r.FormValue("at"), 10, 64)
+			if err != nil || at <= 0 {
+				s.renderAdminPageWithAuth(w, session, "", "请选择回滚时间")
+				return
+			}
+			restored, deleted, err := s.RollbackTenant(id, time.Unix(at, 0))
+			if err != nil {
+				s.renderAdminPageWithAuth(w, session, "", err.Error())
+				return
+			}
+			s.renderAdminPageWithAuth(w, session,
+				fmt.Sprintf("已回滚: 恢复 %d 个文件, 删除 %d 个文件", restored, deleted), "")
+			return
+
+		case "revoke_device":
+			s.mu.RLock()
+			tenant := s.tenants[r.FormValue("id")]
+			s.mu.RUnlock()
+			if tenant == nil {
+				s.renderAdminPageWithAuth(w, session, "", "tenant not found")
+				return
+			}
+			if err := s.RevokeDevice(tenant, r.FormValue("machine_id")); err != nil {
+				s.renderAdminPageWithAuth(w, session, "", err.Error())
+				return
+			}
+			s.renderAdminPageWithAuth(w, session, "设备已撤销", "")
+			return
+
+		case "pairing_code":
+			s.mu.RLock()
+			tenant := s.tenants[r.FormValue("id")]
+			s.mu.RUnlock()
+			if tenant == nil {
+				s.renderAdminPageWithAuth(w, session, "", "tenant not found")
+				return
+			}
+			scope, err := Scope{
+				Access: r.FormValue("access"),
+				Paths:  strings.Split(r.FormValue("paths"), ","),
+			}.normalize()
+			if err != nil {
+				s.renderAdminPageWithAuth(w, session, "", err.Error())
 				return
 			}
-			s.renderAdminPageWithAuth(w, adminToken, "租户已删除", "")
+			code, _ := s.CreatePairingCode(tenant, scope)
+			msg := fmt.Sprintf("租户 %s 的配对码: %s (权限: %s, %d 分钟内有效, 只能使用一次)", tenant.ID, code, scope, int(DefaultPairingTTL.Minutes()))
+			s.renderAdminPageWithAuth(w, session, msg, "")
+			return
+
+		case "rotate_token":
+			id := r.FormValue("id")
+			hours, err := strconv.Atoi(r.FormValue("grace_hours"))
+			if err != nil || hours < 0 {
+				s.renderAdminPageWithAuth(w, session, "", "无效的宽限期")
+				return
+			}
+			grace := time.Duration(hours) * time.Hour
+			token, err := s.RotateTenantToken(id, r.FormValue("tenant_token"), grace)
+			if err != nil {
+				s.renderAdminPageWithAuth(w, session, "", err.Error())
+				return
+			}
+			msg := fmt.Sprintf("租户 %s 的新令牌: %s (旧令牌立即失效)", id, token)
+			if grace > 0 {
+				msg = fmt.Sprintf("租户 %s 的新令牌: %s (旧令牌在 %d 小时内仍然有效)", id, token, hours)
+			}
+			s.renderAdminPageWithAuth(w, session, msg, "")
 			return
 		}
 	}
 
-	// 验证 token
-	if !s.validateAdminToken(adminToken) {
+	if session == nil {
 		s.renderAdminPage(w, &AdminPage{})
 		return
 	}
 
-	s.renderAdminPageWithAuth(w, adminToken, "", "")
+	s.renderAdminPageWithAuth(w, session, "", "")
 }
 
+// validateAdminToken 校验管理令牌; 租户的同步令牌不能用于管理
 func (s *Server) validateAdminToken(token string) bool {
 	if token == "" {
 		return false
 	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	_, exists := s.tenants[token]
-	return exists
+	return verifyToken(token, s.config.AdminTokenHash)
+}
+
+// newAdminSession 登录成功后创建会话, 返回会话 ID; 同时清理过期的会话
+func (s *Server) newAdminSession() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, session := range s.adminSessions {
+		if now.After(session.expiresAt) {
+			delete(s.adminSessions, id)
+		}
+	}
+	id := generateToken()
+	s.adminSessions[id] = &adminSession{
+		csrfToken: generateToken(),
+		expiresAt: now.Add(adminSessionTTL),
+	}
+	return id
+}
+
+// requestAdminSession 获取请求 cookie 对应的有效会话, 没有登录或已过期时为空
+func (s *Server) requestAdminSession(r *http.Request) *adminSession {
+	cookie, err := r.Cookie(adminSessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session := s.adminSessions[cookie.Value]
+	if session == nil || time.Now().After(session.expiresAt) {
+		return nil
+	}
+	return session
+}
+
+// endAdminSession 退出登录, 删除请求 cookie 对应的会话
+func (s *Server) endAdminSession(r *http.Request) {
+	if cookie, err := r.Cookie(adminSessionCookie); err == nil {
+		s.mu.Lock()
+		delete(s.adminSessions, cookie.Value)
+		s.mu.Unlock()
+	}
+}
+
+// validCSRF 校验表单中的 CSRF 令牌
+func (a *adminSession) validCSRF(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.csrfToken)) == 1
 }
 
 func (s *Server) renderAdminPage(w http.ResponseWriter, page *AdminPage) {
@@ -128,13 +268,13 @@ func (s *Server) renderAdminPage(w http.ResponseWriter, page *AdminPage) {
 	tmpl.Execute(w, page)
 }
 
-func (s *Server) renderAdminPageWithAuth(w http.ResponseWriter, adminToken, success, errMsg string) {
+func (s *Server) renderAdminPageWithAuth(w http.ResponseWriter, session *adminSession, success, errMsg string) {
 	stats := s.getServerStats()
 	page := &AdminPage{
-		Stats:      stats,
-		AdminToken: adminToken,
-		Success:    success,
-		Error:      errMsg,
+		Stats:     stats,
+		CSRFToken: session.csrfToken,
+		Success:   success,
+		Error:     errMsg,
 	}
 	s.renderAdminPage(w, page)
 }
@@ -155,25 +295,19 @@ func (s *Server) getServerStats() *ServerStats {
 		totalFiles += len(t.Files)
 		totalSize += tSize
 
-		clients := make([]*ClientInfo, 0, len(t.Clients))
-		for _, c := range t.Clients {
-			clients = append(clients, c)
-		}
-
-		// 按最后活跃时间排序客户端
-		sort.Slice(clients, func(i, j int) bool {
-			return clients[i].LastSeen.After(clients[j].LastSeen)
-		})
-
-		tenantStats = append(tenantStats, &TenantStats{
+		stats := &TenantStats{
 			ID:          t.ID,
 			Name:        t.Name,
 			FileCount:   len(t.Files),
 			TotalSize:   tSize,
 			ClientCount: len(t.Clients),
-			Clients:     clients,
+			Clients:     t.clientList(),
 			LastActive:  t.LastActive,
-		})
+		}
+		if t.PrevTokenHash != "" && time.Now().Before(t.PrevTokenExpiresAt) {
+			stats.PrevTokenExpiresAt = &t.PrevTokenExpiresAt
+		}
+		tenantStats = append(tenantStats, stats)
 	}
 
 	// 按最后活跃时间排序租户
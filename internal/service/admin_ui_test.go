@@ -0,0 +1,144 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func newTestAdminServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := NewServer(0, t.TempDir(), "tenant-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.SetAdminToken("admin-token"); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func postAdminForm(s *Server, cookie *http.Cookie, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/admin", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.handleAdminUI(w, req)
+	return w
+}
+
+// loginAdmin 登录管理界面, 返回会话 cookie 和页面中的 CSRF 令牌
+func loginAdmin(t *testing.T, s *Server) (*http.Cookie, string) {
+	t.Helper()
+	w := postAdminForm(s, nil, url.Values{"action": {"login"}, "token": {"admin-token"}})
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("cookies = %v", cookies)
+	}
+
+	req := httptest.NewRequest("GET", "/admin", nil)
+	req.AddCookie(cookies[0])
+	page := httptest.NewRecorder()
+	s.handleAdminUI(page, req)
+	m := regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`).FindStringSubmatch(page.Body.String())
+	if m == nil {
+		t.Fatal("page has no csrf token")
+	}
+	return cookies[0], m[1]
+}
+
+func TestAdminUISessionCookie(t *testing.T) {
+	s := newTestAdminServer(t)
+
+	c, _ := loginAdmin(t, s)
+	if !c.HttpOnly || c.SameSite != http.SameSiteStrictMode {
+		t.Errorf("cookie HttpOnly=%v SameSite=%v", c.HttpOnly, c.SameSite)
+	}
+	// cookie 中是随机的会话 ID, 不是管理令牌
+	if c.Name != adminSessionCookie || strings.Contains(c.Value, "admin-token") || len(c.Value) < 32 {
+		t.Errorf("cookie = %s=%s", c.Name, c.Value)
+	}
+
+	// 管理令牌不能作为 cookie 或 URL 参数使用
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/admin?token=admin-token", nil),
+		httptest.NewRequest("GET", "/admin", nil),
+	} {
+		req.AddCookie(&http.Cookie{Name: adminSessionCookie, Value: "admin-token"})
+		w := httptest.NewRecorder()
+		s.handleAdminUI(w, req)
+		if strings.Contains(w.Body.String(), `name="csrf_token"`) {
+			t.Errorf("%s: logged in without a session", req.URL)
+		}
+	}
+
+	// 退出后会话失效
+	c, csrf := loginAdmin(t, s)
+	postAdminForm(s, c, url.Values{"action": {"logout"}, "csrf_token": {csrf}})
+	req := httptest.NewRequest("GET", "/admin", nil)
+	req.AddCookie(c)
+	if s.requestAdminSession(req) != nil {
+		t.Error("session still valid after logout")
+	}
+}
+
+func TestAdminUIRequiresCSRFToken(t *testing.T) {
+	s := newTestAdminServer(t)
+	cookie, csrf := loginAdmin(t, s)
+	_, otherCSRF := loginAdmin(t, s)
+
+	// 每个会话的 CSRF 令牌不同, 不能使用其他会话的令牌
+	for _, token := range []string{"", "forged", otherCSRF} {
+		w := postAdminForm(s, cookie, url.Values{"action": {"delete_tenant"}, "id": {"default"}, "csrf_token": {token}})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("csrf %q: status = %d", token, w.Code)
+		}
+		if s.tenants["default"] == nil {
+			t.Fatalf("csrf %q: tenant deleted", token)
+		}
+	}
+
+	// 没有会话时不执行操作
+	if w := postAdminForm(s, nil, url.Values{"action": {"delete_tenant"}, "id": {"default"}, "csrf_token": {csrf}}); w.Code != http.StatusSeeOther {
+		t.Errorf("without session: status = %d", w.Code)
+	}
+
+	w := postAdminForm(s, cookie, url.Values{"action": {"delete_tenant"}, "id": {"default"}, "csrf_token": {csrf}})
+	if w.Code != http.StatusOK || s.tenants["default"] != nil {
+		t.Errorf("status = %d, tenant = %v", w.Code, s.tenants["default"])
+	}
+
+	// 更换管理令牌后已登录的会话失效
+	s.SetAdminToken("admin-token-2")
+	req := httptest.NewRequest("GET", "/admin", nil)
+	req.AddCookie(cookie)
+	if s.requestAdminSession(req) != nil {
+		t.Error("session still valid after admin token change")
+	}
+}
+
+func TestAdminAPIRejectsTokenInURL(t *testing.T) {
+	s := newTestAdminServer(t)
+	handler := s.adminAuth(func(w http.ResponseWriter, r *http.Request) {})
+
+	req := httptest.NewRequest("GET", "/admin/stats?admin_token=admin-token", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("token in URL: status = %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/admin/stats", nil)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("bearer token: status = %d", w.Code)
+	}
+}
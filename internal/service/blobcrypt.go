@@ -0,0 +1,248 @@
+package service
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// 服务器端静态加密: 每个租户有一个随机的数据密钥, 用主密钥加密后保存在租户信息中,
+// 主密钥只通过启动参数或密钥文件提供, 不写入数据目录。租户的内容存储使用数据密钥
+// AES-256-GCM 加密, 数据目录或其备份被盗时无法读取会话记录 (文件路径和哈希仍在元数据库中)。
+//
+// 加密的内容保存在租户的 sealed/ 下 (明文在 blobs/ 下), 是否加密由存放位置决定, 不根据内容判断。
+// 加密后的内容格式为 blobMagic 加若干条记录, 每条记录为
+// [4 字节长度 (大端)][12 字节随机 nonce][密文]。追加写入时在已有内容后增加一条记录,
+// 不需要重新加密已有的内容。启用加密之前写入的明文读取时原样返回, 并在启动后由 sealBlobs
+// 逐个加密后移到 sealed/ 下
+
+// blobMagic 加密内容的文件头 (格式版本, 用于校验)
+var blobMagic = []byte("\x00CSBLOB1")
+
+// errBlobSealed 内容已加密但没有可用的数据密钥
+var errBlobSealed = errors.New("blob is encrypted but no master key is configured")
+
+// ParseMasterKey 解析主密钥, 接受 64 位十六进制或 base64 编码的 32 字节密钥
+func ParseMasterKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("主密钥必须是 32 字节 (64 位十六进制或 base64 编码), 可以使用 openssl rand -hex 32 生成")
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapDataKey 使用主密钥加密租户的数据密钥, 租户 ID 作为附加数据, 数据密钥不能挪给其他租户使用
+func wrapDataKey(master cipher.AEAD, tenantID string, key []byte) string {
+	nonce := make([]byte, master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(master.Seal(nonce, nonce, key, []byte(tenantID)))
+}
+
+// unwrapDataKey 使用主密钥解密租户的数据密钥
+func unwrapDataKey(master cipher.AEAD, tenantID, wrapped string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(data) < master.NonceSize() {
+		return nil, fmt.Errorf("invalid data key")
+	}
+	n := master.NonceSize()
+	return master.Open(nil, data[:n], data[n:], []byte(tenantID))
+}
+
+// SetMasterKey 设置主密钥并启用静态加密 (在 Start 之前调用): 解密已有租户的数据密钥,
+// 还没有数据密钥的租户生成新密钥。之后写入的内容都会加密, 已有的明文内容在启动后加密
+func (s *Server) SetMasterKey(key []byte) error {
+	master, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.tenants {
+		if t.DataKey == "" {
+			if err := s.newDataKey(master, t); err != nil {
+				return err
+			}
+			if err := s.saveTenant(t); err != nil {
+				t.DataKey = ""
+				t.blobs.aead = nil
+				return err
+			}
+			fmt.Printf("[%s] [%s] 已生成数据密钥, 文件内容将加密保存\n", time.Now().Format("15:04:05"), t.Name)
+			continue
+		}
+		dataKey, err := unwrapDataKey(master, t.ID, t.DataKey)
+		if err != nil {
+			return fmt.Errorf("无法解密租户 %s 的数据密钥, 主密钥不正确", t.Name)
+		}
+		if t.blobs.aead, err = newGCM(dataKey); err != nil {
+			return err
+		}
+	}
+	s.masterKey = master
+	return nil
+}
+
+// newDataKey 为租户生成数据密钥 (调用者需要持有锁并保存租户)
+func (s *Server) newDataKey(master cipher.AEAD, tenant *Tenant) error {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	tenant.DataKey = wrapDataKey(master, tenant.ID, dataKey)
+	tenant.blobs.aead = aead
+	return nil
+}
+
+// checkDataKeys 检查加密过的租户都有可用的数据密钥, 避免没有主密钥时把密文当作内容发给客户端
+func (s *Server) checkDataKeys() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tenants {
+		if t.DataKey != "" && t.blobs.aead == nil {
+			return fmt.Errorf("租户 %s 的数据已加密, 需要通过 -master-key 或 -master-key-file 指定主密钥", t.Name)
+		}
+	}
+	return nil
+}
+
+// sealBlobs 加密启用静态加密之前写入的明文内容。逐个内容加锁, 避免长时间阻塞同步请求
+func (s *Server) sealBlobs() {
+	s.mu.RLock()
+	tenants := make([]*Tenant, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		if t.blobs.aead != nil {
+			tenants = append(tenants, t)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, t := range tenants {
+		keys, err := s.store.List(t.blobs.prefix)
+		if err != nil {
+			continue
+		}
+		sealed := 0
+		for _, key := range keys {
+			s.mu.Lock()
+			ok, err := t.blobs.sealBlob(path.Base(key))
+			s.mu.Unlock()
+			if err != nil {
+				fmt.Printf("[%s] [%s] 加密内容失败: %s: %v\n", time.Now().Format("15:04:05"), t.Name, key, err)
+			}
+			if ok {
+				sealed++
+			}
+		}
+		if sealed > 0 {
+			fmt.Printf("[%s] [%s] 已加密 %d 个之前保存的内容\n", time.Now().Format("15:04:05"), t.Name, sealed)
+		}
+	}
+}
+
+// sealRecord 加密一条记录
+func (b *blobStore) sealRecord(data []byte) []byte {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	record := make([]byte, 4, 4+len(nonce)+len(data)+b.aead.Overhead())
+	record = append(record, nonce...)
+	record = b.aead.Seal(record, nonce, data, nil)
+	binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+	return record
+}
+
+// seal 加密要写入的内容, 未启用静态加密时原样返回
+func (b *blobStore) seal(data []byte) []byte {
+	if b.aead == nil {
+		return data
+	}
+	return append(append([]byte{}, blobMagic...), b.sealRecord(data)...)
+}
+
+// unseal 解密读取的加密内容
+func (b *blobStore) unseal(data []byte) ([]byte, error) {
+	if b.aead == nil {
+		return nil, errBlobSealed
+	}
+	if !bytes.HasPrefix(data, blobMagic) {
+		return nil, fmt.Errorf("blob is corrupted: bad header")
+	}
+
+	var plain []byte
+	rest := data[len(blobMagic):]
+	for len(rest) > 0 {
+		if len(rest) < 4 {
+			return nil, fmt.Errorf("blob is truncated")
+		}
+		n := binary.BigEndian.Uint32(rest)
+		rest = rest[4:]
+		if uint64(n) > uint64(len(rest)) || int(n) < b.aead.NonceSize() {
+			return nil, fmt.Errorf("blob is truncated")
+		}
+		nonce, sealed := rest[:b.aead.NonceSize()], rest[b.aead.NonceSize():n]
+		var err error
+		if plain, err = b.aead.Open(plain, nonce, sealed, nil); err != nil {
+			return nil, fmt.Errorf("blob is corrupted: %v", err)
+		}
+		rest = rest[n:]
+	}
+	return plain, nil
+}
+
+// isSealed 内容是否已加密保存
+func (b *blobStore) isSealed(hash string) bool {
+	file, err := b.store.Open(b.sealedKey(hash))
+	if err != nil {
+		return false
+	}
+	file.Close()
+	return true
+}
+
+// sealBlob 加密启用加密之前写入的明文内容: 先写入加密的内容, 再删除明文, 返回是否做了加密
+// (调用者需要持有锁)。中途退出时两份都在, 读取时使用加密的内容, 下次启动重新加密并删除明文
+func (b *blobStore) sealBlob(hash string) (bool, error) {
+	if b.aead == nil {
+		return false, nil
+	}
+	data, err := b.store.Get(b.key(hash))
+	if err != nil {
+		return false, nil
+	}
+	if err := b.store.Put(b.sealedKey(hash), b.seal(data)); err != nil {
+		return false, err
+	}
+	if err := b.store.Delete(b.key(hash)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
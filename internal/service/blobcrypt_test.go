@@ -0,0 +1,162 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestParseMasterKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, 32)
+	for _, s := range []string{hex.EncodeToString(key), " " + base64.StdEncoding.EncodeToString(key) + "\n"} {
+		got, err := ParseMasterKey(s)
+		if err != nil || !bytes.Equal(got, key) {
+			t.Errorf("ParseMasterKey(%q) = %x, %v", s, got, err)
+		}
+	}
+	for _, s := range []string{"", "abcd", hex.EncodeToString(key[:16]), "not a key at all"} {
+		if _, err := ParseMasterKey(s); err == nil {
+			t.Errorf("ParseMasterKey(%q) should fail", s)
+		}
+	}
+}
+
+func TestWrapDataKey(t *testing.T) {
+	master, _ := newGCM(bytes.Repeat([]byte{1}, 32))
+	other, _ := newGCM(bytes.Repeat([]byte{2}, 32))
+	dataKey := bytes.Repeat([]byte{3}, 32)
+
+	wrapped := wrapDataKey(master, "t1", dataKey)
+	if got, err := unwrapDataKey(master, "t1", wrapped); err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("unwrap = %x, %v", got, err)
+	}
+	if _, err := unwrapDataKey(master, "t2", wrapped); err == nil {
+		t.Error("data key should not unwrap for another tenant")
+	}
+	if _, err := unwrapDataKey(other, "t1", wrapped); err == nil {
+		t.Error("data key should not unwrap with another master key")
+	}
+	if _, err := unwrapDataKey(master, "t1", "!!"); err == nil {
+		t.Error("invalid encoding should fail")
+	}
+}
+
+func TestSealUnseal(t *testing.T) {
+	b := newTestBlobStore(t, NewLocalStorage(t.TempDir()), true)
+
+	sealed := append(b.seal([]byte("line1\n")), b.sealRecord([]byte("line2\n"))...)
+	if !bytes.HasPrefix(sealed, blobMagic) || bytes.Contains(sealed, []byte("line1")) {
+		t.Fatalf("content not sealed: %q", sealed)
+	}
+	if plain, err := b.unseal(sealed); err != nil || string(plain) != "line1\nline2\n" {
+		t.Errorf("unseal = %q, %v", plain, err)
+	}
+
+	if _, err := b.unseal([]byte("plain")); err == nil {
+		t.Error("content without header should fail")
+	}
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := b.unseal(tampered); err == nil {
+		t.Error("tampered content should fail")
+	}
+	if _, err := b.unseal(sealed[:len(sealed)-3]); err == nil {
+		t.Error("truncated content should fail")
+	}
+
+	noKey := newTestBlobStore(t, b.store, false)
+	if _, err := noKey.unseal(sealed); err != errBlobSealed {
+		t.Errorf("unseal without key: %v", err)
+	}
+}
+
+func TestServerMasterKey(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+
+	s, err := NewServer(0, dir, "tenant-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant := s.tenants["default"]
+	content := []byte("secret transcript\n")
+	hash := hashBytes(content)
+	tenant.blobs.Put(hash, content)
+
+	if err := s.SetMasterKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if tenant.DataKey == "" {
+		t.Fatal("data key not generated")
+	}
+	s.sealBlobs()
+	raw, err := s.store.Get(tenant.blobs.sealedKey(hash))
+	if err != nil || !bytes.HasPrefix(raw, blobMagic) || bytes.Contains(raw, []byte("secret")) {
+		t.Fatalf("blob not sealed: %q, %v", raw, err)
+	}
+	if _, err := s.store.Get(tenant.blobs.key(hash)); err == nil {
+		t.Error("plaintext should be removed after sealing")
+	}
+	if plain, err := tenant.blobs.Read(hash); err != nil || !bytes.Equal(plain, content) {
+		t.Errorf("Read = %q, %v", plain, err)
+	}
+	s.Close()
+
+	// 重新启动时没有主密钥或主密钥不正确都应报错
+	s, err = NewServer(0, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.checkDataKeys(); err == nil {
+		t.Error("checkDataKeys should fail without master key")
+	}
+	if err := s.SetMasterKey(bytes.Repeat([]byte{8}, 32)); err == nil || !strings.Contains(err.Error(), "主密钥不正确") {
+		t.Errorf("wrong master key: %v", err)
+	}
+	if err := s.SetMasterKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := s.tenants["default"].blobs.Read(hash); err != nil || !bytes.Equal(plain, content) {
+		t.Errorf("Read after restart = %q, %v", plain, err)
+	}
+}
+
+func TestPlaintextWithBlobMagic(t *testing.T) {
+	// 明文内容恰好以加密文件头开头: 是否加密由存放位置决定, 不会被误当作密文
+	store := NewLocalStorage(t.TempDir())
+	content := append(append([]byte{}, blobMagic...), "not encrypted\n"...)
+	hash := hashBytes(content)
+
+	plain := newTestBlobStore(t, store, false)
+	if err := plain.Put(hash, content); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := plain.Read(hash); err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("plain Read = %q, %v", data, err)
+	}
+
+	// 启用加密后读取明文, 并由 sealBlob 加密
+	b := newTestBlobStore(t, store, true)
+	b.refs = plain.refs
+	if data, err := b.Read(hash); err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("Read before sealing = %q, %v", data, err)
+	}
+	if ok, err := b.sealBlob(hash); !ok || err != nil {
+		t.Fatalf("sealBlob = %v, %v", ok, err)
+	}
+	if !b.isSealed(hash) {
+		t.Error("content should be sealed")
+	}
+	if data, err := b.Read(hash); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("Read after sealing = %q, %v", data, err)
+	}
+
+	// 没有数据密钥时不能把加密的内容当作明文返回
+	if _, err := plain.Read(hash); err != errBlobSealed {
+		t.Errorf("Read without key: %v", err)
+	}
+}
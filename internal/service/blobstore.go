@@ -0,0 +1,217 @@
+package service
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"io"
+	"os"
+	"path"
+)
+
+// blobStore 租户的内容寻址存储: 内容按 SHA-256 哈希存放, 相同内容只存一份。
+// 引用计数记录有多少个文件 (当前版本和历史版本) 使用同一份内容, 归零时删除 (调用者需要持有锁)。
+// 上传在锁外写入内容 (Pin → Write → 加锁提交 Ref → Unpin), 固定期间内容不会被删除
+// 明文内容和加密内容分别存放在 blobs/ 和 sealed/ 下, 内容是否加密由存放位置决定 (见 blobcrypt.go)
+type blobStore struct {
+	store        Storage
+	prefix       string // 明文内容, 如 tenants/<id>/blobs/
+	sealedPrefix string // 加密内容, 如 tenants/<id>/sealed/
+	refs         map[string]int
+	pins         map[string]int // 正在锁外写入、尚未提交引用的内容
+	aead         cipher.AEAD    // 租户的数据密钥, 为空时不加密
+}
+
+// newBlobStore 创建保存在 root (如 tenants/<id>/) 下的内容存储
+func newBlobStore(store Storage, root string) *blobStore {
+	return &blobStore{
+		store:        store,
+		prefix:       root + "blobs/",
+		sealedPrefix: root + "sealed/",
+		refs:         make(map[string]int),
+		pins:         make(map[string]int),
+	}
+}
+
+// key 明文内容的存储键, 按哈希前两位分目录
+func (b *blobStore) key(hash string) string {
+	return b.prefix + hashDir(hash)
+}
+
+// sealedKey 加密内容的存储键
+func (b *blobStore) sealedKey(hash string) string {
+	return b.sealedPrefix + hashDir(hash)
+}
+
+func hashDir(hash string) string {
+	if len(hash) < 2 {
+		return "_/" + hash
+	}
+	return hash[:2] + "/" + hash
+}
+
+// List 列出存储中的所有内容 (明文和加密的)
+func (b *blobStore) List() ([]string, error) {
+	keys, err := b.store.List(b.prefix)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := b.store.List(b.sealedPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return append(keys, sealed...), nil
+}
+
+// Open 打开内容用于流式读取; 加密的内容需要先完整读取并解密
+func (b *blobStore) Open(hash string) (io.ReadCloser, error) {
+	if b.aead == nil {
+		return b.store.Open(b.key(hash))
+	}
+	data, err := b.Read(hash)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Read 读取内容。启用加密时先读加密的内容, 不存在时读取启用加密之前写入的明文;
+// 未启用加密时读取明文, 只有加密的内容时报错
+func (b *blobStore) Read(hash string) ([]byte, error) {
+	if b.aead == nil {
+		data, err := b.store.Get(b.key(hash))
+		if os.IsNotExist(err) && b.isSealed(hash) {
+			return nil, errBlobSealed
+		}
+		return data, err
+	}
+
+	data, err := b.store.Get(b.sealedKey(hash))
+	if os.IsNotExist(err) {
+		return b.store.Get(b.key(hash))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.unseal(data)
+}
+
+// remove 删除内容 (明文和加密的)
+func (b *blobStore) remove(hash string) {
+	b.store.Delete(b.key(hash))
+	b.store.Delete(b.sealedKey(hash))
+}
+
+// Put 增加一次引用, 内容尚未被引用时写入
+func (b *blobStore) Put(hash string, data []byte) error {
+	if b.refs[hash] == 0 {
+		if err := b.Write(hash, data); err != nil {
+			return err
+		}
+	}
+	b.refs[hash]++
+	return nil
+}
+
+// Write 写入内容, 启用加密时加密保存; 不改变引用 (不需要持有锁, 调用者需要先 Pin)
+func (b *blobStore) Write(hash string, data []byte) error {
+	if b.aead == nil {
+		return b.store.Put(b.key(hash), data)
+	}
+	return b.store.Put(b.sealedKey(hash), b.seal(data))
+}
+
+// Pin 固定内容, 直到 Unpin 之前引用归零也不删除; 返回内容是否已保存 (调用者需要持有锁)
+func (b *blobStore) Pin(hash string) bool {
+	b.pins[hash]++
+	return b.refs[hash] > 0
+}
+
+// Unpin 解除固定, 写入后没有被引用 (提交失败) 的内容随之删除 (调用者需要持有锁)
+func (b *blobStore) Unpin(hash string) {
+	if b.pins[hash] > 1 {
+		b.pins[hash]--
+		return
+	}
+	delete(b.pins, hash)
+	if b.refs[hash] == 0 {
+		b.remove(hash)
+	}
+}
+
+// Ref 为已存在的内容增加一次引用
+func (b *blobStore) Ref(hash string) {
+	b.refs[hash]++
+}
+
+// Release 减少一次引用, 没有引用时删除内容
+func (b *blobStore) Release(hash string) {
+	if b.refs[hash] > 1 {
+		b.refs[hash]--
+		return
+	}
+	delete(b.refs, hash)
+	if b.pins[hash] == 0 {
+		b.remove(hash)
+	}
+}
+
+// Extend 将一次对 oldHash 的引用替换为对 newHash (oldHash 的内容追加 suffix) 的引用。
+// 新内容总是写入新的对象, 写入完成后才释放旧内容: 中途失败时旧内容保持不变, 引用它的
+// 当前版本和历史版本都不受影响。存储支持 copyAppender 时在存储内部复制, 不需要读入整个文件
+// (加密的内容追加一条新记录, 尚未加密的旧内容需要重新写入)
+func (b *blobStore) Extend(oldHash, newHash string, suffix []byte) error {
+	if b.refs[newHash] == 0 {
+		if err := b.WriteExtended(oldHash, newHash, suffix); err != nil {
+			return err
+		}
+	}
+	b.refs[newHash]++
+	b.Release(oldHash)
+	return nil
+}
+
+// WriteExtended 将 oldHash 的内容追加 suffix 写入 newHash, 不改变引用 (不需要持有锁, 调用者需要先 Pin)
+func (b *blobStore) WriteExtended(oldHash, newHash string, suffix []byte) error {
+	if c, ok := b.store.(copyAppender); ok {
+		switch {
+		case b.aead == nil:
+			return c.CopyAppend(b.key(oldHash), b.key(newHash), suffix)
+		case b.isSealed(oldHash):
+			return c.CopyAppend(b.sealedKey(oldHash), b.sealedKey(newHash), b.sealRecord(suffix))
+		}
+	}
+	base, err := b.Read(oldHash)
+	if err != nil {
+		return err
+	}
+	return b.Write(newHash, append(base, suffix...))
+}
+
+// Import 将已有对象移入存储 (不增加引用), 内容已存在时删除该对象; 用于迁移旧的数据布局
+func (b *blobStore) Import(hash, src string) error {
+	existing, err := b.store.Open(b.key(hash))
+	if err == nil {
+		existing.Close()
+		return b.store.Delete(src)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if b.isSealed(hash) {
+		return b.store.Delete(src)
+	}
+	return moveKey(b.store, src, b.key(hash))
+}
+
+// Sweep 删除 keys (由 List 得到) 中没有任何引用的内容, 返回删除的数量
+func (b *blobStore) Sweep(keys []string) int {
+	removed := 0
+	for _, key := range keys {
+		if hash := path.Base(key); b.refs[hash] == 0 && b.pins[hash] == 0 {
+			if b.store.Delete(key) == nil {
+				removed++
+			}
+		}
+	}
+	return removed
+}
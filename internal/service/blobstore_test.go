@@ -0,0 +1,141 @@
+package service
+
+import (
+	"errors"
+	"testing"
+)
+
+// failingCopy 模拟写入新对象时失败的存储
+type failingCopy struct {
+	*LocalStorage
+}
+
+func (f failingCopy) CopyAppend(srcKey, dstKey string, data []byte) error {
+	return errors.New("disk full")
+}
+
+func newTestBlobStore(t *testing.T, store Storage, encrypt bool) *blobStore {
+	t.Helper()
+	b := newBlobStore(store, "")
+	if encrypt {
+		aead, err := newGCM(make([]byte, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.aead = aead
+	}
+	return b
+}
+
+func TestBlobStoreExtendWritesNewObject(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		b := newTestBlobStore(t, NewLocalStorage(t.TempDir()), encrypt)
+		if err := b.Put("old", []byte("line1\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Extend("old", "new", []byte("line2\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := b.Read("new")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "line1\nline2\n" {
+			t.Errorf("encrypt=%v: new = %q", encrypt, data)
+		}
+		if _, err := b.store.Get(b.key("old")); err == nil {
+			t.Errorf("encrypt=%v: old blob should be released", encrypt)
+		}
+		if b.refs["old"] != 0 || b.refs["new"] != 1 {
+			t.Errorf("encrypt=%v: refs = %v", encrypt, b.refs)
+		}
+	}
+}
+
+func TestBlobStoreExtendKeepsSharedBase(t *testing.T) {
+	b := newTestBlobStore(t, NewLocalStorage(t.TempDir()), false)
+	b.Put("old", []byte("a\n"))
+	b.Ref("old") // 历史版本也引用了旧内容
+
+	if err := b.Extend("old", "new", []byte("b\n")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := b.Read("old"); err != nil || string(data) != "a\n" {
+		t.Errorf("old = %q, %v", data, err)
+	}
+	if data, err := b.Read("new"); err != nil || string(data) != "a\nb\n" {
+		t.Errorf("new = %q, %v", data, err)
+	}
+}
+
+func TestBlobStoreExtendFailureKeepsOldObject(t *testing.T) {
+	b := newTestBlobStore(t, failingCopy{NewLocalStorage(t.TempDir())}, false)
+	b.Put("old", []byte("a\n"))
+
+	if err := b.Extend("old", "new", []byte("b\n")); err == nil {
+		t.Fatal("expected error")
+	}
+	if data, err := b.Read("old"); err != nil || string(data) != "a\n" {
+		t.Errorf("old = %q, %v", data, err)
+	}
+	if _, err := b.store.Get(b.key("new")); err == nil {
+		t.Error("new blob should not exist")
+	}
+	if b.refs["old"] != 1 || b.refs["new"] != 0 {
+		t.Errorf("refs = %v", b.refs)
+	}
+}
+
+func TestBlobStoreExtendPlainBaseWithEncryption(t *testing.T) {
+	store := NewLocalStorage(t.TempDir())
+	plain := newTestBlobStore(t, store, false)
+	plain.Put("old", []byte("a\n"))
+
+	// 启用加密前写入的明文内容追加时整体重新加密
+	b := newTestBlobStore(t, store, true)
+	b.refs = plain.refs
+	if err := b.Extend("old", "new", []byte("b\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !b.isSealed("new") {
+		t.Error("new blob should be sealed")
+	}
+	if data, err := b.Read("new"); err != nil || string(data) != "a\nb\n" {
+		t.Errorf("new = %q, %v", data, err)
+	}
+}
+
+func TestBlobStorePinKeepsReleasedContent(t *testing.T) {
+	b := newTestBlobStore(t, NewLocalStorage(t.TempDir()), false)
+	b.Put("h", []byte("a\n"))
+
+	// 锁外写入期间最后一个引用被释放: 内容保留, 提交后继续使用
+	if !b.Pin("h") {
+		t.Error("pinned content should be reported as stored")
+	}
+	b.Release("h")
+	if _, err := b.store.Get(b.key("h")); err != nil {
+		t.Fatalf("pinned content removed: %v", err)
+	}
+	b.Ref("h")
+	b.Unpin("h")
+	if data, err := b.Read("h"); err != nil || string(data) != "a\n" {
+		t.Errorf("committed content = %q, %v", data, err)
+	}
+
+	// 写入后没有提交引用的内容在解除固定时删除
+	if b.Pin("x") {
+		t.Error("new content should not be reported as stored")
+	}
+	if err := b.Write("x", []byte("b\n")); err != nil {
+		t.Fatal(err)
+	}
+	if removed := b.Sweep([]string{b.key("x")}); removed != 0 {
+		t.Errorf("sweep removed %d pinned blobs", removed)
+	}
+	b.Unpin("x")
+	if _, err := b.store.Get(b.key("x")); err == nil {
+		t.Error("uncommitted content should be removed")
+	}
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 冲突解决方式
+const (
+	KeepLocal  = "local"  // 保留本地版本 (冲突副本覆盖服务器版本)
+	KeepRemote = "remote" // 保留服务器版本 (删除冲突副本)
+	KeepBoth   = "both"   // 两者都保留 (冲突副本作为独立文件继续同步)
+)
+
+// keepConflictCopies 将冲突文件的本地版本另存为冲突副本, 返回需要下载的服务器版本
+func (s *SyncService) keepConflictCopies(conflicts []FileInfo) []FileInfo {
+	var download []FileInfo
+	now := time.Now()
+	for _, f := range conflicts {
+		localPath := s.localPath(f.Path)
+		if localPath == "" {
+			continue
+		}
+		src := filepath.Join(s.claudeDir, localPath)
+
+		if _, err := os.Stat(src); err == nil {
+			copyPath := s.conflictCopyPath(localPath, now)
+			if err := os.Rename(src, filepath.Join(s.claudeDir, copyPath)); err != nil {
+				fmt.Printf("保存冲突副本失败: %s: %v\n", localPath, err)
+				continue
+			}
+			if info, err := os.Stat(filepath.Join(s.claudeDir, copyPath)); err == nil {
+				s.refreshFile(copyPath, info)
+			}
+			s.state.PutConflict(Conflict{
+				Path:       localPath,
+				CopyPath:   copyPath,
+				RemoteRev:  f.Rev,
+				DetectedAt: now.Unix(),
+			})
+		}
+
+		// 原路径改为服务器版本; 清除状态, 避免被当作本地删除
+		s.state.Delete(localPath)
+		download = append(download, f)
+	}
+	return download
+}
+
+// conflictCopyPath 生成冲突副本路径: name.conflict-<machine>-<time>.ext
+func (s *SyncService) conflictCopyPath(localPath string, t time.Time) string {
+	machine := sanitizeName(s.config.MachineName)
+	if machine == "" {
+		machine = s.config.MachineID
+		if len(machine) > 8 {
+			machine = machine[:8]
+		}
+	}
+
+	ext := filepath.Ext(localPath)
+	base := strings.TrimSuffix(localPath, ext)
+	stamp := t.Format("20060102-150405")
+	copyPath := fmt.Sprintf("%s.conflict-%s-%s%s", base, machine, stamp, ext)
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(filepath.Join(s.claudeDir, copyPath)); os.IsNotExist(err) {
+			return copyPath
+		}
+		copyPath = fmt.Sprintf("%s.conflict-%s-%s-%d%s", base, machine, stamp, i, ext)
+	}
+}
+
+// sanitizeName 去掉机器名中不适合出现在文件名里的字符
+func sanitizeName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			b.WriteRune(r)
+		case r == ' ' || r == '.':
+			b.WriteRune('-')
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+// Conflicts 返回未解决的冲突
+func (s *SyncService) Conflicts() []Conflict {
+	return s.state.Conflicts()
+}
+
+// ResolveConflict 解决冲突; keep 为 KeepLocal、KeepRemote 或 KeepBoth
+func (s *SyncService) ResolveConflict(path, keep string) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	defer s.state.Save()
+
+	c, ok := s.state.GetConflict(path)
+	if !ok {
+		return fmt.Errorf("冲突不存在: %s", path)
+	}
+
+	original := filepath.Join(s.claudeDir, c.Path)
+	copyFile := filepath.Join(s.claudeDir, c.CopyPath)
+
+	switch keep {
+	case KeepLocal:
+		// 冲突副本覆盖服务器版本; 原路径的基准版本仍是服务器版本, 下次同步会正常上传
+		if err := os.Rename(copyFile, original); err != nil {
+			return fmt.Errorf("恢复本地版本失败: %v", err)
+		}
+		if info, err := os.Stat(original); err == nil {
+			s.refreshFile(c.Path, info)
+		}
+		s.refreshFile(c.CopyPath, nil)
+	case KeepRemote:
+		if err := os.Remove(copyFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("删除冲突副本失败: %v", err)
+		}
+		s.refreshFile(c.CopyPath, nil)
+	case KeepBoth:
+	default:
+		return fmt.Errorf("未知的解决方式: %s", keep)
+	}
+
+	s.state.DeleteConflict(path)
+	return nil
+}
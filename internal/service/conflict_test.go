@@ -0,0 +1,161 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/k0ngk0ng/claude-sync/internal/config"
+)
+
+// newTestConflict 制造一个冲突: 本地版本另存为冲突副本, 原路径写入下载的服务器版本
+func newTestConflict(t *testing.T) (*SyncService, Conflict) {
+	t.Helper()
+	s := newTestSyncService(t, &config.Config{MachineID: "machine-1", MachineName: "My Laptop"})
+	rel := filepath.Join("projects", "p", "s.jsonl")
+	writeTestFile(t, s, rel, "local\n")
+	s.state.Put(rel, FileState{SyncedHash: hashBytes([]byte("base\n")), Rev: 1})
+
+	remote := remoteFile("projects/p/s.jsonl", "remote\n")
+	remote.Rev = 5
+	download := s.keepConflictCopies([]FileInfo{remote})
+	if len(download) != 1 || download[0].Path != remote.Path {
+		t.Fatalf("download = %+v", download)
+	}
+	c, ok := s.state.GetConflict(rel)
+	if !ok {
+		t.Fatal("conflict not recorded")
+	}
+
+	writeTestFile(t, s, rel, "remote\n")
+	s.state.Put(rel, FileState{SyncedHash: remote.Hash, Rev: remote.Rev})
+	return s, c
+}
+
+func TestKeepConflictCopies(t *testing.T) {
+	s, c := newTestConflict(t)
+
+	rel := filepath.Join("projects", "p", "s.jsonl")
+	if c.Path != rel || c.RemoteRev != 5 || c.DetectedAt == 0 {
+		t.Errorf("conflict = %+v", c)
+	}
+	if dir, name := filepath.Split(c.CopyPath); dir != filepath.Join("projects", "p")+string(filepath.Separator) ||
+		!strings.HasPrefix(name, "s.conflict-My-Laptop-") || !strings.HasSuffix(name, ".jsonl") {
+		t.Errorf("copy path = %q", c.CopyPath)
+	}
+	if got := readTestFile(t, s, c.CopyPath); got != "local\n" {
+		t.Errorf("conflict copy = %q", got)
+	}
+	if st, ok := s.state.Get(c.CopyPath); !ok || st.Hash != hashBytes([]byte("local\n")) || st.Synced() {
+		t.Errorf("conflict copy state = %+v, %v", st, ok)
+	}
+
+	// 同一秒内再次冲突时副本不覆盖之前的副本
+	writeTestFile(t, s, rel, "local again\n")
+	s.keepConflictCopies([]FileInfo{remoteFile("projects/p/s.jsonl", "remote\n")})
+	again, _ := s.state.GetConflict(rel)
+	if again.CopyPath == c.CopyPath || readTestFile(t, s, c.CopyPath) != "local\n" || readTestFile(t, s, again.CopyPath) != "local again\n" {
+		t.Errorf("second conflict copy %q overwrote %q", again.CopyPath, c.CopyPath)
+	}
+}
+
+func TestKeepConflictCopiesWithoutLocalFile(t *testing.T) {
+	s := newTestSyncService(t, &config.Config{MachineID: "machine-1"})
+	rel := filepath.Join("projects", "p", "s.jsonl")
+	s.state.Put(rel, FileState{SyncedHash: hashBytes([]byte("base\n")), Rev: 1})
+
+	download := s.keepConflictCopies([]FileInfo{remoteFile("projects/p/s.jsonl", "remote\n")})
+	if len(download) != 1 {
+		t.Fatalf("download = %+v", download)
+	}
+	if _, ok := s.state.GetConflict(rel); ok {
+		t.Error("conflict recorded without a local version")
+	}
+	// 清除状态, 下载前不会被当作本地删除
+	if _, ok := s.state.Get(rel); ok {
+		t.Error("state of the original path kept")
+	}
+}
+
+func TestResolveConflictKeepLocal(t *testing.T) {
+	s, c := newTestConflict(t)
+	if err := s.ResolveConflict(c.Path, KeepLocal); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, s, c.Path); got != "local\n" {
+		t.Errorf("original = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(s.claudeDir, c.CopyPath)); !os.IsNotExist(err) {
+		t.Errorf("conflict copy still exists: %v", err)
+	}
+	// 基准仍是服务器版本, 下次同步作为本地修改上传
+	st, _ := s.state.Get(c.Path)
+	if st.Hash != hashBytes([]byte("local\n")) || st.SyncedHash != hashBytes([]byte("remote\n")) || st.Rev != 5 {
+		t.Errorf("original state = %+v", st)
+	}
+	if _, ok := s.state.Get(c.CopyPath); ok {
+		t.Error("conflict copy state kept")
+	}
+	if _, ok := s.state.GetConflict(c.Path); ok {
+		t.Error("conflict not resolved")
+	}
+}
+
+func TestResolveConflictKeepRemote(t *testing.T) {
+	s, c := newTestConflict(t)
+	if err := s.ResolveConflict(c.Path, KeepRemote); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, s, c.Path); got != "remote\n" {
+		t.Errorf("original = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(s.claudeDir, c.CopyPath)); !os.IsNotExist(err) {
+		t.Errorf("conflict copy still exists: %v", err)
+	}
+	if _, ok := s.state.Get(c.CopyPath); ok {
+		t.Error("conflict copy state kept")
+	}
+	if len(s.Conflicts()) != 0 {
+		t.Errorf("conflicts = %+v", s.Conflicts())
+	}
+
+	// 冲突副本已被手动删除时也能解决
+	s, c = newTestConflict(t)
+	os.Remove(filepath.Join(s.claudeDir, c.CopyPath))
+	if err := s.ResolveConflict(c.Path, KeepRemote); err != nil {
+		t.Errorf("resolve without copy: %v", err)
+	}
+}
+
+func TestResolveConflictKeepBoth(t *testing.T) {
+	s, c := newTestConflict(t)
+	if err := s.ResolveConflict(c.Path, KeepBoth); err != nil {
+		t.Fatal(err)
+	}
+	if readTestFile(t, s, c.Path) != "remote\n" || readTestFile(t, s, c.CopyPath) != "local\n" {
+		t.Error("both versions should be kept")
+	}
+	if st, ok := s.state.Get(c.CopyPath); !ok || st.Hash != hashBytes([]byte("local\n")) {
+		t.Errorf("conflict copy state = %+v, %v", st, ok)
+	}
+	if len(s.Conflicts()) != 0 {
+		t.Errorf("conflicts = %+v", s.Conflicts())
+	}
+}
+
+func TestResolveConflictRejectsUnknown(t *testing.T) {
+	s, c := newTestConflict(t)
+	if err := s.ResolveConflict(c.Path, "mine"); err == nil {
+		t.Error("unknown resolution accepted")
+	}
+	if _, ok := s.state.GetConflict(c.Path); !ok {
+		t.Error("conflict removed by a failed resolution")
+	}
+	if readTestFile(t, s, c.CopyPath) != "local\n" {
+		t.Error("conflict copy changed by a failed resolution")
+	}
+	if err := s.ResolveConflict("projects/other.jsonl", KeepLocal); err == nil {
+		t.Error("resolving a missing conflict succeeded")
+	}
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// errBaseMismatch 追加传输的基准内容与本地不一致, 需要完整传输
+var errBaseMismatch = errors.New("base content mismatch")
+
+// hashBytes 计算内容的 SHA-256 哈希
+func hashBytes(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// makeAppendDelta 如果 f.Content 是在基准内容之后追加而来, 只保留追加的部分
+func makeAppendDelta(f FileInfo, baseHash string, baseSize int64) (FileInfo, bool) {
+	if baseHash == "" || baseSize <= 0 || int64(len(f.Content)) <= baseSize {
+		return f, false
+	}
+	if hashBytes(f.Content[:baseSize]) != baseHash {
+		return f, false
+	}
+	f.Offset = baseSize
+	f.BaseHash = baseHash
+	f.Content = f.Content[baseSize:]
+	return f, true
+}
+
+// applyAppendDelta 把追加的部分拼接到基准内容之后, 并校验基准和结果的哈希
+func applyAppendDelta(base []byte, f FileInfo) ([]byte, error) {
+	if int64(len(base)) != f.Offset || hashBytes(base) != f.BaseHash {
+		return nil, errBaseMismatch
+	}
+	content := make([]byte, 0, len(base)+len(f.Content))
+	content = append(content, base...)
+	content = append(content, f.Content...)
+	if hashBytes(content) != f.Hash {
+		return nil, errBaseMismatch
+	}
+	return content, nil
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAppendDeltaRoundTrip(t *testing.T) {
+	base := []byte("a\nb\n")
+	full := FileInfo{Path: "s.jsonl", Hash: hashBytes([]byte("a\nb\nc\n")), Content: []byte("a\nb\nc\n")}
+
+	delta, ok := makeAppendDelta(full, hashBytes(base), int64(len(base)))
+	if !ok {
+		t.Fatal("append not detected")
+	}
+	if delta.Offset != int64(len(base)) || delta.BaseHash != hashBytes(base) || string(delta.Content) != "c\n" {
+		t.Fatalf("delta = %+v", delta)
+	}
+	content, err := applyAppendDelta(base, delta)
+	if err != nil || string(content) != "a\nb\nc\n" {
+		t.Errorf("applyAppendDelta = %q, %v", content, err)
+	}
+}
+
+func TestMakeAppendDeltaFallsBackToFullContent(t *testing.T) {
+	base := []byte("a\nb\n")
+	content := []byte("a\nb\nc\n")
+	f := FileInfo{Path: "s.jsonl", Hash: hashBytes(content), Content: content}
+
+	cases := map[string]struct {
+		hash string
+		size int64
+	}{
+		"no base":          {"", int64(len(base))},
+		"empty base":       {hashBytes(nil), 0},
+		"not longer":       {hashBytes(content), int64(len(content))},
+		"base too long":    {hashBytes(base), int64(len(content) + 1)},
+		"base rewritten":   {hashBytes([]byte("x\ny\n")), int64(len(base))},
+		"size of old base": {hashBytes(base), int64(len(base)) - 1},
+	}
+	for name, c := range cases {
+		got, ok := makeAppendDelta(f, c.hash, c.size)
+		if ok || got.Offset != 0 || got.BaseHash != "" || string(got.Content) != string(content) {
+			t.Errorf("%s: makeAppendDelta = %+v, %v", name, got, ok)
+		}
+	}
+}
+
+func TestApplyAppendDeltaRejectsMismatch(t *testing.T) {
+	base := []byte("a\nb\n")
+	delta := FileInfo{
+		Path:     "s.jsonl",
+		Hash:     hashBytes([]byte("a\nb\nc\n")),
+		Content:  []byte("c\n"),
+		Offset:   int64(len(base)),
+		BaseHash: hashBytes(base),
+	}
+
+	cases := map[string]struct {
+		base  []byte
+		delta func(FileInfo) FileInfo
+	}{
+		"shorter base":   {[]byte("a\n"), nil},
+		"longer base":    {[]byte("a\nb\nc\n"), nil},
+		"different base": {[]byte("x\ny\n"), nil},
+		"wrong offset":   {base, func(f FileInfo) FileInfo { f.Offset--; return f }},
+		"wrong base hash": {base, func(f FileInfo) FileInfo {
+			f.BaseHash = hashBytes([]byte("x\ny\n"))
+			return f
+		}},
+		"wrong result hash": {base, func(f FileInfo) FileInfo {
+			f.Hash = hashBytes([]byte("a\nb\nd\n"))
+			return f
+		}},
+		"corrupted suffix": {base, func(f FileInfo) FileInfo {
+			f.Content = []byte("d\n")
+			return f
+		}},
+	}
+	for name, c := range cases {
+		f := delta
+		if c.delta != nil {
+			f = c.delta(f)
+		}
+		if content, err := applyAppendDelta(c.base, f); !errors.Is(err, errBaseMismatch) {
+			t.Errorf("%s: applyAppendDelta = %q, %v", name, content, err)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Device 设备凭据, 绑定到客户端的 MachineID
+type Device struct {
+	MachineID   string    `json:"machine_id"`
+	MachineName string    `json:"machine_name"`
+	TokenHash   string    `json:"token_hash"`
+	Scope       Scope     `json:"scope"`
+	EnrolledAt  time.Time `json:"enrolled_at"`
+	RevokedAt   time.Time `json:"revoked_at"` // 为零值时有效
+}
+
+// Revoked 设备凭据是否已撤销
+func (d *Device) Revoked() bool {
+	return !d.RevokedAt.IsZero()
+}
+
+// EnrollRequest 设备注册请求
+type EnrollRequest struct {
+	MachineID   string `json:"machine_id"`
+	MachineName string `json:"machine_name"`
+	Scope       Scope  `json:"scope"` // 为空时为完全权限
+}
+
+// EnrollResponse 设备注册响应, Token 只在此时返回一次
+type EnrollResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Token   string `json:"token,omitempty"`
+}
+
+// RevokeDeviceRequest 撤销设备请求
+type RevokeDeviceRequest struct {
+	MachineID string `json:"machine_id"`
+}
+
+// machineIDHeader 客户端在每个请求中发送本机的 MachineID, 设备凭据只能由绑定的机器使用
+const machineIDHeader = "X-Machine-ID"
+
+type deviceContextKey struct{}
+
+// requestDevice 获取请求使用的设备凭据, 使用租户令牌时为空
+func requestDevice(r *http.Request) *Device {
+	d, _ := r.Context().Value(deviceContextKey{}).(*Device)
+	return d
+}
+
+// deviceMatches 请求中声明的 MachineID 是否与使用的设备凭据一致, 使用租户令牌时总是一致
+func deviceMatches(r *http.Request, machineID string) bool {
+	d := requestDevice(r)
+	return d == nil || d.MachineID == machineID
+}
+
+// findDevice 根据令牌查找设备 (调用者需要持有锁); 已撤销的设备也会返回, 由调用者拒绝
+func (t *Tenant) findDevice(token string) *Device {
+	for _, d := range t.Devices {
+		if verifyToken(token, d.TokenHash) {
+			return d
+		}
+	}
+	return nil
+}
+
+// errDeviceExists 使用配对码注册的机器已有设备凭据 (包括已撤销的)
+var errDeviceExists = errors.New("machine is already enrolled")
+
+// EnrollDevice 为机器签发权限范围为 scope 的设备凭据; 同一机器重新注册时替换旧凭据 (包括已撤销的),
+// 只用于持有租户令牌的注册
+func (s *Server) EnrollDevice(tenant *Tenant, machineID, machineName, ip string, scope Scope) (string, error) {
+	return s.enrollDevice(tenant, machineID, machineName, ip, scope, true)
+}
+
+// PairDevice 为使用配对码的机器签发设备凭据。配对码不能证明请求来自已注册的那台机器,
+// 机器已有设备凭据时返回 errDeviceExists, 避免替换权限更大的设备或恢复已撤销的设备
+func (s *Server) PairDevice(tenant *Tenant, machineID, machineName, ip string, scope Scope) (string, error) {
+	return s.enrollDevice(tenant, machineID, machineName, ip, scope, false)
+}
+
+func (s *Server) enrollDevice(tenant *Tenant, machineID, machineName, ip string, scope Scope, replace bool) (string, error) {
+	if machineID == "" {
+		return "", fmt.Errorf("machine ID required")
+	}
+	scope, err := scope.normalize()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, exists := tenant.Devices[machineID]
+	if exists && !replace {
+		fmt.Printf("[%s] [%s] 拒绝配对: %s (%s) 已注册过设备凭据\n",
+			time.Now().Format("15:04:05"), tenant.Name, machineName, machineID)
+		return "", errDeviceExists
+	}
+
+	token := generateToken()
+	now := time.Now()
+	tenant.Devices[machineID] = &Device{
+		MachineID:   machineID,
+		MachineName: machineName,
+		TokenHash:   hashToken(token),
+		Scope:       scope,
+		EnrolledAt:  now,
+	}
+	_, known := tenant.Clients[machineID]
+	if !known {
+		tenant.Clients[machineID] = &ClientInfo{
+			MachineID:   machineID,
+			MachineName: machineName,
+			LastSeen:    now,
+			IP:          ip,
+		}
+	}
+	if err := s.saveTenant(tenant); err != nil {
+		// 保存失败时恢复原来的设备凭据, 不能让已有设备失效
+		if exists {
+			tenant.Devices[machineID] = previous
+		} else {
+			delete(tenant.Devices, machineID)
+		}
+		if !known {
+			delete(tenant.Clients, machineID)
+		}
+		return "", err
+	}
+
+	fmt.Printf("[%s] [%s] 设备注册: %s (%s), 权限: %s\n", now.Format("15:04:05"), tenant.Name, machineName, machineID, scope)
+	return token, nil
+}
+
+// RevokeDevice 撤销设备凭据, 该设备之后的请求立即被拒绝
+func (s *Server) RevokeDevice(tenant *Tenant, machineID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := tenant.Devices[machineID]
+	if !ok {
+		return fmt.Errorf("device not found")
+	}
+	if d.Revoked() {
+		return nil
+	}
+	d.RevokedAt = time.Now()
+	if err := s.saveTenant(tenant); err != nil {
+		d.RevokedAt = time.Time{}
+		return err
+	}
+
+	fmt.Printf("[%s] [%s] 设备已撤销: %s (%s)\n", time.Now().Format("15:04:05"), tenant.Name, d.MachineName, machineID)
+	return nil
+}
+
+// clientList 返回租户的客户端列表 (调用者需要持有锁), 附带设备凭据状态, 按最后活跃时间排序
+func (t *Tenant) clientList() []*ClientInfo {
+	clients := make([]*ClientInfo, 0, len(t.Clients))
+	for id, c := range t.Clients {
+		info := *c
+		if d, ok := t.Devices[id]; ok {
+			enrolled := d.EnrolledAt
+			info.EnrolledAt = &enrolled
+			if !d.Scope.IsFull() {
+				scope := d.Scope
+				info.Scope = &scope
+			}
+			if d.Revoked() {
+				revoked := d.RevokedAt
+				info.RevokedAt = &revoked
+			}
+		}
+		clients = append(clients, &info)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].LastSeen.After(clients[j].LastSeen)
+	})
+	return clients
+}
+
+// handleDeviceEnroll 为当前机器签发设备凭据; 只能使用租户令牌注册, 设备凭据不能再签发新凭据
+func (s *Server) handleDeviceEnroll(w http.ResponseWriter, r *http.Request, tenant *Tenant) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requestDevice(r) != nil {
+		http.Error(w, "Tenant token required", http.StatusForbidden)
+		return
+	}
+
+	var req EnrollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, err := s.EnrollDevice(tenant, req.MachineID, req.MachineName, clientIP(r), req.Scope)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EnrollResponse{
+		Success: true,
+		Message: "OK",
+		Token:   token,
+	})
+}
+
+// handleDeviceRevoke 撤销租户的某台设备 (例如丢失的电脑), 受限的凭据不能管理设备
+func (s *Server) handleDeviceRevoke(w http.ResponseWriter, r *http.Request, tenant *Tenant) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requestScope(r).IsFull() {
+		http.Error(w, "Token scope does not allow device management", http.StatusForbidden)
+		return
+	}
+
+	var req RevokeDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.RevokeDevice(tenant, req.MachineID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// handleAdminDeviceRevoke 管理员撤销租户的设备
+func (s *Server) handleAdminDeviceRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID        string `json:"id"`
+		MachineID string `json:"machine_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.RLock()
+	tenant := s.tenants[req.ID]
+	s.mu.RUnlock()
+	if tenant == nil {
+		http.Error(w, "tenant not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.RevokeDevice(tenant, req.MachineID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// withDevice 将设备凭据附加到请求上下文
+func withDevice(r *http.Request, d *Device) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), deviceContextKey{}, d))
+}
+
+// ensureDevice 使用租户令牌为本机注册设备凭据; 注册后配置中只保存设备凭据,
+// 丢失这台机器时只需撤销它的凭据, 不必在所有机器上更换租户令牌
+func (s *SyncService) ensureDevice() error {
+	if s.config.DeviceToken != "" || s.config.Token == "" {
+		return nil
+	}
+
+	var resp EnrollResponse
+	err := s.postJSON("/devices/enroll", EnrollRequest{
+		MachineID:   s.config.MachineID,
+		MachineName: s.config.MachineName,
+	}, &resp)
+	var httpErr *httpError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound {
+		// 服务器不支持设备凭据, 继续使用租户令牌
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("注册设备失败: %v", err)
+	}
+	if !resp.Success || resp.Token == "" {
+		return fmt.Errorf("注册设备失败: %s", resp.Message)
+	}
+
+	s.config.DeviceToken = resp.Token
+	s.config.Token = ""
+	return s.config.Save()
+}
+
+// Devices 获取同一租户下的所有设备
+func (s *SyncService) Devices() ([]*ClientInfo, error) {
+	var stats TenantStats
+	if err := s.getJSON("/stats", &stats); err != nil {
+		return nil, err
+	}
+	return stats.Clients, nil
+}
+
+// RevokeDevice 撤销设备凭据 (例如丢失的电脑)
+func (s *SyncService) RevokeDevice(machineID string) error {
+	var resp map[string]bool
+	return s.postJSON("/devices/revoke", RevokeDeviceRequest{MachineID: machineID}, &resp)
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeviceCredentialBoundToMachine(t *testing.T) {
+	s, err := NewServer(0, t.TempDir(), "tenant-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	token, err := s.EnrollDevice(s.tenants["default"], "m1", "laptop", "", Scope{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handlers := map[string]http.HandlerFunc{
+		"/sync":          s.tenantAuth(s.handleSync),
+		"/sync/upload":   s.tenantAuth(s.handleSyncUpload),
+		"/sync/download": s.tenantAuth(s.handleSyncDownload),
+	}
+	do := func(endpoint, token, header, body string) int {
+		req := httptest.NewRequest("POST", endpoint, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		if header != "" {
+			req.Header.Set(machineIDHeader, header)
+		}
+		w := httptest.NewRecorder()
+		handlers[endpoint](w, req)
+		return w.Code
+	}
+
+	for endpoint := range handlers {
+		for _, tc := range []struct {
+			token, header, body string
+			want                int
+		}{
+			{token, "", `{"machine_id":"m1"}`, http.StatusForbidden},
+			{token, "m2", `{"machine_id":"m2"}`, http.StatusForbidden},
+			{token, "m1", `{"machine_id":"m2"}`, http.StatusForbidden},
+			{token, "m1", `{"machine_id":"m1"}`, http.StatusOK},
+			{"tenant-token", "", `{"machine_id":"m2"}`, http.StatusOK},
+		} {
+			if got := do(endpoint, tc.token, tc.header, tc.body); got != tc.want {
+				t.Errorf("%s header=%q body=%s: status = %d, want %d", endpoint, tc.header, tc.body, got, tc.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package service
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/k0ngk0ng/claude-sync/internal/config"
+	"golang.org/x/crypto/argon2"
+)
+
+// 端到端加密
+//
+// 口令通过 Argon2id 派生密钥, 盐和参数保存在服务器上供同一租户的设备共用, 服务器只能看到密文。
+// 内容按行加密: 每行 (含换行符) 使用确定性 AES-256-GCM 加密 (nonce 由内容的 HMAC 生成),
+// 编码为 base64 后占一行。这样相同的内容在各设备上得到相同的密文和哈希, 会话记录追加时
+// 密文也是追加, 服务器仍然可以做追加传输和按行合并。代价是服务器能看出哪些行相同以及每行的长度。
+
+// KDFArgon2id 密钥派生算法
+const KDFArgon2id = "argon2id"
+
+// EncryptionParams 租户的加密参数, 不包含任何密钥
+type EncryptionParams struct {
+	KDF          string `json:"kdf"`
+	Salt         []byte `json:"salt"`
+	Time         uint32 `json:"time"`
+	Memory       uint32 `json:"memory"` // KiB
+	Threads      uint8  `json:"threads"`
+	KeyCheck     string `json:"key_check"`     // 用于校验口令是否正确
+	EncryptPaths bool   `json:"encrypt_paths"` // 是否同时加密文件路径
+}
+
+// EncryptionStatus 租户的加密状态
+type EncryptionStatus struct {
+	Enabled bool              `json:"enabled"`
+	Params  *EncryptionParams `json:"params,omitempty"`
+}
+
+// newEncryptionParams 生成新的加密参数 (随机盐)
+func newEncryptionParams(encryptPaths bool) EncryptionParams {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return EncryptionParams{
+		KDF:          KDFArgon2id,
+		Salt:         salt,
+		Time:         3,
+		Memory:       64 * 1024,
+		Threads:      4,
+		EncryptPaths: encryptPaths,
+	}
+}
+
+// validate 检查加密参数, 限制派生密钥的开销, 避免异常的参数耗尽内存
+func (p EncryptionParams) validate() error {
+	if p.KDF != KDFArgon2id || len(p.Salt) < 16 || p.KeyCheck == "" ||
+		p.Time < 1 || p.Time > 16 || p.Memory < 8*1024 || p.Memory > 1024*1024 || p.Threads < 1 || p.Threads > 16 {
+		return fmt.Errorf("不支持的加密参数")
+	}
+	return nil
+}
+
+// deriveKey 由口令派生 32 字节的密钥
+func deriveKey(passphrase string, p EncryptionParams) []byte {
+	return argon2.IDKey([]byte(passphrase), p.Salt, p.Time, p.Memory, p.Threads, 32)
+}
+
+// contentCipher 内容和路径的确定性加密
+type contentCipher struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+	check    string
+}
+
+// 加密的数据种类, 作为附加数据防止内容和路径的密文互换
+const (
+	chunkContent = 'c'
+	chunkPath    = 'p'
+)
+
+// newContentCipher 由密钥创建加密器, 加密和生成 nonce 使用由密钥派生的不同子密钥
+func newContentCipher(key []byte) (*contentCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("无效的加密密钥")
+	}
+	block, err := aes.NewCipher(subKey(key, "content"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &contentCipher{
+		aead:     aead,
+		nonceKey: subKey(key, "nonce"),
+		check:    hex.EncodeToString(subKey(key, "key-check")),
+	}, nil
+}
+
+func subKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("claude-sync " + purpose))
+	return mac.Sum(nil)
+}
+
+// seal 确定性加密: 相同的明文得到相同的密文
+func (c *contentCipher) seal(kind byte, plain []byte) []byte {
+	mac := hmac.New(sha256.New, c.nonceKey)
+	mac.Write([]byte{kind})
+	mac.Write(plain)
+	nonce := mac.Sum(nil)[:c.aead.NonceSize()]
+	return c.aead.Seal(nonce, nonce, plain, []byte{kind})
+}
+
+func (c *contentCipher) open(kind byte, data []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(data) < n {
+		return nil, errDecrypt
+	}
+	plain, err := c.aead.Open(nil, data[:n], data[n:], []byte{kind})
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plain, nil
+}
+
+// errDecrypt 密文无法解密 (密钥不一致或内容不是密文)
+var errDecrypt = errors.New("解密失败")
+
+// encryptContent 按行加密文件内容
+func (c *contentCipher) encryptContent(plain []byte) []byte {
+	var out bytes.Buffer
+	for len(plain) > 0 {
+		n := bytes.IndexByte(plain, '\n') + 1
+		if n == 0 {
+			n = len(plain)
+		}
+		out.WriteString(base64.RawURLEncoding.EncodeToString(c.seal(chunkContent, plain[:n])))
+		out.WriteByte('\n')
+		plain = plain[n:]
+	}
+	return out.Bytes()
+}
+
+// decryptContent 解密按行加密的内容。服务器合并会话记录时行的顺序可能改变,
+// 没有换行符的行 (文件末尾未写完的行) 不在最后时补上换行, 避免与下一行粘连
+func (c *contentCipher) decryptContent(wire []byte) ([]byte, error) {
+	var out bytes.Buffer
+	missingNewline := false
+	for _, line := range bytes.Split(wire, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		data, err := base64.RawURLEncoding.DecodeString(string(line))
+		if err != nil {
+			return nil, errDecrypt
+		}
+		plain, err := c.open(chunkContent, data)
+		if err != nil {
+			return nil, err
+		}
+		if missingNewline {
+			out.WriteByte('\n')
+		}
+		out.Write(plain)
+		missingNewline = !bytes.HasSuffix(plain, []byte("\n"))
+	}
+	return out.Bytes(), nil
+}
+
+// encryptPath 逐段加密 "/" 分隔的路径; 会话记录保留 .jsonl 扩展名, 以便服务器按行合并
+func (c *contentCipher) encryptPath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		segments[i] = base64.RawURLEncoding.EncodeToString(c.seal(chunkPath, []byte(seg)))
+	}
+	if isMergeable(p) {
+		segments[len(segments)-1] += ".jsonl"
+	}
+	return strings.Join(segments, "/")
+}
+
+// decryptPath 解密 encryptPath 加密的路径
+func (c *contentCipher) decryptPath(p string) (string, error) {
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		data, err := base64.RawURLEncoding.DecodeString(strings.TrimSuffix(seg, ".jsonl"))
+		if err != nil {
+			return "", errDecrypt
+		}
+		plain, err := c.open(chunkPath, data)
+		if err != nil {
+			return "", err
+		}
+		segments[i] = string(plain)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// handleEncryption 查询或启用租户的端到端加密; 只能在租户还没有文件时启用, 启用后不能关闭
+func (s *Server) handleEncryption(w http.ResponseWriter, r *http.Request, tenant *Tenant) {
+	switch r.Method {
+	case "GET":
+		s.mu.RLock()
+		status := EncryptionStatus{Enabled: tenant.Encryption != nil, Params: tenant.Encryption}
+		s.mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case "POST":
+		if !requestScope(r).IsFull() {
+			http.Error(w, "Token scope does not allow changing encryption", http.StatusForbidden)
+			return
+		}
+		var params EncryptionParams
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := params.validate(); err != nil {
+			http.Error(w, "Invalid encryption parameters", http.StatusBadRequest)
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		switch {
+		case tenant.Encryption != nil:
+			http.Error(w, "Encryption already enabled", http.StatusConflict)
+			return
+		case len(tenant.Files) > 0:
+			http.Error(w, "Tenant already has unencrypted files", http.StatusConflict)
+			return
+		}
+		tenant.Encryption = &params
+		if err := s.saveTenant(tenant); err != nil {
+			tenant.Encryption = nil
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Printf("[%s] [%s] 已启用端到端加密 (加密路径: %v)\n", time.Now().Format("15:04:05"), tenant.Name, params.EncryptPaths)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(EncryptionStatus{Enabled: true, Params: &params})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// loadCipher 根据配置中的密钥创建加密器, 未启用加密时为 nil
+func (s *SyncService) loadCipher() {
+	var c *contentCipher
+	if s.config.EncryptionKey != "" {
+		key, err := hex.DecodeString(s.config.EncryptionKey)
+		if err == nil {
+			c, err = newContentCipher(key)
+		}
+		if err != nil {
+			fmt.Printf("加载加密密钥失败: %v\n", err)
+		}
+	}
+
+	s.mu.Lock()
+	s.cipher = c
+	s.encryptionVerified = false
+	s.mu.Unlock()
+}
+
+// pathCipher 启用路径加密时返回加密器, 否则为 nil
+func (s *SyncService) pathCipher() *contentCipher {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.config.EncryptPaths {
+		return s.cipher
+	}
+	return nil
+}
+
+// setEncryptPaths 更新并保存是否加密路径 (以服务器的设置为准)
+func (s *SyncService) setEncryptPaths(encryptPaths bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.config.EncryptPaths == encryptPaths {
+		return nil
+	}
+	s.config.EncryptPaths = encryptPaths
+	return s.config.Save()
+}
+
+// ensureEncryption 同步前确认本机与服务器的加密设置一致, 避免把明文上传到已加密的租户
+func (s *SyncService) ensureEncryption() error {
+	if s.encryptionVerified {
+		return nil
+	}
+	if s.config.EncryptionKey != "" && s.cipher == nil {
+		return fmt.Errorf("本机的加密密钥无效, 请在设置中重新输入加密口令")
+	}
+
+	var status EncryptionStatus
+	err := s.getJSON("/encryption", &status)
+	var httpErr *httpError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound && s.cipher == nil {
+		// 服务器不支持加密
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case s.cipher == nil && status.Enabled:
+		return fmt.Errorf("服务器已启用端到端加密, 请在设置中输入加密口令")
+	case s.cipher == nil:
+		return nil
+	case !status.Enabled || status.Params.KeyCheck != s.cipher.check:
+		return fmt.Errorf("本机的加密密钥与服务器不一致, 请在设置中重新输入加密口令")
+	}
+	if err := s.setEncryptPaths(status.Params.EncryptPaths); err != nil {
+		return err
+	}
+	s.encryptionVerified = true
+	return nil
+}
+
+// EnableEncryption 使用口令启用端到端加密: 租户已启用时校验口令并加入, 否则为租户启用
+// (只能在服务器上还没有文件时启用)。启用后本地的同步状态会重建
+func (s *SyncService) EnableEncryption(passphrase string, encryptPaths bool) error {
+	if passphrase == "" {
+		return fmt.Errorf("口令不能为空")
+	}
+
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	if err := s.ensureDevice(); err != nil {
+		return err
+	}
+
+	var status EncryptionStatus
+	if err := s.getJSON("/encryption", &status); err != nil {
+		return err
+	}
+
+	var key []byte
+	var c *contentCipher
+	var err error
+	if status.Enabled {
+		if err := status.Params.validate(); err != nil {
+			return err
+		}
+		key = deriveKey(passphrase, *status.Params)
+		if c, err = newContentCipher(key); err != nil {
+			return err
+		}
+		if c.check != status.Params.KeyCheck {
+			return fmt.Errorf("口令不正确")
+		}
+		encryptPaths = status.Params.EncryptPaths
+	} else {
+		params := newEncryptionParams(encryptPaths)
+		key = deriveKey(passphrase, params)
+		if c, err = newContentCipher(key); err != nil {
+			return err
+		}
+		params.KeyCheck = c.check
+		var resp EncryptionStatus
+		err := s.postJSON("/encryption", params, &resp)
+		var httpErr *httpError
+		if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusConflict {
+			if strings.HasPrefix(httpErr.Body, "Encryption already enabled") {
+				return fmt.Errorf("其他设备刚刚启用了加密, 请重试")
+			}
+			return fmt.Errorf("服务器上已有未加密的文件, 只能为新租户启用加密")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.config.EncryptionKey = hex.EncodeToString(key)
+	s.config.EncryptPaths = encryptPaths
+	err = s.config.Save()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.loadCipher()
+	// 传输内容全部改变, 缓存的哈希和同步记录都已失效
+	s.state.Reset()
+	return nil
+}
+
+// remotePath 本地相对路径转换为传输路径 (统一为 "/" 分隔后做路径映射, 启用路径加密时加密)
+func (s *SyncService) remotePath(localPath string) string {
+	return s.remotePathWith(localPath, s.config.PathMappings)
+}
+
+// remotePathWith 使用指定的路径映射生成传输路径 (例如映射改变之前的)
+func (s *SyncService) remotePathWith(localPath string, mappings config.PathMappings) string {
+	p := mapPath(filepath.ToSlash(localPath), mappings, true)
+	if c := s.pathCipher(); c != nil {
+		p = c.encryptPath(p)
+	}
+	return p
+}
+
+// localPath 传输路径转换为使用本机分隔符的本地相对路径; 无法解密或不安全的路径返回空字符串
+func (s *SyncService) localPath(remotePath string) string {
+	p := cleanWirePath(remotePath)
+	if c := s.pathCipher(); p != "" && c != nil {
+		decrypted, err := c.decryptPath(p)
+		if err != nil {
+			return ""
+		}
+		p = cleanWirePath(decrypted)
+	}
+	if p == "" {
+		return ""
+	}
+	return filepath.FromSlash(s.applyPathMapping(p))
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/k0ngk0ng/claude-sync/internal/config"
+)
+
+func newTestCipher(t *testing.T, seed byte) *contentCipher {
+	t.Helper()
+	c, err := newContentCipher(bytes.Repeat([]byte{seed}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestContentCipherRoundTrip(t *testing.T) {
+	c := newTestCipher(t, 1)
+	for _, plain := range []string{"", "line1\n", "line1\nline2\n", "line1\npartial"} {
+		wire := c.encryptContent([]byte(plain))
+		if plain != "" && bytes.Contains(wire, []byte("line1")) {
+			t.Errorf("%q: content not encrypted: %q", plain, wire)
+		}
+		got, err := c.decryptContent(wire)
+		if err != nil || string(got) != plain {
+			t.Errorf("%q: decrypt = %q, %v", plain, got, err)
+		}
+	}
+
+	// 确定性加密: 相同的内容密文相同, 追加的内容密文也是追加
+	a := c.encryptContent([]byte("line1\n"))
+	b := c.encryptContent([]byte("line1\nline2\n"))
+	if !bytes.Equal(a, c.encryptContent([]byte("line1\n"))) || !bytes.HasPrefix(b, a) {
+		t.Errorf("ciphertext is not deterministic per line: %q, %q", a, b)
+	}
+
+	// 合并后没有换行的行不在最后时补上换行
+	reordered := append(c.encryptContent([]byte("partial")), c.encryptContent([]byte("line2\n"))...)
+	if got, err := c.decryptContent(reordered); err != nil || string(got) != "partial\nline2\n" {
+		t.Errorf("reordered = %q, %v", got, err)
+	}
+}
+
+func TestContentCipherRejectsTamperingAndWrongKey(t *testing.T) {
+	c := newTestCipher(t, 1)
+	wire := c.encryptContent([]byte("secret\n"))
+
+	tampered := append([]byte{}, wire...)
+	if tampered[0] == 'A' {
+		tampered[0] = 'B'
+	} else {
+		tampered[0] = 'A'
+	}
+	for name, data := range map[string][]byte{
+		"tampered":   tampered,
+		"truncated":  wire[:8],
+		"not base64": []byte("!!!\n"),
+	} {
+		if _, err := c.decryptContent(data); err != errDecrypt {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+	if _, err := newTestCipher(t, 2).decryptContent(wire); err != errDecrypt {
+		t.Errorf("wrong key: err = %v", err)
+	}
+
+	// 内容的密文不能当作路径解密
+	if _, err := c.decryptPath(strings.TrimSuffix(string(wire), "\n")); err != errDecrypt {
+		t.Errorf("content as path: err = %v", err)
+	}
+}
+
+func TestPathCipherRoundTrip(t *testing.T) {
+	c := newTestCipher(t, 1)
+	for _, p := range []string{"CLAUDE.md", "projects/-Users-me-dev/session.jsonl", "agents/a b/c.md"} {
+		enc := c.encryptPath(p)
+		if strings.Contains(enc, "Users") || strings.Count(enc, "/") != strings.Count(p, "/") {
+			t.Errorf("%s: encrypted = %s", p, enc)
+		}
+		if isMergeable(p) != isMergeable(enc) {
+			t.Errorf("%s: .jsonl suffix not kept: %s", p, enc)
+		}
+		if enc != c.encryptPath(p) {
+			t.Errorf("%s: path encryption is not deterministic", p)
+		}
+		if got, err := c.decryptPath(enc); err != nil || got != p {
+			t.Errorf("%s: decrypt = %s, %v", p, got, err)
+		}
+		if _, err := newTestCipher(t, 2).decryptPath(enc); err != errDecrypt {
+			t.Errorf("%s: wrong key: err = %v", p, err)
+		}
+	}
+
+	// 篡改任一段都无法解密
+	enc := c.encryptPath("projects/a")
+	segments := strings.Split(enc, "/")
+	if _, err := c.decryptPath(segments[0] + "/" + segments[1][1:]); err != errDecrypt {
+		t.Errorf("tampered segment: err = %v", err)
+	}
+}
+
+func TestEncryptionParamsValidate(t *testing.T) {
+	valid := newEncryptionParams(true)
+	valid.KeyCheck = "check"
+	if err := valid.validate(); err != nil {
+		t.Fatalf("default params: %v", err)
+	}
+
+	for name, change := range map[string]func(p *EncryptionParams){
+		"kdf":        func(p *EncryptionParams) { p.KDF = "scrypt" },
+		"short salt": func(p *EncryptionParams) { p.Salt = p.Salt[:8] },
+		"key check":  func(p *EncryptionParams) { p.KeyCheck = "" },
+		"time":       func(p *EncryptionParams) { p.Time = 100 },
+		"low memory": func(p *EncryptionParams) { p.Memory = 1024 },
+		"memory":     func(p *EncryptionParams) { p.Memory = 16 * 1024 * 1024 },
+		"threads":    func(p *EncryptionParams) { p.Threads = 0 },
+	} {
+		p := valid
+		p.Salt = append([]byte{}, valid.Salt...)
+		change(&p)
+		if err := p.validate(); err == nil {
+			t.Errorf("%s: invalid params accepted", name)
+		}
+	}
+}
+
+func TestEnsureEncryptionSavesServerSetting(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := newTestClient(t, s, ts, "m1")
+
+	params := EncryptionParams{KDF: KDFArgon2id, Salt: bytes.Repeat([]byte{1}, 16), Time: 1, Memory: 8 * 1024, Threads: 1, EncryptPaths: true}
+	key := deriveKey("passphrase", params)
+	cipher, err := newContentCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.KeyCheck = cipher.check
+	s.tenants["default"].Encryption = &params
+
+	c.config.EncryptionKey = hex.EncodeToString(key)
+	c.loadCipher()
+	if err := c.ensureEncryption(); err != nil {
+		t.Fatal(err)
+	}
+	if c.pathCipher() == nil {
+		t.Fatal("paths should be encrypted as configured on the server")
+	}
+
+	// 服务器的设置保存到本机配置, 重启后仍然加密路径
+	saved, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.EncryptPaths || saved.EncryptionKey != c.config.EncryptionKey {
+		t.Errorf("saved config: encrypt_paths=%v", saved.EncryptPaths)
+	}
+}
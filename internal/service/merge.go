@@ -0,0 +1,161 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// isMergeable 是否可以按行合并 (Claude Code 的会话记录为 JSONL)
+func isMergeable(path string) bool {
+	return strings.HasSuffix(path, ".jsonl")
+}
+
+// jsonlRecord 会话记录中的一行
+type jsonlRecord struct {
+	key       string
+	parent    string
+	timestamp time.Time
+	source    int // 0: 已有内容, 1: 新内容
+	index     int // 在来源文件中的行号
+	line      []byte
+}
+
+// parseJSONL 解析 JSONL, 没有时间戳的行沿用上一行的时间, 保持其相对位置
+func parseJSONL(data []byte, source int) []jsonlRecord {
+	var records []jsonlRecord
+	var last time.Time
+
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var fields struct {
+			UUID       string `json:"uuid"`
+			ParentUUID string `json:"parentUuid"`
+			Timestamp  string `json:"timestamp"`
+		}
+		json.Unmarshal(line, &fields)
+
+		rec := jsonlRecord{
+			key:    "uuid:" + fields.UUID,
+			parent: fields.ParentUUID,
+			source: source,
+			index:  i,
+			line:   line,
+		}
+		// 没有 uuid 的行 (如 summary) 按内容去重
+		if fields.UUID == "" {
+			rec.key = "line:" + hashBytes(line)
+		}
+		if ts, err := time.Parse(time.RFC3339Nano, fields.Timestamp); err == nil {
+			last = ts
+		}
+		rec.timestamp = last
+		records = append(records, rec)
+	}
+	return records
+}
+
+// splitPartial 将 JSONL 分为以换行结尾的完整记录和最后一行还没写完的部分
+func splitPartial(data []byte) (complete, partial []byte) {
+	i := bytes.LastIndexByte(data, '\n')
+	return data[:i+1], data[i+1:]
+}
+
+// mergeJSONL 按 uuid 合并两份会话记录, 按时间戳排序并保证父消息在子消息之前。
+// 没有换行结尾的最后一行可能还在写入, 不参与合并, 原样保留在合并结果末尾 (两边都有时
+// 保留较长的一份或 incoming 的; 已在另一边写完的丢弃)。
+// incoming 没有带来新记录时返回 existing 原样和 false
+func mergeJSONL(existing, incoming []byte) ([]byte, bool) {
+	existingLines, existingTail := splitPartial(existing)
+	incomingLines, tail := splitPartial(incoming)
+	if len(tail) == 0 || bytes.HasPrefix(existingTail, tail) {
+		tail = existingTail
+	}
+
+	seen := make(map[string]bool)
+	var records []jsonlRecord
+	for _, rec := range parseJSONL(existingLines, 0) {
+		if !seen[rec.key] {
+			seen[rec.key] = true
+			records = append(records, rec)
+		}
+	}
+
+	added := false
+	for _, rec := range parseJSONL(incomingLines, 1) {
+		if !seen[rec.key] {
+			seen[rec.key] = true
+			records = append(records, rec)
+			added = true
+		}
+	}
+	for _, rec := range records {
+		if len(tail) > 0 && bytes.HasPrefix(rec.line, tail) {
+			tail = nil
+			break
+		}
+	}
+	if !added && bytes.Equal(tail, existingTail) {
+		return existing, false
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if !a.timestamp.Equal(b.timestamp) {
+			return a.timestamp.Before(b.timestamp)
+		}
+		if a.source != b.source {
+			return a.source < b.source
+		}
+		return a.index < b.index
+	})
+
+	// 父消息还没输出的记录先挂起, 等父消息输出后紧跟其后输出
+	present := make(map[string]bool, len(records))
+	for _, rec := range records {
+		present[rec.key] = true
+	}
+	emitted := make(map[string]bool, len(records))
+	waiting := make(map[string][]jsonlRecord)
+	var out bytes.Buffer
+
+	var emit func(rec jsonlRecord)
+	emit = func(rec jsonlRecord) {
+		if emitted[rec.key] {
+			return
+		}
+		emitted[rec.key] = true
+		out.Write(rec.line)
+		out.WriteByte('\n')
+		children := waiting[rec.key]
+		delete(waiting, rec.key)
+		for _, child := range children {
+			emit(child)
+		}
+	}
+
+	for _, rec := range records {
+		parentKey := "uuid:" + rec.parent
+		if rec.parent != "" && present[parentKey] && !emitted[parentKey] {
+			waiting[parentKey] = append(waiting[parentKey], rec)
+			continue
+		}
+		emit(rec)
+	}
+
+	// 理论上不会出现 (父子关系成环), 兜底输出剩余记录
+	for _, rec := range records {
+		if !emitted[rec.key] {
+			emit(rec)
+		}
+	}
+
+	out.Write(tail)
+	return out.Bytes(), true
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMergeJSONL(t *testing.T) {
+	existing := `{"uuid":"a","timestamp":"2026-01-01T00:00:00Z"}
+{"uuid":"b","parentUuid":"a","timestamp":"2026-01-01T00:00:02Z"}
+`
+	incoming := `{"uuid":"a","timestamp":"2026-01-01T00:00:00Z"}
+{"uuid":"c","parentUuid":"a","timestamp":"2026-01-01T00:00:01Z"}
+{"uuid":"b","parentUuid":"a","timestamp":"2026-01-01T00:00:02Z"}
+`
+	merged, ok := mergeJSONL([]byte(existing), []byte(incoming))
+	if !ok {
+		t.Fatal("expected new records")
+	}
+	want := `{"uuid":"a","timestamp":"2026-01-01T00:00:00Z"}
+{"uuid":"c","parentUuid":"a","timestamp":"2026-01-01T00:00:01Z"}
+{"uuid":"b","parentUuid":"a","timestamp":"2026-01-01T00:00:02Z"}
+`
+	if string(merged) != want {
+		t.Errorf("merged:\n%s\nwant:\n%s", merged, want)
+	}
+}
+
+func TestMergeJSONLNoNewRecords(t *testing.T) {
+	existing := []byte(`{"uuid":"a"}` + "\n" + `{"type":"summary"}` + "\n")
+	merged, ok := mergeJSONL(existing, []byte(`{"type":"summary"}`+"\n"))
+	if ok || string(merged) != string(existing) {
+		t.Errorf("got %q, %v; want existing content unchanged", merged, ok)
+	}
+}
+
+func TestMergeJSONLParentBeforeChild(t *testing.T) {
+	// 子消息的时间戳早于父消息 (机器时钟不一致), 仍然排在父消息之后
+	existing := `{"uuid":"p","timestamp":"2026-01-01T00:00:05Z"}` + "\n"
+	incoming := `{"uuid":"k","parentUuid":"p","timestamp":"2026-01-01T00:00:01Z"}` + "\n"
+	merged, _ := mergeJSONL([]byte(existing), []byte(incoming))
+	lines := strings.Split(strings.TrimSpace(string(merged)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"p"`) || !strings.Contains(lines[1], `"k"`) {
+		t.Errorf("unexpected order:\n%s", merged)
+	}
+}
+
+func TestMergeJSONLWithoutUUIDDedupesByContent(t *testing.T) {
+	existing := `{"type":"summary","summary":"x"}` + "\n"
+	incoming := `{"type":"summary","summary":"x"}` + "\n" + `{"type":"summary","summary":"y"}` + "\n"
+	merged, ok := mergeJSONL([]byte(existing), []byte(incoming))
+	if !ok || strings.Count(string(merged), "\n") != 2 {
+		t.Errorf("got %q, %v", merged, ok)
+	}
+}
+
+func TestMergeJSONLKeepsPartialLine(t *testing.T) {
+	// 最后一行还在写入 (没有换行结尾): 不参与合并, 原样保留在末尾
+	existing := `{"uuid":"a","timestamp":"2026-01-01T00:00:00Z"}` + "\n"
+	incoming := `{"uuid":"a","timestamp":"2026-01-01T00:00:00Z"}` + "\n" +
+		`{"uuid":"b","timestamp":"2026-01-01T00:00:01Z"}` + "\n" +
+		`{"uuid":"c","timestamp":"2026-01-01T00:00:02Z","message":"hal`
+	merged, ok := mergeJSONL([]byte(existing), []byte(incoming))
+	if !ok || string(merged) != incoming {
+		t.Errorf("merged = %q, %v; want %q", merged, ok, incoming)
+	}
+
+	// 服务器上的半行已在上传的内容中写完, 不再保留
+	existing = `{"uuid":"a","timestamp":"2026-01-01T00:00:00Z"}` + "\n" + `{"uuid":"c","times`
+	incoming = `{"uuid":"c","timestamp":"2026-01-01T00:00:02Z"}` + "\n"
+	want := `{"uuid":"a","timestamp":"2026-01-01T00:00:00Z"}` + "\n" + incoming
+	if merged, _ := mergeJSONL([]byte(existing), []byte(incoming)); string(merged) != want {
+		t.Errorf("merged = %q, want %q", merged, want)
+	}
+
+	// 上传的只是服务器半行的更早状态, 服务器版本不变
+	existing = `{"uuid":"a"}` + "\n" + `{"uuid":"b","message":"hello`
+	incoming = `{"uuid":"a"}` + "\n" + `{"uuid":"b","mes`
+	if merged, ok := mergeJSONL([]byte(existing), []byte(incoming)); ok || string(merged) != existing {
+		t.Errorf("merged = %q, %v; want existing unchanged", merged, ok)
+	}
+}
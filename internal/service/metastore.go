@@ -0,0 +1,516 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 元数据库结构:
+//
+//	meta/schema_version                 -> 结构版本号
+//	meta/config                         -> 服务器配置 (ServerConfig)
+//	tenants/<id>/info                   -> 租户信息
+//	tenants/<id>/files/<path>           -> 文件索引 (FileInfo)
+//	tenants/<id>/tombstones/<path>      -> 删除记录
+//	tenants/<id>/versions/<path>        -> 历史版本列表
+//	tenants/<id>/clients/<machine id>   -> 客户端信息
+//	tenants/<id>/devices/<machine id>   -> 设备凭据
+//
+// 路径统一使用 "/" 分隔, 与传输路径相同
+var (
+	bucketMeta       = []byte("meta")
+	bucketTenants    = []byte("tenants")
+	bucketFiles      = []byte("files")
+	bucketTombstones = []byte("tombstones")
+	bucketVersions   = []byte("versions")
+	bucketClients    = []byte("clients")
+	bucketDevices    = []byte("devices")
+
+	keySchemaVersion = []byte("schema_version")
+	keyConfig        = []byte("config")
+	keyTenantInfo    = []byte("info")
+)
+
+// metaMigrations 元数据库结构迁移, 第 i 个迁移将结构版本从 i 升级到 i+1。
+// 只能在末尾追加新的迁移, 不能修改已发布的迁移
+var metaMigrations = []func(tx *bolt.Tx) error{
+	// 1: 初始结构
+	func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketMeta); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketTenants)
+		return err
+	},
+	// 2: 租户令牌和管理令牌改为加盐哈希
+	func(tx *bolt.Tx) error {
+		tenants := tx.Bucket(bucketTenants)
+		var ids [][]byte
+		tenants.ForEachBucket(func(id []byte) error {
+			ids = append(ids, id)
+			return nil
+		})
+		for _, id := range ids {
+			tb := tenants.Bucket(id)
+			var info map[string]interface{}
+			if err := json.Unmarshal(tb.Get(keyTenantInfo), &info); err != nil {
+				return err
+			}
+			if token, ok := info["token"].(string); ok {
+				info["token_hash"] = hashToken(token)
+				delete(info, "token")
+			}
+			if err := putJSON(tb, keyTenantInfo, info); err != nil {
+				return err
+			}
+		}
+
+		meta := tx.Bucket(bucketMeta)
+		data := meta.Get(keyConfig)
+		if data == nil {
+			return nil
+		}
+		var config map[string]interface{}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return err
+		}
+		// 之前只保存了管理令牌的 SHA-256
+		if digest, ok := config["admin_token_hash"].(string); ok && digest != "" {
+			config["admin_token_hash"] = saltDigest(newSalt(), digest)
+		}
+		return putJSON(meta, keyConfig, config)
+	},
+	// 3: 路径键统一为 "/" 分隔
+	migrateWirePaths,
+}
+
+// metaRecord 迁移中使用的原始记录, 只解析需要的字段, 数字不经过 float64 以免丢失精度
+type metaRecord map[string]json.RawMessage
+
+func (r metaRecord) int(key string) int64 {
+	var n int64
+	json.Unmarshal(r[key], &n)
+	return n
+}
+
+func getRecord(b *bolt.Bucket, key []byte, v interface{}) error {
+	data := b.Get(key)
+	if data == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// backslashKeys 返回 bucket 中包含反斜杠的键; bucket 不存在时返回 nil
+func backslashKeys(b *bolt.Bucket) [][]byte {
+	if b == nil {
+		return nil
+	}
+	var keys [][]byte
+	b.ForEach(func(k, v []byte) error {
+		if bytes.IndexByte(k, '\\') >= 0 {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return nil
+	})
+	return keys
+}
+
+// mergeVersionRecords 将历史版本合并到 key 已有的历史版本中, 按版本号从旧到新排列
+func mergeVersionRecords(b *bolt.Bucket, key []byte, versions []metaRecord) error {
+	var existing []metaRecord
+	if err := getRecord(b, key, &existing); err != nil {
+		return err
+	}
+	versions = append(existing, versions...)
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].int("rev") < versions[j].int("rev") })
+	return putJSON(b, key, versions)
+}
+
+// migrateWirePaths 将租户记录中反斜杠分隔的路径键 (旧版本的 Windows 客户端上传的) 统一为 "/" 分隔。
+// 同一文件两种形式的记录都存在时保留版本号较大的, 另一个作为被替换的历史版本保留, 可以恢复;
+// 删除记录保留较晚的一个, 文件仍然存在时删除; 历史版本合并后按版本号排序。
+// 无效的路径 (例如包含 "..") 不做处理
+func migrateWirePaths(tx *bolt.Tx) error {
+	tenants := tx.Bucket(bucketTenants)
+	var ids [][]byte
+	tenants.ForEachBucket(func(id []byte) error {
+		ids = append(ids, id)
+		return nil
+	})
+
+	now := time.Now().Unix()
+	for _, id := range ids {
+		tb := tenants.Bucket(id)
+		files, err := tb.CreateBucketIfNotExists(bucketFiles)
+		if err != nil {
+			return err
+		}
+		tombstones, err := tb.CreateBucketIfNotExists(bucketTombstones)
+		if err != nil {
+			return err
+		}
+		versions, err := tb.CreateBucketIfNotExists(bucketVersions)
+		if err != nil {
+			return err
+		}
+
+		canonical := func(key []byte) ([]byte, json.RawMessage) {
+			p := cleanWirePath(string(key))
+			if p == "" {
+				return nil, nil
+			}
+			quoted, _ := json.Marshal(p)
+			return []byte(p), quoted
+		}
+
+		var merged [][]byte
+		for _, key := range backslashKeys(files) {
+			to, quoted := canonical(key)
+			if to == nil {
+				continue
+			}
+			var f, existing metaRecord
+			if err := getRecord(files, key, &f); err != nil {
+				return err
+			}
+			if err := getRecord(files, to, &existing); err != nil {
+				return err
+			}
+			if existing != nil {
+				if existing.int("rev") > f.int("rev") {
+					f, existing = existing, f
+				}
+				archived, _ := json.Marshal(now)
+				version := metaRecord{"rev": existing["rev"], "hash": existing["hash"], "size": existing["size"], "archived_at": archived}
+				if err := mergeVersionRecords(versions, to, []metaRecord{version}); err != nil {
+					return err
+				}
+			}
+			f["path"] = quoted
+			if err := putJSON(files, to, f); err != nil {
+				return err
+			}
+			if err := files.Delete(key); err != nil {
+				return err
+			}
+			merged = append(merged, to)
+		}
+
+		for _, key := range backslashKeys(versions) {
+			to, _ := canonical(key)
+			if to == nil {
+				continue
+			}
+			var list []metaRecord
+			if err := getRecord(versions, key, &list); err != nil {
+				return err
+			}
+			if err := mergeVersionRecords(versions, to, list); err != nil {
+				return err
+			}
+			if err := versions.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		for _, key := range backslashKeys(tombstones) {
+			to, quoted := canonical(key)
+			if to == nil {
+				continue
+			}
+			var ts, existing metaRecord
+			if err := getRecord(tombstones, key, &ts); err != nil {
+				return err
+			}
+			if err := getRecord(tombstones, to, &existing); err != nil {
+				return err
+			}
+			if existing != nil && existing.int("deleted_at") > ts.int("deleted_at") {
+				ts = existing
+			}
+			ts["path"] = quoted
+			if err := putJSON(tombstones, to, ts); err != nil {
+				return err
+			}
+			if err := tombstones.Delete(key); err != nil {
+				return err
+			}
+			merged = append(merged, to)
+		}
+
+		// 合并后文件仍然存在的路径不再需要删除记录
+		for _, key := range merged {
+			if files.Get(key) != nil {
+				if err := tombstones.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// metaStore 服务器元数据库 (租户、文件索引、历史版本、客户端), 所有写入都在事务中完成
+type metaStore struct {
+	db *bolt.DB
+}
+
+// openMetaStore 打开元数据库并执行结构迁移
+func openMetaStore(path string) (*metaStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("打开元数据库失败 %s: %v", path, err)
+	}
+
+	m := &metaStore{db: db}
+	if err := m.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// Close 关闭元数据库
+func (m *metaStore) Close() error {
+	return m.db.Close()
+}
+
+// migrate 依次执行尚未执行的迁移, 每个迁移在单独的事务中完成
+func (m *metaStore) migrate() error {
+	from := 0
+	err := m.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucketMeta); b != nil {
+			from, _ = strconv.Atoi(string(b.Get(keySchemaVersion)))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if from > len(metaMigrations) {
+		return fmt.Errorf("元数据库结构版本 %d 高于当前程序支持的版本 %d", from, len(metaMigrations))
+	}
+
+	for v := from; v < len(metaMigrations); v++ {
+		err := m.db.Update(func(tx *bolt.Tx) error {
+			if err := metaMigrations[v](tx); err != nil {
+				return err
+			}
+			return tx.Bucket(bucketMeta).Put(keySchemaVersion, []byte(strconv.Itoa(v+1)))
+		})
+		if err != nil {
+			return fmt.Errorf("元数据库迁移到版本 %d 失败: %v", v+1, err)
+		}
+	}
+	return nil
+}
+
+// loadConfig 读取服务器配置, 尚未保存过时返回空配置
+func (m *metaStore) loadConfig() (ServerConfig, error) {
+	var config ServerConfig
+	err := m.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketMeta).Get(keyConfig)
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &config)
+	})
+	return config, err
+}
+
+// saveConfig 保存服务器配置
+func (m *metaStore) saveConfig(config ServerConfig) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketMeta), keyConfig, config)
+	})
+}
+
+// loadTenants 读取所有租户及其文件索引、删除记录、历史版本和客户端
+func (m *metaStore) loadTenants() ([]*Tenant, error) {
+	var tenants []*Tenant
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTenants).ForEachBucket(func(id []byte) error {
+			tb := tx.Bucket(bucketTenants).Bucket(id)
+			t := &Tenant{
+				Files:      make(map[string]FileInfo),
+				Clients:    make(map[string]*ClientInfo),
+				Tombstones: make(map[string]*Tombstone),
+				Versions:   make(map[string][]FileVersion),
+				Devices:    make(map[string]*Device),
+			}
+			if err := json.Unmarshal(tb.Get(keyTenantInfo), t); err != nil {
+				return fmt.Errorf("租户 %s: %v", id, err)
+			}
+
+			err := forEachJSON(tb.Bucket(bucketFiles), func(key string, data []byte) error {
+				var f FileInfo
+				if err := json.Unmarshal(data, &f); err != nil {
+					return err
+				}
+				t.Files[key] = f
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			err = forEachJSON(tb.Bucket(bucketTombstones), func(key string, data []byte) error {
+				var ts Tombstone
+				if err := json.Unmarshal(data, &ts); err != nil {
+					return err
+				}
+				t.Tombstones[key] = &ts
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			err = forEachJSON(tb.Bucket(bucketVersions), func(key string, data []byte) error {
+				var versions []FileVersion
+				if err := json.Unmarshal(data, &versions); err != nil {
+					return err
+				}
+				t.Versions[key] = versions
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			err = forEachJSON(tb.Bucket(bucketClients), func(key string, data []byte) error {
+				var c ClientInfo
+				if err := json.Unmarshal(data, &c); err != nil {
+					return err
+				}
+				t.Clients[key] = &c
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			err = forEachJSON(tb.Bucket(bucketDevices), func(key string, data []byte) error {
+				var d Device
+				if err := json.Unmarshal(data, &d); err != nil {
+					return err
+				}
+				t.Devices[d.MachineID] = &d
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			tenants = append(tenants, t)
+			return nil
+		})
+	})
+	return tenants, err
+}
+
+// forEachJSON 遍历 bucket 中的记录; bucket 不存在时不做任何事
+func forEachJSON(b *bolt.Bucket, fn func(key string, data []byte) error) error {
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		return fn(string(k), v)
+	})
+}
+
+// saveTenant 在一个事务中写入租户信息、全部客户端和设备, 以及 paths 中每个路径当前的
+// 文件索引、删除记录和历史版本 (内存中不存在的记录会被删除)
+func (m *metaStore) saveTenant(t *Tenant, paths []string) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		tb, err := tx.Bucket(bucketTenants).CreateBucketIfNotExists([]byte(t.ID))
+		if err != nil {
+			return err
+		}
+		if err := putJSON(tb, keyTenantInfo, t); err != nil {
+			return err
+		}
+
+		buckets := make(map[string]*bolt.Bucket)
+		for _, name := range [][]byte{bucketFiles, bucketTombstones, bucketVersions, bucketClients, bucketDevices} {
+			b, err := tb.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+			buckets[string(name)] = b
+		}
+
+		for id, c := range t.Clients {
+			if err := putJSON(buckets[string(bucketClients)], []byte(id), c); err != nil {
+				return err
+			}
+		}
+		for id, d := range t.Devices {
+			if err := putJSON(buckets[string(bucketDevices)], []byte(id), d); err != nil {
+				return err
+			}
+		}
+
+		for _, path := range paths {
+			key := []byte(path)
+
+			var file, tombstone, versions interface{}
+			if f, ok := t.Files[path]; ok {
+				file = f
+			}
+			if ts, ok := t.Tombstones[path]; ok {
+				tombstone = ts
+			}
+			if v, ok := t.Versions[path]; ok && len(v) > 0 {
+				versions = v
+			}
+
+			records := []struct {
+				bucket *bolt.Bucket
+				value  interface{}
+			}{
+				{buckets[string(bucketFiles)], file},
+				{buckets[string(bucketTombstones)], tombstone},
+				{buckets[string(bucketVersions)], versions},
+			}
+			for _, r := range records {
+				if r.value == nil {
+					err = r.bucket.Delete(key)
+				} else {
+					err = putJSON(r.bucket, key, r.value)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// canonicalizePaths 统一所有租户的路径键 (见 migrateWirePaths), 导入旧版配置后调用
+func (m *metaStore) canonicalizePaths() error {
+	return m.db.Update(migrateWirePaths)
+}
+
+// deleteTenant 删除租户的所有元数据
+func (m *metaStore) deleteTenant(id string) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bucketTenants).DeleteBucket([]byte(id))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func putJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
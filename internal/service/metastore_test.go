@@ -0,0 +1,225 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// createMetaV1 创建结构版本 1 的元数据库: 租户令牌明文保存, 管理令牌只保存 SHA-256
+func createMetaV1(t *testing.T, path, tenantToken, adminToken string) {
+	t.Helper()
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := metaMigrations[0](tx); err != nil {
+			return err
+		}
+		meta := tx.Bucket(bucketMeta)
+		meta.Put(keySchemaVersion, []byte("1"))
+		if err := putJSON(meta, keyConfig, map[string]string{"admin_token_hash": hashBytes([]byte(adminToken))}); err != nil {
+			return err
+		}
+		tb, err := tx.Bucket(bucketTenants).CreateBucket([]byte("t1"))
+		if err != nil {
+			return err
+		}
+		return putJSON(tb, keyTenantInfo, map[string]string{"id": "t1", "name": "T1", "token": tenantToken})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetaStoreMigratesTokensToSaltedHashes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), metaName)
+	createMetaV1(t, path, "tenant-secret", "admin-secret")
+
+	// 第二次打开不应重复迁移
+	for i := 0; i < 2; i++ {
+		m, err := openMetaStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := m.loadConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !verifyToken("admin-secret", config.AdminTokenHash) {
+			t.Errorf("open %d: admin token does not verify against %q", i, config.AdminTokenHash)
+		}
+		tenants, err := m.loadTenants()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tenants) != 1 || !verifyToken("tenant-secret", tenants[0].TokenHash) {
+			t.Errorf("open %d: tenant token does not verify: %+v", i, tenants)
+		}
+		m.db.View(func(tx *bolt.Tx) error {
+			if v := string(tx.Bucket(bucketMeta).Get(keySchemaVersion)); v != strconv.Itoa(len(metaMigrations)) {
+				t.Errorf("open %d: schema version = %s", i, v)
+			}
+			return nil
+		})
+		m.Close()
+	}
+}
+
+func TestMetaStoreRejectsNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), metaName)
+	m, err := openMetaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMeta).Put(keySchemaVersion, []byte("99"))
+	})
+	m.Close()
+
+	if m, err := openMetaStore(path); err == nil {
+		m.Close()
+		t.Fatal("expected error for a newer schema version")
+	}
+}
+
+func TestImportLegacyConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(key, content string) {
+		path := filepath.Join(dir, filepath.FromSlash(key))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(configKey, `{"tenants":[{"id":"t1","name":"T1","token":"legacy-token",
+		"tombstones":{"projects/gone.jsonl":{"path":"projects/gone.jsonl"}}}]}`)
+	write("tenants/t1/projects/a/s.jsonl", "{\"a\":1}\n")
+
+	s, err := NewServer(0, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant, _ := s.getTenantByToken("legacy-token")
+	if tenant == nil {
+		t.Fatal("legacy token does not authenticate")
+	}
+	f, ok := tenant.Files["projects/a/s.jsonl"]
+	if !ok {
+		t.Fatalf("file not imported: %v", tenant.Files)
+	}
+	if data, err := tenant.blobs.Read(f.Hash); err != nil || string(data) != "{\"a\":1}\n" {
+		t.Errorf("blob = %q, %v", data, err)
+	}
+	if _, ok := tenant.Tombstones["projects/gone.jsonl"]; !ok {
+		t.Errorf("tombstone not imported: %v", tenant.Tombstones)
+	}
+	for _, key := range []string{configKey, "tenants/t1/projects/a/s.jsonl"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(key))); !os.IsNotExist(err) {
+			t.Errorf("legacy file %s still exists", key)
+		}
+	}
+
+	// 重新启动时从元数据库加载
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewServer(0, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if tenant, _ := s.getTenantByToken("legacy-token"); tenant == nil || len(tenant.Files) != 1 {
+		t.Errorf("tenant after restart: %+v", tenant)
+	}
+}
+
+func TestMetaStoreMigratesBackslashPaths(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewServer(0, dir, "tenant-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant := s.tenants["default"]
+	old, current := []byte("{\"a\":1}\n"), []byte("{\"a\":1}\n{\"b\":2}\n")
+	tenant.blobs.Put(hashBytes(old), old)
+	tenant.blobs.Put(hashBytes(current), current)
+	s.Close()
+
+	// 旧版本的 Windows 客户端和新客户端上传的同一文件各有一条记录, 回到迁移之前的结构版本
+	db, err := bolt.Open(filepath.Join(dir, metaName), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		tb := tx.Bucket(bucketTenants).Bucket([]byte("default"))
+		files, _ := tb.CreateBucketIfNotExists(bucketFiles)
+		tombstones, _ := tb.CreateBucketIfNotExists(bucketTombstones)
+		versions, _ := tb.CreateBucketIfNotExists(bucketVersions)
+		putJSON(files, []byte(`projects\p\s.jsonl`), FileInfo{Path: `projects\p\s.jsonl`, Hash: hashBytes(current), Size: int64(len(current)), Rev: 200})
+		putJSON(files, []byte("projects/p/s.jsonl"), FileInfo{Path: "projects/p/s.jsonl", Hash: hashBytes(old), Size: int64(len(old)), Rev: 100})
+		putJSON(versions, []byte(`projects\p\s.jsonl`), []FileVersion{{Rev: 150, Hash: hashBytes(old), Size: int64(len(old)), Prefix: true}})
+		putJSON(tombstones, []byte(`projects\p\s.jsonl`), Tombstone{Path: `projects\p\s.jsonl`, Hash: "gone", DeletedAt: 1})
+		putJSON(tombstones, []byte(`commands\x.md`), Tombstone{Path: `commands\x.md`, Hash: "x", DeletedAt: 2})
+		return tx.Bucket(bucketMeta).Put(keySchemaVersion, []byte("2"))
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewServer(0, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tenant = s.tenants["default"]
+
+	// 保留版本号较大的记录, 另一个作为历史版本
+	if len(tenant.Files) != 1 {
+		t.Fatalf("files = %v", tenant.Files)
+	}
+	f := tenant.Files["projects/p/s.jsonl"]
+	if f.Rev != 200 || f.Path != "projects/p/s.jsonl" || f.Hash != hashBytes(current) {
+		t.Errorf("merged file = %+v", f)
+	}
+	versions := tenant.Versions["projects/p/s.jsonl"]
+	if len(versions) != 2 || versions[0].Rev != 100 || versions[1].Rev != 150 || len(tenant.Versions) != 1 {
+		t.Fatalf("versions = %+v", tenant.Versions)
+	}
+	for i := range versions {
+		if content, err := s.readVersion(tenant, f.Path, versions, i); err != nil || string(content) != string(old) {
+			t.Errorf("version %d = %q, %v", versions[i].Rev, content, err)
+		}
+	}
+
+	// 文件仍然存在的路径没有删除记录, 其他删除记录统一路径
+	if len(tenant.Tombstones) != 1 || tenant.Tombstones["commands/x.md"] == nil || tenant.Tombstones["commands/x.md"].Path != "commands/x.md" {
+		t.Errorf("tombstones = %v", tenant.Tombstones)
+	}
+
+	// 旧版本的客户端提交反斜杠路径时与同一条记录比较, 不会收到重复的文件
+	body, _ := json.Marshal(SyncRequest{MachineID: "m1", Files: []FileInfo{
+		{Path: `projects\p\s.jsonl`, Hash: f.Hash, Size: f.Size, BaseRev: f.Rev, BaseHash: f.Hash},
+	}})
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/sync", strings.NewReader(string(body)))
+	req.Header.Set("Authorization", "Bearer tenant-token")
+	s.tenantAuth(s.handleSync)(w, req)
+	var resp SyncResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Need) != 0 || len(resp.Files) != 0 || len(resp.Conflicts) != 0 {
+		t.Errorf("legacy client sync: %+v", resp)
+	}
+}
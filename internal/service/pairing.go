@@ -0,0 +1,291 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/k0ngk0ng/claude-sync/internal/config"
+)
+
+// DefaultPairingTTL 配对码有效期
+const DefaultPairingTTL = 10 * time.Minute
+
+// 同一客户端地址在 pairingFailureWindow 内使用错误的配对码达到 maxPairingFailures 次后,
+// 窗口结束前拒绝该地址的配对请求, 防止猜测; 其他地址和已生成的配对码不受影响
+const (
+	maxPairingFailures   = 10
+	pairingFailureWindow = 10 * time.Minute
+)
+
+var (
+	errPairingInvalid = errors.New("invalid or expired pairing code")
+	errPairingLimited = errors.New("too many invalid pairing codes")
+)
+
+// pairingAlphabet 配对码字符集, 去掉了容易混淆的 0/O/1/I
+const pairingAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// pairingCode 一次性配对码, 只保存在内存中, 服务器重启后失效
+type pairingCode struct {
+	tenantID  string
+	scope     Scope // 使用配对码注册的设备凭据的权限范围
+	expiresAt time.Time
+}
+
+// pairingLimit 一个客户端地址在时间窗口内使用错误配对码的次数
+type pairingLimit struct {
+	failures int
+	resetAt  time.Time
+}
+
+// PairRequest 使用配对码注册设备的请求
+type PairRequest struct {
+	Code        string `json:"code"`
+	MachineID   string `json:"machine_id"`
+	MachineName string `json:"machine_name"`
+}
+
+// PairingCodeRequest 生成配对码的请求
+type PairingCodeRequest struct {
+	Scope Scope `json:"scope"` // 为空时与生成者的权限相同
+}
+
+// PairingCodeResponse 生成配对码的响应
+type PairingCodeResponse struct {
+	Success   bool      `json:"success"`
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// normalizePairingCode 去掉分隔符并转为大写, 用户输入 "abcd-efgh" 与 "ABCDEFGH" 等价
+func normalizePairingCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// CreatePairingCode 为租户生成一次性配对码, 格式为 "XXXX-XXXX"; 使用配对码注册的设备权限范围为 scope
+func (s *Server) CreatePairingCode(tenant *Tenant, scope Scope) (string, time.Time) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = pairingAlphabet[int(b[i])%len(pairingAlphabet)]
+	}
+	code := string(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for c, p := range s.pairings {
+		if now.After(p.expiresAt) {
+			delete(s.pairings, c)
+		}
+	}
+	expiresAt := now.Add(DefaultPairingTTL)
+	s.pairings[code] = &pairingCode{tenantID: tenant.ID, scope: scope, expiresAt: expiresAt}
+
+	fmt.Printf("[%s] [%s] 生成配对码, 权限: %s, 有效期至 %s\n", now.Format("15:04:05"), tenant.Name, scope, expiresAt.Format("15:04:05"))
+	return code[:4] + "-" + code[4:], expiresAt
+}
+
+// redeemPairingCode 客户端地址 addr 使用配对码 (只能使用一次), 返回所属租户和权限范围。
+// 配对码无效或已过期时返回 errPairingInvalid, 该地址错误次数过多时返回 errPairingLimited (不再检查配对码)
+func (s *Server) redeemPairingCode(code, addr string) (*Tenant, Scope, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for a, l := range s.pairingFailures {
+		if now.After(l.resetAt) {
+			delete(s.pairingFailures, a)
+		}
+	}
+	limit := s.pairingFailures[addr]
+	if limit != nil && limit.failures >= maxPairingFailures {
+		return nil, Scope{}, errPairingLimited
+	}
+
+	code = normalizePairingCode(code)
+	p, ok := s.pairings[code]
+	if ok {
+		delete(s.pairings, code)
+	}
+	if !ok || now.After(p.expiresAt) || s.tenants[p.tenantID] == nil {
+		if limit == nil {
+			limit = &pairingLimit{resetAt: now.Add(pairingFailureWindow)}
+			s.pairingFailures[addr] = limit
+		}
+		limit.failures++
+		if limit.failures == maxPairingFailures {
+			fmt.Printf("[%s] %s 使用错误的配对码过多, %s 前拒绝其配对请求\n",
+				now.Format("15:04:05"), addr, limit.resetAt.Format("15:04:05"))
+		}
+		return nil, Scope{}, errPairingInvalid
+	}
+	return s.tenants[p.tenantID], p.scope, nil
+}
+
+// handlePairingCode 已认证的设备为新设备生成配对码, 新设备的权限不能超出当前凭据
+func (s *Server) handlePairingCode(w http.ResponseWriter, r *http.Request, tenant *Tenant) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PairingCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scope, err := resolveScope(req.Scope, requestScope(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	code, expiresAt := s.CreatePairingCode(tenant, scope)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PairingCodeResponse{
+		Success:   true,
+		Code:      code,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// handleAdminPairingCode 管理员为租户生成配对码
+func (s *Server) handleAdminPairingCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID    string `json:"id"`
+		Scope Scope  `json:"scope"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scope, err := req.Scope.normalize()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.RLock()
+	tenant := s.tenants[req.ID]
+	s.mu.RUnlock()
+	if tenant == nil {
+		http.Error(w, "tenant not found", http.StatusNotFound)
+		return
+	}
+
+	code, expiresAt := s.CreatePairingCode(tenant, scope)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PairingCodeResponse{
+		Success:   true,
+		Code:      code,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// handleDevicePair 新设备使用配对码注册, 不需要令牌
+func (s *Server) handleDevicePair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PairRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.MachineID == "" {
+		http.Error(w, "machine ID required", http.StatusBadRequest)
+		return
+	}
+
+	tenant, scope, err := s.redeemPairingCode(req.Code, remoteHost(r))
+	if err == errPairingLimited {
+		http.Error(w, "Too many invalid pairing codes, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid or expired pairing code", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := s.PairDevice(tenant, req.MachineID, req.MachineName, clientIP(r), scope)
+	if err == errDeviceExists {
+		http.Error(w, "Machine is already enrolled, re-enroll it with the tenant token", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EnrollResponse{
+		Success: true,
+		Message: "OK",
+		Token:   token,
+	})
+}
+
+// CreatePairingCode 为新设备生成配对码, scope 为空时新设备的权限与本机相同
+func (s *SyncService) CreatePairingCode(scope Scope) (*PairingCodeResponse, error) {
+	var resp PairingCodeResponse
+	if err := s.postJSON("/devices/pairing-code", PairingCodeRequest{Scope: scope}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Pair 使用配对码连接服务器并为本机注册设备凭据, 不需要输入租户令牌
+func (s *SyncService) Pair(serverURL, code string) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	// 配对请求不需要认证, 使用新的服务器地址发送
+	pairing := &SyncService{config: &config.Config{ServerURL: serverURL}}
+	var resp EnrollResponse
+	err := pairing.postJSON("/devices/pair", PairRequest{
+		Code:        code,
+		MachineID:   s.config.MachineID,
+		MachineName: s.config.MachineName,
+	}, &resp)
+	var httpErr *httpError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("配对码无效或已过期")
+	}
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("错误的配对码过多, 请稍后再试")
+	}
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusConflict {
+		return fmt.Errorf("本机已注册过设备凭据 (可能已被撤销), 不能通过配对码重新注册, 请使用租户令牌")
+	}
+	if err != nil {
+		return fmt.Errorf("配对失败: %v", err)
+	}
+	if !resp.Success || resp.Token == "" {
+		return fmt.Errorf("配对失败: %s", resp.Message)
+	}
+
+	s.config.ServerURL = serverURL
+	s.config.DeviceToken = resp.Token
+	s.config.Token = ""
+	return s.config.Save()
+}
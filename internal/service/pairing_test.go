@@ -0,0 +1,148 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPairingFailuresLimitedPerAddress(t *testing.T) {
+	s, err := NewServer(0, t.TempDir(), "tenant-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tenant := s.tenants["default"]
+	code, _ := s.CreatePairingCode(tenant, Scope{})
+
+	for i := 0; i < maxPairingFailures; i++ {
+		if _, _, err := s.redeemPairingCode("WRONG-CODE", "10.0.0.1"); err != errPairingInvalid {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+	}
+	// 错误次数过多的地址即使提交正确的配对码也被拒绝, 配对码不会被消耗
+	if _, _, err := s.redeemPairingCode(code, "10.0.0.1"); err != errPairingLimited {
+		t.Fatalf("limited address: %v", err)
+	}
+
+	// 其他地址和已生成的配对码不受影响
+	got, _, err := s.redeemPairingCode(strings.ToLower(code), "10.0.0.2")
+	if err != nil || got != tenant {
+		t.Fatalf("other address: %v, %v", got, err)
+	}
+	if _, _, err := s.redeemPairingCode(code, "10.0.0.2"); err != errPairingInvalid {
+		t.Errorf("code reused: %v", err)
+	}
+
+	// 时间窗口结束后恢复
+	s.pairingFailures["10.0.0.1"].resetAt = time.Now().Add(-time.Second)
+	code, _ = s.CreatePairingCode(tenant, Scope{})
+	if got, _, err := s.redeemPairingCode(code, "10.0.0.1"); err != nil || got != tenant {
+		t.Errorf("after window: %v, %v", got, err)
+	}
+}
+
+func TestDevicePairTooManyRequests(t *testing.T) {
+	s, err := NewServer(0, t.TempDir(), "tenant-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	pair := func(addr string) int {
+		req := httptest.NewRequest("POST", "/devices/pair", strings.NewReader(`{"code":"WRONG","machine_id":"m1"}`))
+		req.RemoteAddr = addr
+		req.Header.Set("X-Forwarded-For", "192.0.2.99") // 伪造的转发地址不影响计数
+		w := httptest.NewRecorder()
+		s.handleDevicePair(w, req)
+		return w.Code
+	}
+	for i := 0; i < maxPairingFailures; i++ {
+		if code := pair("10.0.0.1:1234"); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status = %d", i, code)
+		}
+	}
+	if code := pair("10.0.0.1:5678"); code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want 429", code)
+	}
+	if code := pair("10.0.0.2:1234"); code != http.StatusUnauthorized {
+		t.Errorf("other address: status = %d", code)
+	}
+}
+
+func TestDevicePairRejectsEnrolledMachine(t *testing.T) {
+	s, err := NewServer(0, t.TempDir(), "tenant-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tenant := s.tenants["default"]
+	if _, err := s.EnrollDevice(tenant, "full", "desktop", "", Scope{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.EnrollDevice(tenant, "lost", "laptop", "", Scope{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeDevice(tenant, "lost"); err != nil {
+		t.Fatal(err)
+	}
+	full := *tenant.Devices["full"]
+
+	pair := func(machineID string) int {
+		code, _ := s.CreatePairingCode(tenant, Scope{Access: AccessRead})
+		body := `{"code":"` + code + `","machine_id":"` + machineID + `"}`
+		w := httptest.NewRecorder()
+		s.handleDevicePair(w, httptest.NewRequest("POST", "/devices/pair", strings.NewReader(body)))
+		return w.Code
+	}
+
+	// 受限的配对码不能替换已有的完全权限设备, 也不能恢复已撤销的设备
+	if code := pair("full"); code != http.StatusConflict {
+		t.Errorf("existing device: status = %d, want 409", code)
+	}
+	if d := tenant.Devices["full"]; d.TokenHash != full.TokenHash || !d.Scope.IsFull() {
+		t.Errorf("existing device replaced: %+v", d)
+	}
+	if code := pair("lost"); code != http.StatusConflict {
+		t.Errorf("revoked device: status = %d, want 409", code)
+	}
+	if !tenant.Devices["lost"].Revoked() {
+		t.Error("revoked device should stay revoked")
+	}
+
+	if code := pair("new"); code != http.StatusOK {
+		t.Errorf("new device: status = %d", code)
+	}
+}
+
+func TestEnrollDeviceKeepsPreviousOnSaveFailure(t *testing.T) {
+	s, err := NewServer(0, t.TempDir(), "tenant-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tenant := s.tenants["default"]
+	if _, err := s.EnrollDevice(tenant, "m1", "laptop", "", Scope{}); err != nil {
+		t.Fatal(err)
+	}
+	previous := tenant.Devices["m1"]
+
+	s.meta.Close() // 之后保存租户都会失败
+	if _, err := s.EnrollDevice(tenant, "m1", "laptop", "", Scope{}); err == nil {
+		t.Fatal("enroll should fail when the tenant cannot be saved")
+	}
+	if tenant.Devices["m1"] != previous {
+		t.Errorf("device = %+v, want previous credential", tenant.Devices["m1"])
+	}
+	if _, err := s.EnrollDevice(tenant, "m2", "desktop", "", Scope{}); err == nil {
+		t.Fatal("enroll should fail when the tenant cannot be saved")
+	}
+	if _, ok := tenant.Devices["m2"]; ok {
+		t.Error("failed enrollment should not leave a device")
+	}
+	if _, ok := tenant.Clients["m2"]; ok {
+		t.Error("failed enrollment should not leave a client")
+	}
+}
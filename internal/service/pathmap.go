@@ -0,0 +1,527 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/k0ngk0ng/claude-sync/internal/config"
+)
+
+// 路径映射: config.PathMappings 按顺序记录远程机器的目录 (remote) 对应本机的哪个目录 (local)。
+// 多个映射都匹配时使用前缀最长的那个, 前缀必须在路径分隔符处结束, 长度相同时使用排在前面的。
+//
+// Claude Code 把项目保存在 ~/.claude/projects/<编码后的项目路径>/ 下, 编码方式是把绝对路径中
+// 字母和数字以外的字符都替换为 "-" (/Users/work/projects/foo -> -Users-work-projects-foo)。
+// 同步路径中的项目目录名按编码形式映射, 文件内容中的路径按原始形式映射 (见 mapContentPaths)。
+//
+// 编码会丢失信息: /Users/work/projects-foo 和 /Users/work/projects/foo 的编码相同,
+// 所以 "-Users-work-projects-foo" 也会被 /Users/work/projects 的映射转换
+
+// 传输路径 (FileInfo.Path) 是相对于 ~/.claude、以 "/" 分隔的路径, 与客户端的系统无关;
+// remotePath 和 localPath 负责与使用本机分隔符的本地相对路径相互转换
+
+// cleanWirePath 检查收到的传输路径并统一为 "/" 分隔。旧版本的 Windows 客户端上传的路径使用反斜杠,
+// 同样接受; 绝对路径、带盘符的路径以及包含空段、"." 或 ".." 的路径不能放在 ~/.claude 下, 返回空字符串
+func cleanWirePath(p string) string {
+	p = strings.ReplaceAll(p, `\`, "/")
+	if p == "" || p[0] == '/' || len(p) >= 2 && p[1] == ':' {
+		return ""
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return ""
+		}
+	}
+	return p
+}
+
+// encodeProjectDir 按 Claude Code 的方式编码项目路径, 作为 ~/.claude/projects 下的目录名
+func encodeProjectDir(path string) string {
+	path = strings.TrimRight(path, `/\`)
+	b := []byte(path)
+	for i, c := range b {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			b[i] = '-'
+		}
+	}
+	return string(b)
+}
+
+// splitProjectPath 将 projects/<目录>/<其余部分> 形式的相对路径拆分为目录名和其余部分 (含分隔符)
+func splitProjectPath(path string) (dir, rest string, ok bool) {
+	const prefix = "projects"
+	if !strings.HasPrefix(path, prefix) || len(path) <= len(prefix) || !isPathSeparator(path[len(prefix)]) {
+		return "", "", false
+	}
+	dir = path[len(prefix)+1:]
+	if i := strings.IndexAny(dir, `/\`); i >= 0 {
+		dir, rest = dir[:i], dir[i:]
+	}
+	return dir, rest, dir != ""
+}
+
+func isPathSeparator(c byte) bool {
+	return c == '/' || c == '\\'
+}
+
+// mapProjectDir 将项目目录名中 from 的编码形式替换为 to 的编码形式; 有多个映射匹配时使用最长的
+func mapProjectDir(dir string, mappings config.PathMappings, reverse bool) (string, bool) {
+	best, replacement := "", ""
+	for _, m := range mappings {
+		from, to := encodeProjectDir(m.Remote), encodeProjectDir(m.Local)
+		if reverse {
+			from, to = to, from
+		}
+		if from == "" || len(from) <= len(best) {
+			continue
+		}
+		if dir == from || strings.HasPrefix(dir, from+"-") {
+			best, replacement = from, to
+		}
+	}
+	if best == "" {
+		return dir, false
+	}
+	return replacement + dir[len(best):], true
+}
+
+// mapPath 映射同步路径: 只有 projects 下的目录名包含项目路径, 按编码形式映射
+func mapPath(path string, mappings config.PathMappings, reverse bool) string {
+	if dir, rest, ok := splitProjectPath(path); ok {
+		if mapped, ok := mapProjectDir(dir, mappings, reverse); ok {
+			return path[:len("projects")+1] + mapped + rest
+		}
+	}
+	return path
+}
+
+// loadPathMappings 与状态库中记录的路径映射比较 (程序没有运行时修改的配置也能发现)。
+// 映射改变后本地文件对应的远程路径和传输内容都会改变: 远程路径改变的文件在下次同步时
+// 从原路径删除并上传到新路径, 其他机器随之改名; 下次全量扫描时重新读取所有文件
+func (s *SyncService) loadPathMappings() {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	mappings := s.config.PathMappings
+	old, ok := s.state.PathMappings()
+	if ok && fmt.Sprint(old) == fmt.Sprint(mappings) {
+		return
+	}
+	if ok {
+		moved := 0
+		for relPath, st := range s.state.Snapshot() {
+			if !st.Synced() {
+				continue
+			}
+			from, to := s.remotePathWith(relPath, old), s.remotePath(relPath)
+			if from == to {
+				continue
+			}
+			s.state.AddMove(Tombstone{
+				Path:      from,
+				Hash:      st.SyncedHash,
+				DeletedAt: time.Now().Unix(),
+				MachineID: s.config.MachineID,
+			})
+			// 新路径上还没有同步过, 按新文件上传
+			st.SyncedHash, st.SyncedSize, st.Rev, st.SyncedAt = "", 0, 0, 0
+			s.state.Put(relPath, st)
+			moved++
+		}
+		if moved > 0 {
+			fmt.Printf("[%s] 路径映射已改变, %d 个文件将移到新的远程路径\n", time.Now().Format("15:04:05"), moved)
+		}
+		s.state.Invalidate()
+	}
+	s.state.SetPathMappings(mappings)
+	s.state.Save()
+}
+
+// applyPathMapping 远程路径转换为本地路径
+func (s *SyncService) applyPathMapping(path string) string {
+	return mapPath(path, s.config.PathMappings, false)
+}
+
+// 文件内容中的路径映射只处理会话记录 (.jsonl) 和 JSON 文件中保存路径的字段, 例如记录的 cwd
+// 和工具调用参数中的 file_path, 对话文本和命令等其他内容保持不变。替换在 JSON 转义后的原始
+// 字节上进行, 只改动匹配的前缀以及跨系统时其后的分隔符, 其余字节原样保留: 下载的内容映射到
+// 本地后再映射回去, 得到的内容与原内容逐字节相同, 哈希不变, 不会被当作本地修改重新上传。
+//
+// 为了保证可以还原, 内容映射是双向交换: 远程路径换成本地路径的同时, 已经是本地路径的值
+// (例如其他机器上恰好使用了这个路径) 换成远程路径, 否则上传时它会被误当作本机路径映射。
+// 交换的结果再交换一次得到原内容; 个别记录无法原样还原时 (例如混用分隔符的跨系统路径), 整条记录保持不变
+
+// contentPathKeys 保存路径的字段
+var contentPathKeys = map[string]bool{
+	"cwd":           true,
+	"path":          true,
+	"file_path":     true,
+	"filePath":      true,
+	"notebook_path": true,
+	"notebookPath":  true,
+}
+
+// contentRewrite 一条内容映射, from 和 to 是 JSON 转义后的形式
+type contentRewrite struct {
+	from, to       []byte
+	fromWin, toWin bool // Windows 路径, 分隔符为反斜杠
+	mapping        config.PathMapping
+}
+
+func isDriveLetter(c byte) bool {
+	return 'a' <= c|0x20 && c|0x20 <= 'z'
+}
+
+// isWindowsPath 是否为 Windows 路径: 以盘符或 UNC 前缀开头, 或者只使用反斜杠分隔
+func isWindowsPath(p string) bool {
+	if len(p) >= 2 && p[1] == ':' && isDriveLetter(p[0]) {
+		return true
+	}
+	return strings.HasPrefix(p, `\\`) || strings.Contains(p, `\`) && !strings.Contains(p, "/")
+}
+
+// jsonEscape 字符串在 JSON 中的转义形式 (不含引号), 与 Claude Code 写入会话记录的方式相同
+func jsonEscape(s string) []byte {
+	var b []byte
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b = append(b, '\\', byte(r))
+		case r < 0x20:
+			b = append(b, fmt.Sprintf(`\u%04x`, r)...)
+		default:
+			b = utf8.AppendRune(b, r)
+		}
+	}
+	return b
+}
+
+// contentRewrites 生成内容映射, 最长的优先匹配; reverse 为 true 时从本地路径映射到远程路径
+func contentRewrites(mappings config.PathMappings, reverse bool) []contentRewrite {
+	var list []contentRewrite
+	for _, m := range mappings {
+		from, to := strings.TrimRight(m.Remote, `/\`), strings.TrimRight(m.Local, `/\`)
+		if reverse {
+			from, to = to, from
+		}
+		if from == "" || to == "" {
+			continue
+		}
+		list = append(list, contentRewrite{
+			from:    jsonEscape(from),
+			to:      jsonEscape(to),
+			fromWin: isWindowsPath(from),
+			toWin:   isWindowsPath(to),
+			mapping: m,
+		})
+	}
+	sort.SliceStable(list, func(i, j int) bool { return len(list[i].from) > len(list[j].from) })
+	return list
+}
+
+// countSeparators 统计转义形式中的 "/" 和反斜杠 (转义为 "\\") 的个数
+func countSeparators(raw []byte) (slashes, backslashes int) {
+	for i := 0; i < len(raw); i++ {
+		switch raw[i] {
+		case '/':
+			slashes++
+		case '\\':
+			if i+1 < len(raw) && raw[i+1] == '\\' {
+				backslashes++
+			}
+			i++
+		}
+	}
+	return slashes, backslashes
+}
+
+// convertSeparators 转换转义形式中的分隔符, toWin 为 true 时 "/" 转为反斜杠, 否则反斜杠转为 "/"
+func convertSeparators(raw []byte, toWin bool) []byte {
+	out := make([]byte, 0, len(raw))
+	for i := 0; i < len(raw); i++ {
+		switch {
+		case raw[i] == '/' && toWin:
+			out = append(out, '\\', '\\')
+		case raw[i] == '\\' && i+1 < len(raw):
+			if raw[i+1] == '\\' && !toWin {
+				out = append(out, '/')
+			} else {
+				out = append(out, raw[i], raw[i+1])
+			}
+			i++
+		default:
+			out = append(out, raw[i])
+		}
+	}
+	return out
+}
+
+// rewritePathValue 映射一个路径字段的值 (转义形式), 同时返回使用的映射在 rewrites 中的位置;
+// 没有匹配的映射时返回 nil 和 -1。
+// 前缀必须在路径分隔符处结束; 跨系统映射时, 只使用来源系统分隔符的路径同时转换其余部分的分隔符,
+// 混用两种分隔符的路径只替换前缀, 保证映射可以原样反向
+func rewritePathValue(raw []byte, rewrites []contentRewrite) ([]byte, int) {
+	for i, rw := range rewrites {
+		if !bytes.HasPrefix(raw, rw.from) {
+			continue
+		}
+		rest := raw[len(rw.from):]
+		if len(rest) > 0 && rest[0] != '/' && !((rw.fromWin || rw.toWin) && bytes.HasPrefix(rest, []byte(`\\`))) {
+			continue
+		}
+		if rw.fromWin != rw.toWin {
+			slashes, backslashes := countSeparators(rest)
+			if rw.fromWin && slashes == 0 || !rw.fromWin && backslashes == 0 {
+				rest = convertSeparators(rest, rw.toWin)
+			}
+		}
+		return append(append([]byte{}, rw.to...), rest...), i
+	}
+	return nil, -1
+}
+
+// jsonStringEnd 返回从 start 开始的 JSON 字符串的结束引号位置, 字符串不完整时返回 -1
+func jsonStringEnd(data []byte, start int) int {
+	for i := start; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// rewriteJSONPaths 映射 JSON 文本中路径字段的字符串值, 其他字节原样保留; 没有改动时返回 nil。
+// 只做词法扫描, 不完整或无效的 JSON 也不会出错
+func rewriteJSONPaths(data []byte, rewrites []contentRewrite) []byte {
+	var out []byte
+	last := 0
+	pathKey, afterColon := false, false
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '"':
+			end := jsonStringEnd(data, i+1)
+			if end < 0 {
+				i = len(data)
+				break
+			}
+			raw := data[i+1 : end]
+			if afterColon && pathKey {
+				if mapped, _ := rewritePathValue(raw, rewrites); mapped != nil {
+					out = append(out, data[last:i+1]...)
+					out = append(out, mapped...)
+					last = end
+				}
+			}
+			afterColon = false
+			// 后面紧跟冒号的是字段名
+			j := end + 1
+			for j < len(data) && isJSONSpace(data[j]) {
+				j++
+			}
+			if j < len(data) && data[j] == ':' {
+				pathKey = contentPathKeys[string(raw)]
+			}
+			i = end
+		case ':':
+			afterColon = true
+		case ' ', '\t', '\r', '\n':
+		default:
+			afterColon = false
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	return append(out, data[last:]...)
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// swapRewrites 双向交换表, 最长的优先匹配; 内容中没有出现任何映射的路径时返回 nil。
+// 检查能否还原时映射后的内容可能用到任何一条映射, 所以不按内容筛选
+func swapRewrites(content []byte, mappings config.PathMappings) []contentRewrite {
+	list := append(contentRewrites(mappings, false), contentRewrites(mappings, true)...)
+	for _, rw := range list {
+		if bytes.Contains(content, rw.from) {
+			sort.SliceStable(list, func(i, j int) bool { return len(list[i].from) > len(list[j].from) })
+			return list
+		}
+	}
+	return nil
+}
+
+// swapRecord 交换一条记录中的路径, 没有改动或无法原样还原时返回 nil
+func swapRecord(record []byte, rewrites []contentRewrite) []byte {
+	mapped := rewriteJSONPaths(record, rewrites)
+	if mapped == nil || !bytes.Equal(rewriteJSONPaths(mapped, rewrites), record) {
+		return nil
+	}
+	return mapped
+}
+
+// mapContentPaths 映射文件内容中的路径: .jsonl 文件逐行处理, .json 文件整体处理, 其他文件不变。
+// 映射是双向交换, 下载和上传使用同一个函数, 映射两次得到原内容
+func mapContentPaths(path string, content []byte, mappings config.PathMappings) []byte {
+	ext := strings.ToLower(filepath.Ext(path))
+	if len(mappings) == 0 || ext != ".jsonl" && ext != ".json" {
+		return content
+	}
+	rewrites := swapRewrites(content, mappings)
+	if len(rewrites) == 0 {
+		return content
+	}
+
+	if ext == ".json" {
+		if out := swapRecord(content, rewrites); out != nil {
+			return out
+		}
+		return content
+	}
+
+	var out []byte
+	last := 0
+	for start := 0; start < len(content); {
+		end := bytes.IndexByte(content[start:], '\n')
+		if end < 0 {
+			end = len(content)
+		} else {
+			end += start
+		}
+		if mapped := swapRecord(content[start:end], rewrites); mapped != nil {
+			out = append(out, content[last:start]...)
+			out = append(out, mapped...)
+			last = end
+		}
+		start = end + 1
+	}
+	if out == nil {
+		return content
+	}
+	return append(out, content[last:]...)
+}
+
+// applyContentPathMapping 将文件内容中的远程路径替换为本地路径
+func (s *SyncService) applyContentPathMapping(path string, content []byte) []byte {
+	return mapContentPaths(path, content, s.config.PathMappings)
+}
+
+// reverseContentPathMapping 将文件内容中的本地路径替换为远程路径
+func (s *SyncService) reverseContentPathMapping(path string, content []byte) []byte {
+	return mapContentPaths(path, content, s.config.PathMappings)
+}
+
+// isAbsPath 是否为 macOS/Linux 或 Windows 的绝对路径
+func isAbsPath(p string) bool {
+	if strings.HasPrefix(p, "/") || strings.HasPrefix(p, `\\`) {
+		return true
+	}
+	return len(p) >= 3 && p[1] == ':' && isDriveLetter(p[0]) && isPathSeparator(p[2])
+}
+
+// comparablePath 比较路径用的形式: 去掉末尾的分隔符并统一为 "/", Windows 路径不区分大小写
+func comparablePath(p string) string {
+	p = strings.TrimRight(p, `/\`)
+	if isWindowsPath(p) {
+		return strings.ToLower(strings.ReplaceAll(p, `\`, "/"))
+	}
+	return p
+}
+
+// hasPathPrefix path 是否等于 prefix 或位于其下 (前缀在路径分隔符处结束)
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix) && len(path) > len(prefix) && isPathSeparator(path[len(prefix)])
+}
+
+// pathsOverlap 两个路径是否相同或一个包含另一个
+func pathsOverlap(a, b string) bool {
+	a, b = comparablePath(a), comparablePath(b)
+	return hasPathPrefix(a, b) || hasPathPrefix(b, a)
+}
+
+// ValidatePathMappings 检查路径映射: 路径必须是绝对路径, 不能是 "/" (Windows 的盘符根目录可以,
+// 例如 C:\ → /mnt/c); 远程路径、本地路径以及它们
+// 对应的项目目录名都不能重复, 否则反向映射无法确定; 远程路径和本地路径不能重叠, 否则映射后的路径
+// 会被再次映射 (链式或循环映射), 也无法原样还原
+func ValidatePathMappings(mappings config.PathMappings) error {
+	for i, m := range mappings {
+		for _, p := range []string{m.Remote, m.Local} {
+			if !isAbsPath(p) {
+				return fmt.Errorf("路径 %s 不是绝对路径", p)
+			}
+			if strings.TrimRight(p, `/\`) == "" {
+				return fmt.Errorf("不能映射根目录 %s", p)
+			}
+		}
+		for _, prev := range mappings[:i] {
+			switch {
+			case comparablePath(prev.Remote) == comparablePath(m.Remote):
+				return fmt.Errorf("远程路径 %s 已有映射", m.Remote)
+			case comparablePath(prev.Local) == comparablePath(m.Local):
+				return fmt.Errorf("本地路径 %s 已经是 %s 的映射, 无法确定反向映射", m.Local, prev.Remote)
+			case encodeProjectDir(prev.Remote) == encodeProjectDir(m.Remote):
+				return fmt.Errorf("远程路径 %s 和 %s 的项目目录名相同 (%s)", m.Remote, prev.Remote, encodeProjectDir(m.Remote))
+			case encodeProjectDir(prev.Local) == encodeProjectDir(m.Local):
+				return fmt.Errorf("本地路径 %s 和 %s 的项目目录名相同 (%s)", m.Local, prev.Local, encodeProjectDir(m.Local))
+			}
+		}
+	}
+	for _, a := range mappings {
+		for _, b := range mappings {
+			if !pathsOverlap(a.Remote, b.Local) {
+				continue
+			}
+			if a == b {
+				return fmt.Errorf("映射 %s → %s 的远程路径和本地路径重叠", a.Remote, a.Local)
+			}
+			return fmt.Errorf("映射 %s → %s 和 %s → %s 形成链式或循环映射", b.Remote, b.Local, a.Remote, a.Local)
+		}
+	}
+	return nil
+}
+
+// PathPreview 路径映射的预览
+type PathPreview struct {
+	Path             string              `json:"path"`
+	Result           string              `json:"result"`             // 映射后的路径, 没有匹配的映射时与 Path 相同
+	Reverse          bool                `json:"reverse"`            // Path 是本机路径, 映射为远程路径
+	Mapping          *config.PathMapping `json:"mapping,omitempty"`  // 使用的映射
+	ProjectDir       string              `json:"project_dir"`        // Path 的项目目录名
+	ResultProjectDir string              `json:"result_project_dir"` // 同步时项目目录名映射的结果
+}
+
+// PreviewPathMapping 预览路径的映射结果: 先作为远程路径映射到本机, 没有匹配的映射时作为本机路径
+// 映射到远程。转换方式与同步时转换会话记录中的路径字段相同
+func PreviewPathMapping(mappings config.PathMappings, path string) PathPreview {
+	preview := PathPreview{Path: path, Result: path, ProjectDir: encodeProjectDir(path)}
+	preview.ResultProjectDir = preview.ProjectDir
+	raw := jsonEscape(path)
+	for _, reverse := range []bool{false, true} {
+		rewrites := contentRewrites(mappings, reverse)
+		mapped, i := rewritePathValue(raw, rewrites)
+		if i < 0 {
+			continue
+		}
+		var result string
+		if err := json.Unmarshal(append(append([]byte{'"'}, mapped...), '"'), &result); err != nil {
+			continue
+		}
+		m := rewrites[i].mapping
+		preview.Result, preview.Reverse, preview.Mapping = result, reverse, &m
+		if dir, ok := mapProjectDir(preview.ProjectDir, mappings, reverse); ok {
+			preview.ResultProjectDir = dir
+		}
+		break
+	}
+	return preview
+}
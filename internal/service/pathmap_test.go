@@ -0,0 +1,188 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/k0ngk0ng/claude-sync/internal/config"
+)
+
+var testMappings = config.PathMappings{
+	{Remote: "/Users/work", Local: "/home/me"},
+	{Remote: `C:\Users\work\win`, Local: "/home/me-win"},
+}
+
+// roundTrip 检查内容下载到本地再上传 (以及反过来) 后与原内容逐字节相同
+func roundTrip(t *testing.T, path, content string, mappings config.PathMappings) string {
+	t.Helper()
+	local := string(mapContentPaths(path, []byte(content), mappings))
+	if back := string(mapContentPaths(path, []byte(local), mappings)); back != content {
+		t.Errorf("round trip changed content:\n  in:    %s\n  local: %s\n  back:  %s", content, local, back)
+	}
+	return local
+}
+
+func TestContentPathMapping(t *testing.T) {
+	for _, tc := range []struct {
+		content, want string
+	}{
+		// 路径字段被映射, 对话文本不变
+		{`{"cwd":"/Users/work/x","message":"cd /Users/work/x"}`, `{"cwd":"/home/me/x","message":"cd /Users/work/x"}`},
+		// 前缀必须在分隔符处结束
+		{`{"cwd":"/Users/workshop/x"}`, `{"cwd":"/Users/workshop/x"}`},
+		// 跨系统映射同时转换分隔符
+		{`{"file_path":"C:\\Users\\work\\win\\a\\b.go"}`, `{"file_path":"/home/me-win/a/b.go"}`},
+		// 已经是本机路径的值交换为远程路径, 上传时才能还原
+		{`{"cwd":"/home/me/x"}`, `{"cwd":"/Users/work/x"}`},
+		{`{"cwd":"/home/me/x","file_path":"/Users/work/y"}`, `{"cwd":"/Users/work/x","file_path":"/home/me/y"}`},
+		// 混用分隔符的跨系统路径只替换前缀
+		{`{"path":"C:\\Users\\work\\win/a\\b"}`, `{"path":"/home/me-win/a\\b"}`},
+	} {
+		if got := roundTrip(t, "projects/p/s.jsonl", tc.content, testMappings); got != tc.want {
+			t.Errorf("map %s\n  got  %s\n  want %s", tc.content, got, tc.want)
+		}
+	}
+}
+
+func TestContentPathMappingRoundTrip(t *testing.T) {
+	lines := []string{
+		`{"cwd":"/Users/work/x","type":"user"}`,
+		`{"cwd":"/home/me/x"}`,
+		`{"toolUseResult":{"filePath":"/home/me-win/z","file_path":"C:\\Users\\work\\win\\z"}}`,
+		`{"path":"/Users/work\\odd"}`,
+		`{"cwd":"/elsewhere"}`,
+		`not json "cwd": "/Users/work/x"`,
+		`{"cwd":"/Users/work/unterminated`,
+	}
+	content := strings.Join(lines, "\n") + "\n"
+	roundTrip(t, "projects/p/s.jsonl", content, testMappings)
+	roundTrip(t, "settings.json", `{"permissions":{"path":"/home/me/a"},"cwd":"/Users/work/b"}`, testMappings)
+
+	// 其他文件不做映射
+	if got := string(mapContentPaths("CLAUDE.md", []byte(`"cwd":"/Users/work/x"`), testMappings)); got != `"cwd":"/Users/work/x"` {
+		t.Errorf("markdown mapped: %s", got)
+	}
+}
+
+func TestContentPathMappingSkipsIrreversibleRecords(t *testing.T) {
+	// 嵌套的本地路径: /Users/a/sub/x 映射为 /l/sub/x 后会被反向映射为 /Users/b/x, 整条记录保持不变
+	mappings := config.PathMappings{
+		{Remote: "/Users/a", Local: "/l"},
+		{Remote: "/Users/b", Local: "/l/sub"},
+	}
+	record := `{"cwd":"/Users/a/sub/x","file_path":"/Users/a/y"}`
+	if got := roundTrip(t, "projects/p/s.jsonl", record, mappings); got != record {
+		t.Errorf("irreversible record mapped to %s", got)
+	}
+	if got := roundTrip(t, "projects/p/s.jsonl", `{"cwd":"/Users/a/y"}`, mappings); got != `{"cwd":"/l/y"}` {
+		t.Errorf("reversible record mapped to %s", got)
+	}
+}
+
+func TestCleanWirePath(t *testing.T) {
+	for in, want := range map[string]string{
+		"projects/a/s.jsonl":   "projects/a/s.jsonl",
+		`projects\a\s.jsonl`:   "projects/a/s.jsonl",
+		"projects/../x":        "",
+		"/abs":                 "",
+		"C:/x":                 "",
+		"":                     "",
+		"projects//a/s.jsonl":  "",
+		"projects/./a/s.jsonl": "",
+	} {
+		if got := cleanWirePath(in); got != want {
+			t.Errorf("cleanWirePath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestValidatePathMappings(t *testing.T) {
+	for _, tc := range []struct {
+		mappings config.PathMappings
+		ok       bool
+	}{
+		{config.PathMappings{{Remote: "/Users/work", Local: "/home/me"}, {Remote: `C:\work`, Local: "/mnt/work"}}, true},
+		{config.PathMappings{{Remote: `C:\`, Local: "/mnt/c"}}, true},
+		{config.PathMappings{{Remote: "relative", Local: "/home/me"}}, false},
+		{config.PathMappings{{Remote: "/", Local: "/home/me"}}, false},
+		{config.PathMappings{{Remote: "/a", Local: "/x"}, {Remote: "/a/", Local: "/y"}}, false},
+		{config.PathMappings{{Remote: "/a", Local: "/x"}, {Remote: "/b", Local: "/x"}}, false},
+		{config.PathMappings{{Remote: "/a", Local: "/a/local"}}, false},
+		{config.PathMappings{{Remote: "/a", Local: "/b"}, {Remote: "/b", Local: "/c"}}, false},
+		{config.PathMappings{{Remote: "/a/b", Local: "/x"}, {Remote: "/a-b", Local: "/y"}}, false},
+	} {
+		if err := ValidatePathMappings(tc.mappings); (err == nil) != tc.ok {
+			t.Errorf("ValidatePathMappings(%v) = %v, want ok=%v", tc.mappings, err, tc.ok)
+		}
+	}
+}
+
+func TestPathMappingChangeInvalidatesState(t *testing.T) {
+	cfg := &config.Config{PathMappings: config.PathMappings{{Remote: "/Users/work", Local: "/home/me"}}}
+	s := newTestSyncService(t, cfg)
+	s.state.Put("projects/p/s.jsonl", FileState{ModTime: 123, Size: 4, Hash: "h"})
+
+	// 配置没有变化时保留缓存
+	s.UpdateConfig(cfg)
+	if fs, _ := s.state.Get("projects/p/s.jsonl"); fs.ModTime != 123 {
+		t.Fatalf("state invalidated without change: %+v", fs)
+	}
+
+	cfg.PathMappings = append(cfg.PathMappings, config.PathMapping{Remote: "/Users/other", Local: "/home/other"})
+	s.UpdateConfig(cfg)
+	if fs, _ := s.state.Get("projects/p/s.jsonl"); fs.ModTime != 0 {
+		t.Errorf("state not invalidated after mapping change: %+v", fs)
+	}
+
+	// 同步过的文件在程序没有运行时修改了映射: 从原远程路径删除, 上传到新路径, 其他机器随之改名
+	srv, ts := newTestServer(t)
+	a := newTestClient(t, srv, ts, "machine-a")
+	b := newTestClient(t, srv, ts, "machine-b")
+	local := filepath.Join("projects", "-home-me-x", "s.jsonl")
+	writeTestFile(t, a, local, `{"cwd":"/home/me/x"}`+"\n")
+	for _, c := range []*SyncService{a, b} {
+		if err := c.SyncNow(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	moved := *a.config
+	moved.PathMappings = config.PathMappings{{Remote: "/Users/work", Local: "/home/me"}}
+	a = restartTestClient(t, a, &moved)
+	for _, c := range []*SyncService{a, b, a} {
+		if err := c.SyncNow(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := a.GetStats().Uploaded + a.GetStats().Downloaded; n != 0 {
+		t.Errorf("files still transferred after the move: %d", n)
+	}
+
+	tenant := srv.tenants["default"]
+	if _, ok := tenant.Files["projects/-home-me-x/s.jsonl"]; ok || tenant.Tombstones["projects/-home-me-x/s.jsonl"] == nil {
+		t.Errorf("old remote path not deleted: files %v", tenant.Files)
+	}
+	f, ok := tenant.Files["projects/-Users-work-x/s.jsonl"]
+	if !ok {
+		t.Fatalf("file not uploaded to the new remote path: %v", tenant.Files)
+	}
+	if content, _ := tenant.blobs.Read(f.Hash); string(content) != `{"cwd":"/Users/work/x"}`+"\n" {
+		t.Errorf("remote content = %s", content)
+	}
+
+	// 本机只有原来的文件, 没有重复的副本
+	if got := readTestFile(t, a, local); got != `{"cwd":"/home/me/x"}`+"\n" {
+		t.Errorf("local content = %s", got)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(a.claudeDir, "projects")); len(entries) != 1 {
+		t.Errorf("local projects: %v", entries)
+	}
+	if _, err := os.Stat(filepath.Join(b.claudeDir, local)); !os.IsNotExist(err) {
+		t.Errorf("other machine kept the old path: %v", err)
+	}
+	if got := readTestFile(t, b, filepath.Join("projects", "-Users-work-x", "s.jsonl")); got != `{"cwd":"/Users/work/x"}`+"\n" {
+		t.Errorf("other machine content = %s", got)
+	}
+}
@@ -0,0 +1,291 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// 敏感信息的处理方式 (config.Config.Redaction)
+const (
+	RedactMask  = "mask"  // 替换为占位符后上传 (默认)
+	RedactBlock = "block" // 包含敏感信息的文件不上传
+	RedactOff   = "off"   // 不检测
+)
+
+// redactRule 敏感信息检测规则; 正则中有名为 secret 的分组时只替换该分组
+type redactRule struct {
+	name  string
+	re    *regexp.Regexp
+	check func(secret string) bool // 额外的检查, 减少误报
+}
+
+// builtinRedactRules 常见密钥格式
+var builtinRedactRules = []redactRule{
+	{name: "private-key", re: regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`)},
+	{name: "anthropic-key", re: regexp.MustCompile(`sk-ant-[A-Za-z0-9_-]{20,}`)},
+	{name: "openai-key", re: regexp.MustCompile(`sk-(?:proj-)?[A-Za-z0-9_-]{32,}`)},
+	{name: "aws-access-key", re: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{name: "github-token", re: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})`)},
+	{name: "gitlab-token", re: regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}`)},
+	{name: "slack-token", re: regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{name: "google-api-key", re: regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}`)},
+	{name: "stripe-key", re: regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{16,}`)},
+	{name: "jwt", re: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`)},
+	// .env 和配置文件中的 KEY=value 以及 JSON 中的 "key": "value";
+	// 键名必须以 SECRET、TOKEN 等结尾 (GITHUB_TOKEN、apiKey, 但不包括 max_tokens、token_count);
+	// 会话记录中的引号和换行是转义的 (\" 和 \n), 值在反斜杠处结束
+	{
+		name:  "secret-assignment",
+		re:    regexp.MustCompile(`(?i)\b[A-Z0-9_]*?(?:SECRET|TOKEN|PASSWORD|PASSWD|API_?KEY|ACCESS_?KEY|SECRET_?KEY|PRIVATE_?KEY)\\?["']?\s*[=:]\s*\\?["']?(?P<secret>[^\s"'\\,;]{12,})`),
+		check: looksRandom,
+	},
+}
+
+// minSecretEntropy 当作密钥的值每个字符至少包含的信息量 (比特), 排除 "aaaa1111aaaa1111" 这样重复的值
+const minSecretEntropy = 3.0
+
+// looksRandom 值同时包含字母和数字且字符足够分散时才当作密钥, 避免把普通单词、数字
+// 或 $GITHUB_TOKEN 这样的变量引用当作密钥
+func looksRandom(secret string) bool {
+	if strings.HasPrefix(secret, "$") {
+		return false
+	}
+	var letter, digit bool
+	counts := make(map[rune]int)
+	n := 0
+	for _, r := range secret {
+		letter = letter || unicode.IsLetter(r)
+		digit = digit || unicode.IsDigit(r)
+		counts[r]++
+		n++
+	}
+	if !letter || !digit {
+		return false
+	}
+	entropy := 0.0
+	for _, c := range counts {
+		p := float64(c) / float64(n)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy >= minSecretEntropy
+}
+
+// unmaskableFiles 替换敏感信息后无法使用的文件 (按文件名): 设置中的密钥被替换为占位符后,
+// 其他机器收到的设置无法使用, 还会覆盖那里的正确设置。这些文件包含敏感信息时总是不上传
+var unmaskableFiles = map[string]bool{
+	"settings.json":       true,
+	"settings.local.json": true,
+}
+
+// redactPlaceholder 替换敏感信息的占位符; 占位符本身不会再被检测到, 重复处理的结果不变
+func redactPlaceholder(rule string) string {
+	return "[REDACTED:" + rule + "]"
+}
+
+// redactor 上传前的敏感信息过滤器
+type redactor struct {
+	rules []redactRule
+	block bool
+}
+
+// newRedactor 根据配置创建过滤器, mode 为 RedactOff 时返回 nil
+func newRedactor(mode string, patterns []string) (*redactor, error) {
+	switch mode {
+	case "", RedactMask, RedactBlock:
+	case RedactOff:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("未知的敏感信息处理方式: %s", mode)
+	}
+
+	r := &redactor{
+		rules: append([]redactRule{}, builtinRedactRules...),
+		block: mode == RedactBlock,
+	}
+	for i, p := range patterns {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("自定义规则 %q 无效: %v", p, err)
+		}
+		r.rules = append(r.rules, redactRule{name: fmt.Sprintf("custom-%d", i+1), re: re})
+	}
+	return r, nil
+}
+
+// ValidateRedaction 检查敏感信息处理方式和自定义规则
+func ValidateRedaction(mode string, patterns []string) error {
+	_, err := newRedactor(mode, patterns)
+	return err
+}
+
+// redact 替换内容中的敏感信息, 返回处理后的内容和每条规则的匹配次数 (没有匹配时为 nil)
+func (r *redactor) redact(content []byte) ([]byte, map[string]int) {
+	var hits map[string]int
+	for _, rule := range r.rules {
+		secret := rule.re.SubexpIndex("secret")
+		matches := rule.re.FindAllSubmatchIndex(content, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		var out []byte
+		last := 0
+		for _, m := range matches {
+			start, end := m[0], m[1]
+			if secret > 0 {
+				start, end = m[2*secret], m[2*secret+1]
+			}
+			if start < 0 || start < last {
+				continue
+			}
+			value := string(content[start:end])
+			if strings.HasPrefix(value, "[REDACTED:") || (rule.check != nil && !rule.check(value)) {
+				continue
+			}
+			out = append(out, content[last:start]...)
+			out = append(out, redactPlaceholder(rule.name)...)
+			last = end
+			if hits == nil {
+				hits = make(map[string]int)
+			}
+			hits[rule.name]++
+		}
+		if out != nil {
+			content = append(out, content[last:]...)
+		}
+	}
+	return content, hits
+}
+
+// Redaction 文件中检测到的敏感信息
+type Redaction struct {
+	Path       string         `json:"path"`        // 本地路径
+	Rules      map[string]int `json:"rules"`       // 规则 -> 匹配次数
+	Blocked    bool           `json:"blocked"`     // 文件未上传 (处理方式为 block, 或者是 unmaskableFiles 中的文件)
+	DetectedAt int64          `json:"detected_at"` // 检测时间 (Unix 秒)
+}
+
+// loadRedactor 根据配置创建敏感信息过滤器, 配置无效时使用默认规则。
+// 规则改变后传输内容也会改变, 下次全量扫描时重新读取所有文件
+func (s *SyncService) loadRedactor() {
+	key := s.config.Redaction + "\x00" + strings.Join(s.config.RedactPatterns, "\x00")
+	r, err := newRedactor(s.config.Redaction, s.config.RedactPatterns)
+	if err != nil {
+		fmt.Printf("敏感信息规则无效, 使用默认规则: %v\n", err)
+		r, _ = newRedactor(RedactMask, nil)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.redactions != nil && key == s.redactKey {
+		return
+	}
+	if s.redactions != nil {
+		s.state.Invalidate()
+	}
+	s.redactor = r
+	s.redactKey = key
+	s.redactions = make(map[string]*Redaction)
+}
+
+// redactLocal 替换本地文件内容中的敏感信息并记录结果; 处理方式为 block 或文件在 unmaskableFiles 中时
+// 返回原内容, 由 uploadBlocked 阻止上传
+func (s *SyncService) redactLocal(relPath string, data []byte) []byte {
+	s.mu.RLock()
+	r := s.redactor
+	s.mu.RUnlock()
+	if r == nil {
+		return data
+	}
+
+	redacted, hits := r.redact(data)
+	block := r.block || unmaskableFiles[filepath.Base(relPath)]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hits == nil {
+		delete(s.redactions, relPath)
+		return data
+	}
+	if prev, ok := s.redactions[relPath]; !ok || prev.Blocked != block || fmt.Sprint(prev.Rules) != fmt.Sprint(hits) {
+		fmt.Printf("[%s] 检测到敏感信息: %s %v\n", time.Now().Format("15:04:05"), relPath, hits)
+	}
+	s.redactions[relPath] = &Redaction{
+		Path:       relPath,
+		Rules:      hits,
+		Blocked:    block,
+		DetectedAt: time.Now().Unix(),
+	}
+	if block {
+		return data
+	}
+	return redacted
+}
+
+// restoreRedacted 将下载的内容中本机被替换的敏感信息还原为本地原文。过滤只作用于离开本机的内容,
+// 但服务器会把本机上传过的内容发回来 (追加传输的基准、其他机器追加后的版本、合并后的会话记录),
+// 直接写入会把本地文件中的密钥换成占位符。local 是本地文件当前的原文, content 是下载的内容
+// (已解密并映射为本地路径): content 以过滤后的 local 开头时保留 local 原文, 只追加其后的部分;
+// 会话记录逐行还原, 与本地某一行过滤后的结果相同的行换回该行的原文
+func (s *SyncService) restoreRedacted(relPath string, local, content []byte) []byte {
+	s.mu.RLock()
+	r := s.redactor
+	s.mu.RUnlock()
+	if r == nil || len(local) == 0 {
+		return content
+	}
+	redacted, hits := r.redact(local)
+	if hits == nil {
+		return content
+	}
+	if bytes.HasPrefix(content, redacted) {
+		return append(append([]byte{}, local...), content[len(redacted):]...)
+	}
+	if !isMergeable(relPath) {
+		return content
+	}
+
+	originals := make(map[string][]byte)
+	for _, line := range bytes.Split(local, []byte("\n")) {
+		if redacted, hits := r.redact(line); hits != nil {
+			originals[string(redacted)] = line
+		}
+	}
+	lines := bytes.Split(content, []byte("\n"))
+	for i, line := range lines {
+		if original, ok := originals[string(line)]; ok {
+			lines[i] = original
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// uploadBlocked 文件是否因包含敏感信息而不上传
+func (s *SyncService) uploadBlocked(relPath string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.redactions[relPath]
+	return ok && r.Blocked
+}
+
+// Redactions 最近检测到敏感信息的文件, 按路径排序
+func (s *SyncService) Redactions() []Redaction {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Redaction, 0, len(s.redactions))
+	for _, r := range s.redactions {
+		list = append(list, *r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
@@ -0,0 +1,346 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// syncRule 一条 gitignore 风格的规则
+type syncRule struct {
+	pattern string
+	re      *regexp.Regexp
+	negate  bool // 以 "!" 开头: 重新包含之前排除的路径
+	dirOnly bool // 以 "/" 结尾: 只匹配目录
+}
+
+// syncRules 决定哪些文件参与同步。规则使用 gitignore 语法, 路径相对于 ~/.claude 并以 "/" 分隔:
+//
+//	*.tmp                     任意位置的文件名
+//	projects/-Users-me-tmp/   目录及其下的所有文件
+//	projects/**/tool-results/ 任意层级的目录
+//	!projects/*/keep.jsonl    重新包含
+//
+// 排除某个目录后, 其下的文件都被排除; 后面的规则优先
+type syncRules struct {
+	rules []syncRule
+	roots []string // 同步根, 为空时不限制
+}
+
+// DefaultSyncRoots 默认同步的 ~/.claude 下的目录和文件: 会话记录、自定义命令、子代理、技能、
+// 全局的 CLAUDE.md 和设置 (包含敏感信息的设置不上传, 见 unmaskableFiles)
+var DefaultSyncRoots = []string{"projects", "commands", "agents", "skills", "CLAUDE.md", "settings.json"}
+
+// deniedFiles 不能离开本机的文件 (登录凭据和同步工具自己的配置、日志、状态), 无论同步根和规则
+// 如何设置, 任何层级的同名文件都不上传, 服务器发来的也不写入
+var deniedFiles = map[string]bool{
+	".credentials.json":   true,
+	"sync-config.json":    true,
+	"sync.log":            true,
+	"sync-state.json":     true,
+	"sync-state.json.tmp": true,
+}
+
+// syncTempPrefix 下载的文件写入本地时使用的临时文件名前缀 (见 replaceLocalFile), 扫描时跳过
+const syncTempPrefix = ".sync-tmp-"
+
+// cleanSyncRoots 检查并规范化同步根, 统一为 "/" 分隔且去掉首尾的 "/"; 为空时返回默认值
+func cleanSyncRoots(roots []string) ([]string, error) {
+	var cleaned []string
+	seen := make(map[string]bool)
+	for _, root := range roots {
+		r := strings.Trim(strings.ReplaceAll(strings.TrimSpace(root), `\`, "/"), "/")
+		if r == "" {
+			continue
+		}
+		if isAbsPath(root) || cleanWirePath(r) == "" {
+			return nil, fmt.Errorf("同步根 %q 无效, 必须是 ~/.claude 下的相对路径", root)
+		}
+		if deniedFiles[path.Base(r)] {
+			return nil, fmt.Errorf("%s 不能同步", r)
+		}
+		if !seen[r] {
+			seen[r] = true
+			cleaned = append(cleaned, r)
+		}
+	}
+	if len(cleaned) == 0 {
+		return append([]string{}, DefaultSyncRoots...), nil
+	}
+	return cleaned, nil
+}
+
+// ValidateSyncRoots 检查同步根
+func ValidateSyncRoots(roots []string) error {
+	_, err := cleanSyncRoots(roots)
+	return err
+}
+
+// compileSyncRules 编译规则, 跳过空行和 "#" 开头的注释; excludedProjects 中的项目目录总是被排除
+func compileSyncRules(lines, excludedProjects []string) (*syncRules, error) {
+	r := &syncRules{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := syncRule{pattern: line}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			return nil, fmt.Errorf("规则 %q 无效", rule.pattern)
+		}
+		re, err := regexp.Compile(globToRegexp(line))
+		if err != nil {
+			return nil, fmt.Errorf("规则 %q 无效: %v", rule.pattern, err)
+		}
+		rule.re = re
+		r.rules = append(r.rules, rule)
+	}
+
+	for _, name := range excludedProjects {
+		r.rules = append(r.rules, syncRule{
+			pattern: "projects/" + name + "/",
+			re:      regexp.MustCompile("^" + regexp.QuoteMeta("projects/"+name) + "$"),
+			dirOnly: true,
+		})
+	}
+	return r, nil
+}
+
+// ValidateSyncRules 检查同步规则的语法
+func ValidateSyncRules(lines []string) error {
+	_, err := compileSyncRules(lines, nil)
+	return err
+}
+
+// globToRegexp 将 gitignore 模式转换为正则表达式: 包含 "/" 的模式从 ~/.claude 开始匹配,
+// 否则匹配任意层级的名称; "*" 和 "?" 不跨越 "/", "**" 匹配任意层级
+func globToRegexp(glob string) string {
+	anchored := strings.Contains(glob, "/")
+	glob = strings.TrimPrefix(glob, "/")
+
+	var b strings.Builder
+	if anchored {
+		b.WriteString("^")
+	} else {
+		b.WriteString("(?:^|/)")
+	}
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			b.WriteString("(?:/.*)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// Excluded 本地相对路径是否不参与同步: 禁止同步的文件、同步根以外的路径以及被规则排除的路径;
+// isDir 为 true 时按目录匹配 (扫描时用于跳过整个目录)
+func (r *syncRules) Excluded(relPath string, isDir bool) bool {
+	p := filepath.ToSlash(relPath)
+	if base := path.Base(p); deniedFiles[base] || strings.HasPrefix(base, syncTempPrefix) {
+		return true
+	}
+	if r == nil {
+		return false
+	}
+	if !r.inRoots(p, isDir) {
+		return true
+	}
+	// 上级目录被排除时其下的路径都被排除, 不能再用 "!" 重新包含
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && r.excludes(p[:i], true) {
+			return true
+		}
+	}
+	return r.excludes(p, isDir)
+}
+
+// inRoots 路径是否位于某个同步根下; 同步根的上级目录也算在内, 扫描时需要进入
+func (r *syncRules) inRoots(p string, isDir bool) bool {
+	if len(r.roots) == 0 {
+		return true
+	}
+	for _, root := range r.roots {
+		if p == root || strings.HasPrefix(p, root+"/") || isDir && strings.HasPrefix(root, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// key 同步范围的摘要, 用于判断范围是否改变
+func (r *syncRules) key() string {
+	var b strings.Builder
+	b.WriteString(strings.Join(r.roots, "\x00"))
+	for _, rule := range r.rules {
+		b.WriteString("\x01" + rule.pattern)
+	}
+	return b.String()
+}
+
+// excludes 依次应用规则, 最后一条匹配的规则决定 p 本身是否被排除
+func (r *syncRules) excludes(p string, isDir bool) bool {
+	excluded := false
+	for _, rule := range r.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(p) {
+			excluded = !rule.negate
+		}
+	}
+	return excluded
+}
+
+// Project ~/.claude/projects 下的一个项目目录
+type Project struct {
+	Name     string `json:"name"`
+	Files    int    `json:"files"`
+	Size     int64  `json:"size"`
+	Excluded bool   `json:"excluded"` // 整个项目不同步
+}
+
+// loadRules 根据配置编译同步规则, 规则无效时不排除任何文件, 同步根无效时使用默认值。
+// 同步范围改变后通知 run 重新建立文件监听
+func (s *SyncService) loadRules() {
+	rules, err := compileSyncRules(s.config.SyncRules, s.config.ExcludedProjects)
+	if err != nil {
+		fmt.Printf("同步规则无效, 已忽略: %v\n", err)
+		rules, _ = compileSyncRules(nil, s.config.ExcludedProjects)
+	}
+	if rules.roots, err = cleanSyncRoots(s.config.SyncRoots); err != nil {
+		fmt.Printf("同步根无效, 使用默认值: %v\n", err)
+		rules.roots, _ = cleanSyncRoots(nil)
+	}
+
+	s.mu.Lock()
+	changed := s.rules != nil && s.rules.key() != rules.key()
+	s.rules = rules
+	s.mu.Unlock()
+	if changed {
+		select {
+		case s.scopeChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// SyncRoots 当前使用的同步根
+func (s *SyncService) SyncRoots() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string{}, s.rules.roots...)
+}
+
+// watchRoots 文件监听需要扫描的绝对路径 (轮询时只遍历同步根)
+func (s *SyncService) watchRoots() []string {
+	roots := s.SyncRoots()
+	for i, root := range roots {
+		roots[i] = filepath.Join(s.claudeDir, filepath.FromSlash(root))
+	}
+	return roots
+}
+
+// watchSkip 文件监听是否忽略绝对路径 p: 同步根以外、禁止同步和被规则排除的路径都不监听,
+// 避免同步工具自己写入的日志和状态文件触发同步。同步范围改变时重新建立监听
+func (s *SyncService) watchSkip(p string, isDir bool) bool {
+	rel, err := filepath.Rel(s.claudeDir, p)
+	if err != nil || rel == "." {
+		return false
+	}
+	return s.excluded(rel, isDir)
+}
+
+// excluded 本地相对路径是否不参与同步
+func (s *SyncService) excluded(relPath string, isDir bool) bool {
+	s.mu.RLock()
+	rules := s.rules
+	s.mu.RUnlock()
+	return rules.Excluded(relPath, isDir)
+}
+
+// includedFiles 过滤掉服务器发来的、被规则排除的文件, 避免在本地重新创建; 因包含敏感信息而不上传的
+// 本地文件也跳过, 不被其他机器的版本覆盖
+func (s *SyncService) includedFiles(files []FileInfo) []FileInfo {
+	var included []FileInfo
+	for _, f := range files {
+		if localPath := s.localPath(f.Path); localPath != "" && !s.excluded(localPath, false) && !s.uploadBlocked(localPath) {
+			included = append(included, f)
+		}
+	}
+	return included
+}
+
+// Projects 列出本地的项目目录及其同步状态
+func (s *SyncService) Projects() ([]Project, error) {
+	projectsDir := filepath.Join(s.claudeDir, "projects")
+	entries, err := os.ReadDir(projectsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	excluded := make(map[string]bool)
+	for _, name := range s.config.ExcludedProjects {
+		excluded[name] = true
+	}
+
+	projects := []Project{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		p := Project{Name: e.Name(), Excluded: excluded[e.Name()]}
+		filepath.Walk(filepath.Join(projectsDir, e.Name()), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				p.Files++
+				p.Size += info.Size()
+			}
+			return nil
+		})
+		projects = append(projects, p)
+	}
+	sort.Slice(projects, func(i, j int) bool { return projects[i].Name < projects[j].Name })
+	return projects, nil
+}
@@ -0,0 +1,44 @@
+package service
+
+import "testing"
+
+func TestDefaultSyncRoots(t *testing.T) {
+	rules, err := compileSyncRules(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules.roots, err = cleanSyncRoots(nil); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{
+		"projects/p/s.jsonl":     false,
+		"commands/review.md":     false,
+		"CLAUDE.md":              false,
+		"settings.json":          false,
+		".credentials.json":      true,
+		"todos/t.json":           true,
+		"projects/p/sync.log":    true,
+		"skills/x/SKILL.md":      false,
+		"agents/sync-state.json": true,
+	} {
+		if got := rules.Excluded(path, false); got != want {
+			t.Errorf("Excluded(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestSyncRootsNeverIncludeCredentials(t *testing.T) {
+	rules, _ := compileSyncRules(nil, nil)
+	var err error
+	if rules.roots, err = cleanSyncRoots([]string{"projects"}); err != nil {
+		t.Fatal(err)
+	}
+	if !rules.Excluded("settings.json", false) {
+		t.Error("settings.json should not sync when roots are set explicitly without it")
+	}
+	for _, roots := range [][]string{{".credentials.json"}, {"../outside"}, {"/abs"}} {
+		if err := ValidateSyncRoots(roots); err == nil {
+			t.Errorf("ValidateSyncRoots(%v) should fail", roots)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// 凭据的访问权限
+const (
+	AccessRead  = "read"  // 只能下载, 例如只读镜像
+	AccessWrite = "write" // 只能上传, 例如只做备份的机器
+)
+
+// Scope 设备凭据的权限范围, 零值表示完全权限 (租户令牌始终是完全权限)
+type Scope struct {
+	Access string   `json:"access,omitempty"` // 为空时可读写
+	Paths  []string `json:"paths,omitempty"`  // 允许访问的路径前缀 (使用 "/" 分隔), 为空时不限制
+}
+
+// IsFull 是否为完全权限
+func (sc Scope) IsFull() bool {
+	return sc.Access == "" && len(sc.Paths) == 0
+}
+
+// CanRead 是否可以下载文件
+func (sc Scope) CanRead() bool {
+	return sc.Access != AccessWrite
+}
+
+// CanWrite 是否可以上传和删除文件
+func (sc Scope) CanWrite() bool {
+	return sc.Access != AccessRead
+}
+
+// Allows 路径是否在允许的前缀内, 前缀按路径段匹配 ("projects/a" 不包含 "projects/ab");
+// 受限时不规范的路径 (如 "projects/a/../b") 一律不允许
+func (sc Scope) Allows(p string) bool {
+	if len(sc.Paths) == 0 {
+		return true
+	}
+	p = filepath.ToSlash(p)
+	if !isValidSyncPath(p) {
+		return false
+	}
+	for _, prefix := range sc.Paths {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// String 权限范围的说明, 用于日志和管理界面
+func (sc Scope) String() string {
+	access := "读写"
+	switch sc.Access {
+	case AccessRead:
+		access = "只读"
+	case AccessWrite:
+		access = "只写"
+	}
+	if len(sc.Paths) == 0 {
+		return access
+	}
+	return access + " " + strings.Join(sc.Paths, ", ")
+}
+
+// normalize 检查访问权限并规范化路径前缀
+func (sc Scope) normalize() (Scope, error) {
+	switch sc.Access {
+	case "", AccessRead, AccessWrite:
+	default:
+		return sc, fmt.Errorf("invalid access %q", sc.Access)
+	}
+
+	var paths []string
+	for _, p := range sc.Paths {
+		p = strings.Trim(filepath.ToSlash(strings.TrimSpace(p)), "/")
+		if p == "" {
+			continue
+		}
+		p = path.Clean(p)
+		if p == ".." || strings.HasPrefix(p, "../") {
+			return sc, fmt.Errorf("invalid path prefix %q", p)
+		}
+		paths = append(paths, p)
+	}
+	sc.Paths = paths
+	return sc, nil
+}
+
+// within 权限范围是否没有超出 parent, 用于限制受限凭据生成的配对码
+func (sc Scope) within(parent Scope) bool {
+	if parent.Access != "" && sc.Access != parent.Access {
+		return false
+	}
+	if len(parent.Paths) == 0 {
+		return true
+	}
+	if len(sc.Paths) == 0 {
+		return false
+	}
+	for _, p := range sc.Paths {
+		if !parent.Allows(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestScope 获取请求凭据的权限范围, 使用租户令牌时为完全权限
+func requestScope(r *http.Request) Scope {
+	if d := requestDevice(r); d != nil {
+		return d.Scope
+	}
+	return Scope{}
+}
+
+// resolveScope 确定新凭据的权限范围: 未指定时继承 parent, 指定时不能超出 parent
+func resolveScope(requested, parent Scope) (Scope, error) {
+	if requested.IsFull() {
+		return parent, nil
+	}
+	scope, err := requested.normalize()
+	if err != nil {
+		return scope, err
+	}
+	if !scope.within(parent) {
+		return scope, fmt.Errorf("scope exceeds credential scope")
+	}
+	return scope, nil
+}
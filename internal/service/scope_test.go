@@ -0,0 +1,117 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsValidSyncPath(t *testing.T) {
+	for path, want := range map[string]bool{
+		"projects/a/s.jsonl":      true,
+		"CLAUDE.md":               true,
+		"projects/a/../b/x.jsonl": false,
+		"projects/./a/s.jsonl":    false,
+		"projects//a/s.jsonl":     false,
+		"projects/a/":             false,
+		`projects\a\s.jsonl`:      false,
+		"../secret":               false,
+		"/etc/passwd":             false,
+		"C:/Users/x":              false,
+		"":                        false,
+	} {
+		if got := isValidSyncPath(path); got != want {
+			t.Errorf("isValidSyncPath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestScopeAllows(t *testing.T) {
+	sc, err := Scope{Paths: []string{"projects/a/", " commands "}}.normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{
+		"projects/a":              true,
+		"projects/a/s.jsonl":      true,
+		"commands/x.md":           true,
+		"projects/ab/s.jsonl":     false,
+		"projects/b/s.jsonl":      false,
+		"projects/a/../b/x.jsonl": false,
+		"projects/a/./s.jsonl":    false,
+		"projects/a//s.jsonl":     false,
+		`projects/a\..\b\x.jsonl`: false,
+		"projects/a/..":           false,
+	} {
+		if got := sc.Allows(path); got != want {
+			t.Errorf("Allows(%q) = %v, want %v", path, got, want)
+		}
+	}
+
+	if !(Scope{}).Allows("anything/goes") {
+		t.Error("full scope should allow every path")
+	}
+}
+
+func TestScopeNormalizeRejectsEscape(t *testing.T) {
+	for _, p := range []string{"..", "../x", "projects/../../x"} {
+		if _, err := (Scope{Paths: []string{p}}).normalize(); err == nil {
+			t.Errorf("normalize(%q) should fail", p)
+		}
+	}
+	sc, err := Scope{Paths: []string{"projects/a/../b"}}.normalize()
+	if err != nil || len(sc.Paths) != 1 || sc.Paths[0] != "projects/b" {
+		t.Errorf("normalize = %v, %v", sc.Paths, err)
+	}
+}
+
+func TestScopeWithin(t *testing.T) {
+	parent := Scope{Access: AccessRead, Paths: []string{"projects/a"}}
+	for _, tc := range []struct {
+		sc   Scope
+		want bool
+	}{
+		{Scope{Access: AccessRead, Paths: []string{"projects/a/x"}}, true},
+		{Scope{Access: AccessRead, Paths: []string{"projects/b"}}, false},
+		{Scope{Access: AccessRead}, false},
+		{Scope{Paths: []string{"projects/a"}}, false},
+	} {
+		if got := tc.sc.within(parent); got != tc.want {
+			t.Errorf("%v within %v = %v, want %v", tc.sc, parent, got, tc.want)
+		}
+	}
+}
+
+func TestScopedUploadRejectsTraversal(t *testing.T) {
+	s, err := NewServer(0, t.TempDir(), "tenant-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tenant := s.tenants["default"]
+	token, err := s.EnrollDevice(tenant, "m1", "laptop", "", Scope{Paths: []string{"projects/a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []FileInfo
+	for _, p := range []string{"projects/a/../b/x.jsonl", "projects/a/s.jsonl"} {
+		files = append(files, FileInfo{Path: p, Hash: hashBytes([]byte(p)), Size: int64(len(p)), Content: []byte(p)})
+	}
+	body, _ := json.Marshal(UploadRequest{MachineID: "m1", Files: files})
+	req := httptest.NewRequest("POST", "/sync/upload", strings.NewReader(string(body)))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(machineIDHeader, "m1")
+	w := httptest.NewRecorder()
+	s.tenantAuth(s.handleSyncUpload)(w, req)
+
+	if _, ok := tenant.Files["projects/a/s.jsonl"]; !ok {
+		t.Errorf("allowed file not saved (status %d)", w.Code)
+	}
+	for path := range tenant.Files {
+		if strings.Contains(path, "..") || strings.HasPrefix(path, "projects/b") {
+			t.Errorf("traversal path saved: %s", path)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package service
 
 import (
+	"bytes"
+	"crypto/cipher"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -15,24 +19,64 @@ import (
 
 // Server 同步服务器 (多租户)
 type Server struct {
-	dataDir  string
-	port     int
-	mu       sync.RWMutex
-	tenants  map[string]*Tenant // token -> Tenant
-	configPath string
+	store   Storage
+	meta    *metaStore
+	config  ServerConfig
+	port    int
+	mu      sync.RWMutex
+	tenants map[string]*Tenant // ID -> Tenant
+
+	pairings        map[string]*pairingCode  // 配对码 -> 租户
+	pairingFailures map[string]*pairingLimit // 客户端地址 -> 时间窗口内错误配对码的次数
+	adminSessions   map[string]*adminSession // 管理界面会话 ID -> 会话
+
+	masterKey cipher.AEAD // 静态加密的主密钥, 为空时不加密新租户
+
+	tombstoneRetention time.Duration // 删除记录保留时间
+	keepVersions       int           // 每个文件至少保留的历史版本数
+	versionRetention   time.Duration // 历史版本保留时间
 }
 
+// DefaultTombstoneRetention 删除记录默认保留时间
+const DefaultTombstoneRetention = 30 * 24 * time.Hour
+
 // Tenant 租户
 type Tenant struct {
-	ID          string                 `json:"id"`
-	Name        string                 `json:"name"`
-	Token       string                 `json:"token"`
-	CreatedAt   time.Time              `json:"created_at"`
-	LastActive  time.Time              `json:"last_active"`
-	Files       map[string]FileInfo    `json:"-"` // 内存中的文件索引
-	Clients     map[string]*ClientInfo `json:"-"` // 连接的客户端
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	TokenHash  string    `json:"token_hash"` // 令牌的加盐哈希
+	CreatedAt  time.Time `json:"created_at"`
+	LastActive time.Time `json:"last_active"`
+
+	// 轮换令牌后旧令牌在宽限期内继续有效
+	PrevTokenHash      string    `json:"prev_token_hash,omitempty"`
+	PrevTokenExpiresAt time.Time `json:"prev_token_expires_at"`
+
+	// 端到端加密参数 (不含密钥), 为空时未启用
+	Encryption *EncryptionParams `json:"encryption,omitempty"`
+
+	// 服务器端静态加密的数据密钥 (用主密钥加密), 为空时文件内容以明文保存
+	DataKey string `json:"data_key,omitempty"`
+
+	Files      map[string]FileInfo      `json:"-"` // 内存中的文件索引
+	Clients    map[string]*ClientInfo   `json:"-"` // 连接的客户端
+	Tombstones map[string]*Tombstone    `json:"-"` // 已删除文件的记录
+	Versions   map[string][]FileVersion `json:"-"` // 历史版本 (按版本号从旧到新)
+	Devices    map[string]*Device       `json:"-"` // 设备凭据 (MachineID -> Device)
+
+	blobs *blobStore      // 文件内容存储
+	dirty map[string]bool // 有变更、尚未写入元数据库的路径
 }
 
+// 旧版存储键, 只在导入到元数据库时使用
+const (
+	configKey    = "config.json"   // 服务器配置
+	manifestName = "manifest.json" // 租户文件清单 (路径 -> 内容哈希)
+)
+
+// metaName 本地数据目录中的元数据库文件名
+const metaName = "meta.db"
+
 // ClientInfo 客户端信息
 type ClientInfo struct {
 	MachineID   string    `json:"machine_id"`
@@ -40,12 +84,16 @@ type ClientInfo struct {
 	LastSeen    time.Time `json:"last_seen"`
 	FileCount   int       `json:"file_count"`
 	IP          string    `json:"ip"`
+
+	// 设备凭据状态, 只在统计中返回
+	EnrolledAt *time.Time `json:"enrolled_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	Scope      *Scope     `json:"scope,omitempty"` // 受限凭据的权限范围
 }
 
-// ServerConfig 服务器配置
+// ServerConfig 服务器配置 (保存在元数据库中)
 type ServerConfig struct {
-	AdminToken string    `json:"admin_token"`
-	Tenants    []*Tenant `json:"tenants"`
+	AdminTokenHash string `json:"admin_token_hash,omitempty"` // 管理令牌的加盐哈希 (格式见 hashToken), 为空时禁用管理接口
 }
 
 // ServerStats 服务器统计
@@ -65,65 +113,167 @@ type TenantStats struct {
 	ClientCount int           `json:"client_count"`
 	Clients     []*ClientInfo `json:"clients"`
 	LastActive  time.Time     `json:"last_active"`
+
+	PrevTokenExpiresAt *time.Time `json:"prev_token_expires_at,omitempty"` // 轮换前的令牌有效期
 }
 
-// NewServer 创建服务器
-func NewServer(port int, dataDir, adminToken string) *Server {
+// NewServer 创建使用本地数据目录的服务器, 元数据库保存在同一目录下。
+// 没有租户时使用 defaultToken 创建默认租户
+func NewServer(port int, dataDir, defaultToken string) (*Server, error) {
+	return NewServerWithStorage(port, NewLocalStorage(dataDir), filepath.Join(dataDir, metaName), defaultToken)
+}
+
+// NewServerWithStorage 创建使用指定存储后端的服务器, 元数据库保存在本地 metaPath
+func NewServerWithStorage(port int, store Storage, metaPath, defaultToken string) (*Server, error) {
+	if err := checkMetaPath(store, metaPath); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0755); err != nil {
+		return nil, err
+	}
+	meta, err := openMetaStore(metaPath)
+	if err != nil {
+		return nil, err
+	}
+
 	s := &Server{
-		dataDir:    dataDir,
-		port:       port,
-		tenants:    make(map[string]*Tenant),
-		configPath: filepath.Join(dataDir, "config.json"),
+		store:              store,
+		meta:               meta,
+		port:               port,
+		tenants:            make(map[string]*Tenant),
+		pairings:           make(map[string]*pairingCode),
+		pairingFailures:    make(map[string]*pairingLimit),
+		adminSessions:      make(map[string]*adminSession),
+		tombstoneRetention: DefaultTombstoneRetention,
+		keepVersions:       DefaultKeepVersions,
+		versionRetention:   DefaultVersionRetention,
 	}
 
 	// 加载或创建配置
-	s.loadConfig(adminToken)
+	if err := s.loadConfig(defaultToken); err != nil {
+		meta.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
 
-	return s
+// checkMetaPath 元数据库不存在时确认存储中还没有租户数据。元数据库放在临时磁盘上时 (例如使用
+// 对象存储的容器重启后), 新建的空元数据库会丢失所有文件索引, 已有的内容也会被当作无引用的内容清理掉
+func checkMetaPath(store Storage, metaPath string) error {
+	if _, err := os.Stat(metaPath); !os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := store.Get(configKey); err == nil {
+		// 旧版数据, 启动时导入元数据库
+		return nil
+	}
+	keys, err := store.List("tenants/")
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return fmt.Errorf("元数据库 %s 不存在, 但存储中已有 %d 个租户数据对象; 请确认 -meta 指向持久化磁盘上的元数据库, 或先恢复元数据库的备份", metaPath, len(keys))
+	}
+	return nil
 }
 
-// loadConfig 加载配置
-func (s *Server) loadConfig(adminToken string) {
-	// 确保数据目录存在
-	os.MkdirAll(s.dataDir, 0755)
+// Close 关闭元数据库
+func (s *Server) Close() error {
+	return s.meta.Close()
+}
 
-	data, err := os.ReadFile(s.configPath)
-	if err == nil {
-		var config ServerConfig
-		if json.Unmarshal(data, &config) == nil {
-			for _, t := range config.Tenants {
-				t.Files = make(map[string]FileInfo)
-				t.Clients = make(map[string]*ClientInfo)
-				s.tenants[t.Token] = t
-				// 加载租户数据
-				s.loadTenantData(t)
-			}
+// SetAdminToken 设置管理令牌 (只保存哈希); 管理令牌与租户令牌相互独立
+func (s *Server) SetAdminToken(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if verifyToken(token, s.config.AdminTokenHash) {
+		return nil
+	}
+	now := time.Now()
+	for _, t := range s.tenants {
+		if t.matchToken(token, now) {
+			return fmt.Errorf("admin token must differ from tenant tokens")
 		}
 	}
-
-	// 如果提供了 adminToken 且没有租户，创建默认租户
-	if adminToken != "" && len(s.tenants) == 0 {
-		s.CreateTenant("default", "Default User", adminToken)
+	config := s.config
+	config.AdminTokenHash = hashToken(token)
+	if err := s.meta.saveConfig(config); err != nil {
+		return err
 	}
+	s.config = config
+	// 更换管理令牌后已登录的管理界面需要重新登录
+	s.adminSessions = make(map[string]*adminSession)
+	return nil
 }
 
-// saveConfig 保存配置 (调用者需要持有锁或不持有锁)
-func (s *Server) saveConfig() error {
-	tenants := make([]*Tenant, 0, len(s.tenants))
-	for _, t := range s.tenants {
-		tenants = append(tenants, t)
+// SetTombstoneRetention 设置删除记录保留时间; 超过该时间仍未同步的客户端可能会让已删除的文件重新出现
+func (s *Server) SetTombstoneRetention(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tombstoneRetention = d
+}
+
+// loadConfig 从元数据库加载租户 (首次启动时先导入旧版配置), 并统计内容引用
+func (s *Server) loadConfig(defaultToken string) error {
+	if err := s.importLegacyConfig(); err != nil {
+		return fmt.Errorf("导入旧版配置失败: %v", err)
 	}
 
-	config := ServerConfig{
-		Tenants: tenants,
+	config, err := s.meta.loadConfig()
+	if err != nil {
+		return fmt.Errorf("读取元数据库失败: %v", err)
 	}
+	s.config = config
 
-	data, err := json.MarshalIndent(config, "", "  ")
+	tenants, err := s.meta.loadTenants()
 	if err != nil {
+		return fmt.Errorf("读取元数据库失败: %v", err)
+	}
+	for _, t := range tenants {
+		t.blobs = newBlobStore(s.store, s.tenantPrefix(t))
+		for _, f := range t.Files {
+			t.blobs.Ref(f.Hash)
+		}
+		for _, versions := range t.Versions {
+			for _, v := range versions {
+				if !v.Prefix && !v.Deleted {
+					t.blobs.Ref(v.Hash)
+				}
+			}
+		}
+		s.tenants[t.ID] = t
+	}
+
+	// 如果提供了 defaultToken 且没有租户，创建默认租户
+	if defaultToken != "" && len(s.tenants) == 0 {
+		if _, err := s.CreateTenant("default", "Default User", defaultToken); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveTenant 将租户信息、客户端和有变更的文件记录写入元数据库 (调用者需要持有锁)
+func (s *Server) saveTenant(tenant *Tenant) error {
+	paths := make([]string, 0, len(tenant.dirty))
+	for path := range tenant.dirty {
+		paths = append(paths, path)
+	}
+	if err := s.meta.saveTenant(tenant, paths); err != nil {
+		fmt.Printf("[%s] [%s] 保存元数据失败: %v\n", time.Now().Format("15:04:05"), tenant.Name, err)
 		return err
 	}
+	tenant.dirty = nil
+	return nil
+}
 
-	return os.WriteFile(s.configPath, data, 0600)
+// markDirty 记录路径有变更, 在下次 saveTenant 时写入元数据库
+func (t *Tenant) markDirty(path string) {
+	if t.dirty == nil {
+		t.dirty = make(map[string]bool)
+	}
+	t.dirty[path] = true
 }
 
 // CreateTenant 创建租户
@@ -131,33 +281,39 @@ func (s *Server) CreateTenant(id, name, token string) (*Tenant, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// 检查 token 是否已存在
-	if _, exists := s.tenants[token]; exists {
+	// 检查 token 是否已存在 (包括管理令牌)
+	if s.tokenInUse(token) {
 		return nil, fmt.Errorf("token already exists")
 	}
 
 	// 检查 ID 是否已存在
-	for _, t := range s.tenants {
-		if t.ID == id {
-			return nil, fmt.Errorf("tenant ID already exists")
-		}
+	if _, exists := s.tenants[id]; exists {
+		return nil, fmt.Errorf("tenant ID already exists")
 	}
 
 	tenant := &Tenant{
-		ID:        id,
-		Name:      name,
-		Token:     token,
-		CreatedAt: time.Now(),
-		Files:     make(map[string]FileInfo),
-		Clients:   make(map[string]*ClientInfo),
+		ID:         id,
+		Name:       name,
+		TokenHash:  hashToken(token),
+		CreatedAt:  time.Now(),
+		Files:      make(map[string]FileInfo),
+		Clients:    make(map[string]*ClientInfo),
+		Tombstones: make(map[string]*Tombstone),
+		Versions:   make(map[string][]FileVersion),
+		Devices:    make(map[string]*Device),
 	}
 
-	// 创建租户数据目录
-	tenantDir := filepath.Join(s.dataDir, "tenants", id)
-	os.MkdirAll(tenantDir, 0755)
+	tenant.blobs = newBlobStore(s.store, s.tenantPrefix(tenant))
+	if s.masterKey != nil {
+		if err := s.newDataKey(s.masterKey, tenant); err != nil {
+			return nil, err
+		}
+	}
 
-	s.tenants[token] = tenant
-	s.saveConfig()
+	if err := s.meta.saveTenant(tenant, nil); err != nil {
+		return nil, err
+	}
+	s.tenants[id] = tenant
 
 	fmt.Printf("[%s] 创建租户: %s (%s)\n", time.Now().Format("15:04:05"), name, id)
 
@@ -169,93 +325,255 @@ func (s *Server) DeleteTenant(id string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	var tokenToDelete string
-	for token, t := range s.tenants {
-		if t.ID == id {
-			tokenToDelete = token
-			break
-		}
-	}
-
-	if tokenToDelete == "" {
+	if _, exists := s.tenants[id]; !exists {
 		return fmt.Errorf("tenant not found")
 	}
 
-	delete(s.tenants, tokenToDelete)
-
-	// 删除数据目录
-	tenantDir := filepath.Join(s.dataDir, "tenants", id)
-	os.RemoveAll(tenantDir)
+	if err := s.meta.deleteTenant(id); err != nil {
+		return err
+	}
+	delete(s.tenants, id)
 
-	s.saveConfig()
+	// 删除租户数据 (包括旧版的历史版本目录)
+	deletePrefix(s.store, "tenants/"+id+"/")
+	deletePrefix(s.store, "versions/"+id+"/")
 
 	return nil
 }
 
-// getTenantByToken 根据 token 获取租户
-func (s *Server) getTenantByToken(token string) *Tenant {
+// getTenantByToken 根据租户令牌或设备凭据获取租户 (逐个以恒定时间比较哈希); 使用设备凭据时同时返回设备
+func (s *Server) getTenantByToken(token string) (*Tenant, *Device) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.tenants[token]
+	now := time.Now()
+	for _, t := range s.tenants {
+		if t.matchToken(token, now) {
+			return t, nil
+		}
+	}
+	for _, t := range s.tenants {
+		if d := t.findDevice(token); d != nil {
+			return t, d
+		}
+	}
+	return nil, nil
+}
+
+// tenantPrefix 获取租户数据的存储键前缀
+func (s *Server) tenantPrefix(tenant *Tenant) string {
+	return "tenants/" + tenant.ID + "/"
 }
 
-// getTenantDataDir 获取租户数据目录
-func (s *Server) getTenantDataDir(tenant *Tenant) string {
-	return filepath.Join(s.dataDir, "tenants", tenant.ID)
+// legacyTenant 旧版 config.json 中的租户, 令牌明文保存, 删除记录和租户信息保存在一起
+type legacyTenant struct {
+	Tenant
+	Token      string                `json:"token"`
+	Tombstones map[string]*Tombstone `json:"tombstones"`
 }
 
-// loadTenantData 加载租户数据
-func (s *Server) loadTenantData(tenant *Tenant) {
-	tenantDir := s.getTenantDataDir(tenant)
+// importLegacyConfig 将旧版 config.json、文件清单和历史版本索引导入元数据库, 导入后删除旧文件。
+// 每个租户在一个事务中导入, 中途失败时下次启动会重新导入
+func (s *Server) importLegacyConfig() error {
+	data, err := s.store.Get(configKey)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var config struct {
+		Tenants []*legacyTenant `json:"tenants"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+
+	for _, lt := range config.Tenants {
+		t := &lt.Tenant
+		t.TokenHash = hashToken(lt.Token)
+		t.Files = make(map[string]FileInfo)
+		t.Clients = make(map[string]*ClientInfo)
+		t.Tombstones = lt.Tombstones
+		if t.Tombstones == nil {
+			t.Tombstones = make(map[string]*Tombstone)
+		}
+		t.Versions = make(map[string][]FileVersion)
+		t.Devices = make(map[string]*Device)
+		t.blobs = newBlobStore(s.store, s.tenantPrefix(t))
+
+		if err := s.importTenantFiles(t); err != nil {
+			return err
+		}
+		if err := s.importLegacyVersions(t); err != nil {
+			return err
+		}
 
-	filepath.Walk(tenantDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
+		for path := range t.Files {
+			t.markDirty(path)
+		}
+		for path := range t.Tombstones {
+			t.markDirty(path)
+		}
+		for path := range t.Versions {
+			t.markDirty(path)
 		}
+		if err := s.saveTenant(t); err != nil {
+			return err
+		}
+		s.cleanupLegacyTenant(t)
+
+		fmt.Printf("[%s] [%s] 已导入 %d 个文件到元数据库\n",
+			time.Now().Format("15:04:05"), t.Name, len(t.Files))
+	}
 
-		relPath, _ := filepath.Rel(tenantDir, path)
-		data, err := os.ReadFile(path)
+	// 旧版本的 Windows 客户端上传的路径使用反斜杠分隔
+	if err := s.meta.canonicalizePaths(); err != nil {
+		return err
+	}
+	return s.store.Delete(configKey)
+}
+
+// importTenantFiles 读取旧版文件清单; 没有清单时将更早按路径存放的文件迁移到内容存储
+func (s *Server) importTenantFiles(tenant *Tenant) error {
+	prefix := s.tenantPrefix(tenant)
+	data, err := s.store.Get(prefix + manifestName)
+	if err == nil {
+		return json.Unmarshal(data, &tenant.Files)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	keys, err := s.store.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, tenant.blobs.prefix) || strings.HasPrefix(key, tenant.blobs.sealedPrefix) {
+			continue
+		}
+		data, err := s.store.Get(key)
 		if err != nil {
-			return nil
+			continue
+		}
+
+		// 旧版用文件修改时间作为版本号
+		modTime := time.Now()
+		if l, ok := s.store.(*LocalStorage); ok {
+			if info, err := os.Stat(l.path(key)); err == nil {
+				modTime = info.ModTime()
+			}
+		}
+
+		hash := hashBytes(data)
+		if err := tenant.blobs.Import(hash, key); err != nil {
+			continue
 		}
 
-		hash := sha256.Sum256(data)
+		relPath := strings.TrimPrefix(key, prefix)
 		tenant.Files[relPath] = FileInfo{
 			Path:    relPath,
-			Hash:    hex.EncodeToString(hash[:]),
-			ModTime: info.ModTime().Unix(),
-			Size:    info.Size(),
+			Hash:    hash,
+			ModTime: modTime.Unix(),
+			Size:    int64(len(data)),
+			Rev:     modTime.UnixNano(),
 		}
-		return nil
-	})
+	}
+	return nil
+}
+
+// cleanupLegacyTenant 删除已导入元数据库的旧版文件清单和历史版本索引
+func (s *Server) cleanupLegacyTenant(tenant *Tenant) {
+	s.store.Delete(s.tenantPrefix(tenant) + manifestName)
+	for path := range tenant.Versions {
+		s.store.Delete(s.versionPrefix(tenant, path) + versionIndexName)
+	}
+}
+
+// sweepBlobs 清理所有租户中没有引用的内容 (例如写入后服务器异常退出留下的)。
+// 列出内容时不持有锁, 避免对象存储较慢时阻塞同步请求
+func (s *Server) sweepBlobs() {
+	s.mu.RLock()
+	tenants := make([]*Tenant, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		tenants = append(tenants, t)
+	}
+	s.mu.RUnlock()
+
+	for _, t := range tenants {
+		keys, err := t.blobs.List()
+		if err != nil {
+			continue
+		}
+		s.mu.Lock()
+		n := t.blobs.Sweep(keys)
+		s.mu.Unlock()
+		if n > 0 {
+			fmt.Printf("[%s] [%s] 清理 %d 个无引用的内容\n", time.Now().Format("15:04:05"), t.Name, n)
+		}
+	}
 }
 
 // Start 启动服务器
 func (s *Server) Start() error {
+	if err := s.checkDataKeys(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Claude Sync 服务器启动 (多租户模式)\n")
+	fmt.Printf("监听端口: %d\n", s.port)
+	fmt.Printf("数据存储: %v\n", s.store)
+	if s.masterKey != nil {
+		fmt.Printf("静态加密: 已启用\n")
+	}
+	fmt.Printf("租户数量: %d\n", len(s.tenants))
+	if s.config.AdminTokenHash == "" {
+		fmt.Printf("管理界面: 未设置管理令牌 (-admin-token), 已禁用\n")
+	} else {
+		fmt.Printf("管理界面: http://localhost:%d/admin\n", s.port)
+	}
+	fmt.Println("等待客户端连接...")
+
+	go func() {
+		s.sweepBlobs()
+		s.sealBlobs()
+	}()
+
+	return http.ListenAndServe(fmt.Sprintf(":%d", s.port), s.handler())
+}
+
+// handler 注册所有接口
+func (s *Server) handler() http.Handler {
 	mux := http.NewServeMux()
 
 	// 公开接口
 	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/devices/pair", s.handleDevicePair) // 使用配对码注册设备
 
 	// 租户接口 (需要租户 token)
 	mux.HandleFunc("/sync", s.tenantAuth(s.handleSync))
+	mux.HandleFunc("/sync/upload", s.tenantAuth(s.handleSyncUpload))
+	mux.HandleFunc("/sync/download", s.tenantAuth(s.handleSyncDownload))
 	mux.HandleFunc("/stats", s.tenantAuth(s.handleTenantStats))
+	mux.HandleFunc("/versions", s.tenantAuth(s.handleVersions))
+	mux.HandleFunc("/versions/restore", s.tenantAuth(s.handleVersionRestore))
+	mux.HandleFunc("/devices/enroll", s.tenantAuth(s.handleDeviceEnroll))
+	mux.HandleFunc("/devices/revoke", s.tenantAuth(s.handleDeviceRevoke))
+	mux.HandleFunc("/devices/pairing-code", s.tenantAuth(s.handlePairingCode))
+	mux.HandleFunc("/encryption", s.tenantAuth(s.handleEncryption))
 
 	// 管理接口 (需要 admin token)
-	mux.HandleFunc("/admin/tenants", s.handleAdminTenants)
-	mux.HandleFunc("/admin/stats", s.handleAdminStats)
+	mux.HandleFunc("/admin/tenants", s.adminAuth(s.handleAdminTenants))
+	mux.HandleFunc("/admin/stats", s.adminAuth(s.handleAdminStats))
+	mux.HandleFunc("/admin/rollback", s.adminAuth(s.handleAdminRollback))
+	mux.HandleFunc("/admin/tenants/rotate", s.adminAuth(s.handleAdminRotateToken))
+	mux.HandleFunc("/admin/devices/revoke", s.adminAuth(s.handleAdminDeviceRevoke))
+	mux.HandleFunc("/admin/devices/pairing-code", s.adminAuth(s.handleAdminPairingCode))
 
 	// 管理界面
 	s.registerAdminUI(mux)
-
-	fmt.Printf("Claude Sync 服务器启动 (多租户模式)\n")
-	fmt.Printf("监听端口: %d\n", s.port)
-	fmt.Printf("数据目录: %s\n", s.dataDir)
-	fmt.Printf("租户数量: %d\n", len(s.tenants))
-	fmt.Printf("管理界面: http://localhost:%d/admin\n", s.port)
-	fmt.Println("等待客户端连接...")
-
-	return http.ListenAndServe(fmt.Sprintf(":%d", s.port), mux)
+	return mux
 }
 
 // tenantAuth 租户认证中间件
@@ -268,11 +586,26 @@ func (s *Server) tenantAuth(next func(http.ResponseWriter, *http.Request, *Tenan
 		}
 
 		token := strings.TrimPrefix(auth, "Bearer ")
-		tenant := s.getTenantByToken(token)
+		tenant, device := s.getTenantByToken(token)
 		if tenant == nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
+		if device != nil {
+			s.mu.RLock()
+			revoked := device.Revoked()
+			s.mu.RUnlock()
+			if revoked {
+				http.Error(w, "Device revoked", http.StatusUnauthorized)
+				return
+			}
+			// 设备凭据只能用于签发时绑定的机器
+			if r.Header.Get(machineIDHeader) != device.MachineID {
+				http.Error(w, "Device credential does not match machine", http.StatusForbidden)
+				return
+			}
+			r = withDevice(r, device)
+		}
 
 		// 更新最后活跃时间
 		s.mu.Lock()
@@ -283,6 +616,43 @@ func (s *Server) tenantAuth(next func(http.ResponseWriter, *http.Request, *Tenan
 	}
 }
 
+// adminAuth 管理认证中间件, 管理令牌只能通过 Authorization: Bearer 传递
+// (URL 中的令牌会出现在访问日志、浏览器历史和代理记录中)
+func (s *Server) adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if token == "" {
+			http.Error(w, "Admin token required", http.StatusUnauthorized)
+			return
+		}
+		if !s.validateAdminToken(token) {
+			http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientIP 获取客户端地址, 经过反向代理时使用 X-Forwarded-For
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return forwarded
+	}
+	return r.RemoteAddr
+}
+
+// remoteHost 获取连接的对端地址 (不含端口); 与 clientIP 不同, 不使用可以伪造的 X-Forwarded-For
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -293,6 +663,7 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// handleSync 处理文件清单 (第一阶段), 返回需要上传和将要下发的文件
 func (s *Server) handleSync(w http.ResponseWriter, r *http.Request, tenant *Tenant) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -305,15 +676,37 @@ func (s *Server) handleSync(w http.ResponseWriter, r *http.Request, tenant *Tena
 		return
 	}
 
-	clientIP := r.RemoteAddr
-	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-		clientIP = forwarded
+	if !deviceMatches(r, req.MachineID) {
+		http.Error(w, "Device credential does not match machine", http.StatusForbidden)
+		return
 	}
 
+	// 路径统一为规范形式并忽略无效的路径; 受限凭据只处理允许的路径, 只读凭据不能删除,
+	// 只写凭据不接收服务器的文件
+	scope := requestScope(r)
+	files := req.Files[:0]
+	for _, f := range req.Files {
+		if f.Path = syncPath(f.Path); f.Path != "" && scope.Allows(f.Path) {
+			files = append(files, f)
+		}
+	}
+	req.Files = files
+	deletedPaths := req.Deleted[:0]
+	for _, t := range req.Deleted {
+		if t.Path = syncPath(t.Path); t.Path != "" && scope.Allows(t.Path) {
+			deletedPaths = append(deletedPaths, t)
+		}
+	}
+	req.Deleted = deletedPaths
+	if !scope.CanWrite() {
+		req.Deleted = nil
+	}
+
+	ip := clientIP(r)
 	fmt.Printf("[%s] [%s] 同步请求: %s (%s) @ %s, 文件数: %d\n",
 		time.Now().Format("15:04:05"),
 		tenant.Name,
-		req.MachineName, req.MachineID, clientIP, len(req.Files))
+		req.MachineName, req.MachineID, ip, len(req.Files))
 
 	s.mu.Lock()
 
@@ -326,33 +719,61 @@ func (s *Server) handleSync(w http.ResponseWriter, r *http.Request, tenant *Tena
 		MachineName: req.MachineName,
 		LastSeen:    time.Now(),
 		FileCount:   len(req.Files),
-		IP:          clientIP,
+		IP:          ip,
 	}
 
-	tenantDir := s.getTenantDataDir(tenant)
-	var filesToSend []FileInfo
+	need := []string{}
+	filesToSend := []FileInfo{}
+	synced := []FileInfo{}
+	deleted := []Tombstone{}
+	conflicts := []FileInfo{}
+	prefixChecks := []FileInfo{} // 需要在锁外读取内容判断的会话记录, 与 req.Files 中的同名文件对应
+
+	// 处理客户端的删除记录: 只有服务器版本仍是客户端删除的那个版本时才删除
+	s.gcTombstones(tenant)
+	for _, t := range req.Deleted {
+		existing, exists := tenant.Files[t.Path]
+		if !exists || existing.Hash != t.Hash {
+			continue
+		}
+		s.removeTenantFile(tenant, t.Path, req.MachineID)
+	}
+	s.saveTenant(tenant)
 
-	// 处理客户端发来的文件
+	// 对比客户端清单
 	for _, f := range req.Files {
 		existing, exists := tenant.Files[f.Path]
-
-		if len(f.Content) > 0 {
-			if !exists || f.ModTime > existing.ModTime {
-				tenant.Files[f.Path] = f
-				s.saveTenantFile(tenant, f)
+		switch {
+		case !exists:
+			// 已在其他机器删除且客户端没有修改过的文件, 通知客户端删除
+			// (客户端持有的可能是较旧的版本, 例如文件被恢复后又删除)
+			t, ok := tenant.Tombstones[f.Path]
+			switch {
+			case ok && t.Hash == f.Hash:
+				deleted = append(deleted, *t)
+			case ok && f.BaseRev != 0 && f.BaseHash == f.Hash:
+				stale := *t
+				stale.Hash = f.Hash
+				deleted = append(deleted, stale)
+			default:
+				need = append(need, f.Path)
 			}
-		}
-
-		if exists && existing.Hash != f.Hash && existing.ModTime > f.ModTime {
-			content, err := os.ReadFile(filepath.Join(tenantDir, existing.Path))
-			if err == nil {
-				filesToSend = append(filesToSend, FileInfo{
-					Path:    existing.Path,
-					Hash:    existing.Hash,
-					ModTime: existing.ModTime,
-					Content: content,
-				})
+		case existing.Hash == f.Hash:
+			if f.BaseRev != existing.Rev {
+				synced = append(synced, existing)
 			}
+		case f.BaseRev == existing.Rev:
+			// 客户端基于服务器当前版本做了修改
+			need = append(need, f.Path)
+		case f.BaseRev != 0 && f.BaseHash == f.Hash:
+			// 客户端没有修改, 服务器版本已更新
+			filesToSend = append(filesToSend, existing)
+		case isMergeable(f.Path):
+			// 会话记录两边都有修改: 客户端是服务器版本的前缀时直接下发, 否则上传后按行合并
+			prefixChecks = append(prefixChecks, existing)
+		default:
+			// 两边都有修改且无法合并
+			conflicts = append(conflicts, existing)
 		}
 	}
 
@@ -363,42 +784,436 @@ func (s *Server) handleSync(w http.ResponseWriter, r *http.Request, tenant *Tena
 	}
 
 	for path, f := range tenant.Files {
-		if !clientFiles[path] {
-			content, err := os.ReadFile(filepath.Join(tenantDir, path))
-			if err == nil {
-				filesToSend = append(filesToSend, FileInfo{
-					Path:    f.Path,
-					Hash:    f.Hash,
-					ModTime: f.ModTime,
-					Content: content,
-				})
-			}
+		if !clientFiles[path] && scope.Allows(path) {
+			filesToSend = append(filesToSend, f)
 		}
 	}
 
 	s.mu.Unlock()
 
-	if len(filesToSend) > 0 {
-		fmt.Printf("[%s] [%s] 发送 %d 个文件到 %s\n",
-			time.Now().Format("15:04:05"), tenant.Name, len(filesToSend), req.MachineName)
+	clientHashes := make(map[string]FileInfo, len(req.Files))
+	for _, f := range req.Files {
+		clientHashes[f.Path] = f
+	}
+	for _, existing := range prefixChecks {
+		f := clientHashes[existing.Path]
+		if s.hasPrefix(tenant, existing, f.Hash, f.Size) {
+			filesToSend = append(filesToSend, existing)
+		} else {
+			need = append(need, existing.Path)
+		}
+	}
+
+	if !scope.CanWrite() {
+		need = []string{}
+	}
+	if !scope.CanRead() {
+		filesToSend = []FileInfo{}
+		deleted = []Tombstone{}
+		conflicts = []FileInfo{}
+	}
+
+	if len(need) > 0 || len(filesToSend) > 0 || len(deleted) > 0 || len(conflicts) > 0 {
+		fmt.Printf("[%s] [%s] %s: 需要上传 %d 个文件, 将发送 %d 个文件, 将删除 %d 个文件, 冲突 %d 个文件\n",
+			time.Now().Format("15:04:05"), tenant.Name, req.MachineName,
+			len(need), len(filesToSend), len(deleted), len(conflicts))
 	}
 
 	resp := SyncResponse{
-		Success: true,
-		Message: "OK",
-		Files:   filesToSend,
+		Success:   true,
+		Message:   "OK",
+		Need:      need,
+		Files:     filesToSend,
+		Synced:    synced,
+		Deleted:   deleted,
+		Conflicts: conflicts,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (s *Server) saveTenantFile(tenant *Tenant, f FileInfo) error {
-	path := filepath.Join(s.getTenantDataDir(tenant), f.Path)
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+// handleSyncUpload 接收客户端上传的文件内容 (第二阶段)
+func (s *Server) handleSyncUpload(w http.ResponseWriter, r *http.Request, tenant *Tenant) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scope := requestScope(r)
+	if !scope.CanWrite() {
+		http.Error(w, "Token scope does not allow upload", http.StatusForbidden)
+		return
+	}
+
+	var req UploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !deviceMatches(r, req.MachineID) {
+		http.Error(w, "Device credential does not match machine", http.StatusForbidden)
+		return
+	}
+
+	// 内容的读取、合并和写入都在锁外进行 (存储可能是远程的 S3), 只在提交清单时加锁
+	saved := []FileInfo{}
+	retry := []string{}
+	merged := []FileInfo{}
+	conflicts := []FileInfo{}
+	for _, f := range req.Files {
+		if f.Path = syncPath(f.Path); f.Path == "" || !scope.Allows(f.Path) {
+			continue
+		}
+
+		result, outcome := s.acceptUpload(tenant, f)
+		switch outcome {
+		case uploadSaved:
+			saved = append(saved, result)
+		case uploadRetry:
+			retry = append(retry, f.Path)
+		case uploadMerged:
+			merged = append(merged, result)
+		case uploadConflict:
+			conflicts = append(conflicts, result)
+		}
+	}
+	if len(saved) > 0 || len(merged) > 0 {
+		s.mu.Lock()
+		s.saveTenant(tenant)
+		s.mu.Unlock()
+	}
+
+	if len(saved) > 0 {
+		fmt.Printf("[%s] [%s] 收到 %d 个文件\n",
+			time.Now().Format("15:04:05"), tenant.Name, len(saved))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UploadResponse{
+		Success:   true,
+		Message:   "OK",
+		Saved:     saved,
+		Retry:     retry,
+		Merged:    merged,
+		Conflicts: conflicts,
+	})
+}
+
+// handleSyncDownload 向客户端发送文件内容 (第二阶段)
+func (s *Server) handleSyncDownload(w http.ResponseWriter, r *http.Request, tenant *Tenant) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scope := requestScope(r)
+	if !scope.CanRead() {
+		http.Error(w, "Token scope does not allow download", http.StatusForbidden)
+		return
+	}
+
+	var req DownloadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !deviceMatches(r, req.MachineID) {
+		http.Error(w, "Device credential does not match machine", http.StatusForbidden)
+		return
+	}
+
+	// 在锁内取清单, 锁外读取内容; 读取时内容已被删除 (文件期间被更新) 的文件下次同步再下发
+	s.mu.RLock()
+	wanted := []FileInfo{}
+	current := []FileInfo{}
+	for _, want := range req.Files {
+		want.Path = syncPath(want.Path)
+		f, exists := tenant.Files[want.Path]
+		if !exists || !scope.Allows(want.Path) {
+			continue
+		}
+		wanted = append(wanted, want)
+		current = append(current, f)
+	}
+	s.mu.RUnlock()
+
+	files := []FileInfo{}
+	for i, f := range current {
+		content, err := tenant.blobs.Read(f.Hash)
+		if err != nil {
+			continue
+		}
+		f.Content = content
+		// 客户端的内容是服务器版本的前缀时只发送追加的部分
+		f, _ = makeAppendDelta(f, wanted[i].Hash, wanted[i].Size)
+		files = append(files, f)
+	}
+
+	if len(files) > 0 {
+		fmt.Printf("[%s] [%s] 发送 %d 个文件\n",
+			time.Now().Format("15:04:05"), tenant.Name, len(files))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DownloadResponse{
+		Success: true,
+		Message: "OK",
+		Files:   files,
+	})
+}
+
+// isValidSyncPath 检查路径是规范的相对路径: 使用 "/" 分隔, 不含反斜杠、空段、"." 和 "..",
+// 不会逃出租户目录。权限范围按前缀匹配, 所以必须在检查权限之前拒绝不规范的路径
+func isValidSyncPath(path string) bool {
+	return path != "" && !strings.Contains(path, `\`) && cleanWirePath(path) == path
+}
+
+// syncPath 将客户端提交的路径统一为规范形式: 旧版本的 Windows 客户端使用反斜杠分隔, 转换为 "/",
+// 与其他客户端提交的同一文件对应同一条记录; 无效的路径返回空字符串
+func syncPath(path string) string {
+	if p := cleanWirePath(path); isValidSyncPath(p) {
+		return p
+	}
+	return ""
+}
+
+// hasPrefix 判断哈希为 hash、大小为 size 的内容是否为服务器文件的前缀
+func (s *Server) hasPrefix(tenant *Tenant, existing FileInfo, hash string, size int64) bool {
+	if size <= 0 || size >= existing.Size {
+		return false
+	}
+	file, err := tenant.blobs.Open(existing.Hash)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.CopyN(h, file, size); err != nil {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == hash
+}
+
+// uploadOutcome 单个上传文件的处理结果
+type uploadOutcome int
+
+const (
+	uploadIgnored  uploadOutcome = iota // 内容与哈希不符或写入失败
+	uploadSaved                         // 已保存 (或服务器已有相同内容)
+	uploadRetry                         // 需要客户端完整上传
+	uploadMerged                        // 已与服务器版本合并, 客户端需要重新下载
+	uploadConflict                      // 两边都有修改且无法合并
+)
+
+// acceptUpload 校验并保存一个上传的文件, 返回保存后的文件信息 (仅清单)。
+// 读取和写入内容时不持有锁, 提交时服务器版本已被其他请求更新则不提交, 让客户端重新上传
+func (s *Server) acceptUpload(tenant *Tenant, f FileInfo) (FileInfo, uploadOutcome) {
+	s.mu.RLock()
+	existing, exists := tenant.Files[f.Path]
+	s.mu.RUnlock()
+
+	appendOnly := f.Offset > 0
+	outcome := uploadSaved
+	switch {
+	case appendOnly:
+		// 追加上传: 基准必须是服务器当前版本, 否则让客户端完整上传
+		if !exists || !s.verifyAppend(tenant, existing, f) {
+			return FileInfo{}, uploadRetry
+		}
+	case hashBytes(f.Content) != f.Hash:
+		return FileInfo{}, uploadIgnored
+	case exists && existing.Hash == f.Hash:
+		return existing, uploadSaved
+	case exists && f.BaseRev != existing.Rev && isMergeable(f.Path):
+		// 两边都有新内容时按行合并, 合并结果需要客户端重新下载
+		result, changed, err := s.mergeUpload(tenant, existing, f)
+		if err != nil {
+			return FileInfo{}, uploadIgnored
+		}
+		if !changed {
+			// 上传的内容没有新记录, 服务器版本不变
+			return existing, uploadMerged
+		}
+		if result.Hash != f.Hash {
+			outcome = uploadMerged
+		}
+		f = result
+	case exists && f.BaseRev != existing.Rev:
+		// 上传基于的版本已不是服务器当前版本
+		return existing, uploadConflict
+	}
+
+	s.mu.Lock()
+	stored := tenant.blobs.Pin(f.Hash)
+	s.mu.Unlock()
+
+	var err error
+	switch {
+	case stored:
+	case appendOnly:
+		err = tenant.blobs.WriteExtended(existing.Hash, f.Hash, f.Content)
+	default:
+		err = tenant.blobs.Write(f.Hash, f.Content)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer tenant.blobs.Unpin(f.Hash)
+	if err != nil {
+		fmt.Printf("[%s] [%s] 保存文件失败: %s: %v\n",
+			time.Now().Format("15:04:05"), tenant.Name, f.Path, err)
+		return FileInfo{}, uploadIgnored
+	}
+	if current, ok := tenant.Files[f.Path]; ok != exists || current.Rev != existing.Rev {
+		return FileInfo{}, uploadRetry
+	}
+
+	tenant.blobs.Ref(f.Hash)
+	if appendOnly {
+		tenant.blobs.Release(existing.Hash)
+	}
+	f.Rev = s.commitVersion(tenant, f.Path, appendOnly)
+	f.Size = f.Offset + int64(len(f.Content))
+	f.Content = nil
+	f.Offset = 0
+	f.BaseHash = ""
+	f.BaseRev = 0
+	tenant.Files[f.Path] = f
+	delete(tenant.Tombstones, f.Path)
+	return f, outcome
+}
+
+// mergeUpload 将上传的会话记录与服务器版本按行合并, 返回合并后的文件 (含内容);
+// 上传内容已包含服务器全部内容时原样返回。上传的内容没有新记录时返回 false
+func (s *Server) mergeUpload(tenant *Tenant, existing, f FileInfo) (FileInfo, bool, error) {
+	base, err := tenant.blobs.Read(existing.Hash)
+	if err != nil {
+		return FileInfo{}, false, err
+	}
+
+	content := f.Content
+	if !bytes.HasPrefix(f.Content, base) {
+		var changed bool
+		content, changed = mergeJSONL(base, f.Content)
+		if !changed {
+			return existing, false, nil
+		}
+		fmt.Printf("[%s] [%s] 合并会话记录: %s\n",
+			time.Now().Format("15:04:05"), tenant.Name, f.Path)
+	}
+
+	result := FileInfo{
+		Path:    f.Path,
+		Hash:    hashBytes(content),
+		ModTime: f.ModTime,
+		Content: content,
+	}
+	if existing.ModTime > result.ModTime {
+		result.ModTime = existing.ModTime
+	}
+	return result, true, nil
+}
+
+// verifyAppend 校验追加上传: 基准为服务器当前版本, 且拼接后的哈希与声明一致
+func (s *Server) verifyAppend(tenant *Tenant, existing, f FileInfo) bool {
+	if existing.Hash != f.BaseHash || existing.Size != f.Offset {
+		return false
+	}
+	file, err := tenant.blobs.Open(existing.Hash)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return false
+	}
+	h.Write(f.Content)
+	return hex.EncodeToString(h.Sum(nil)) == f.Hash
+}
+
+// saveTenantFile 保存文件内容 (追加上传时只追加新内容), 返回新的版本号 (调用者需要持有锁)
+func (s *Server) saveTenantFile(tenant *Tenant, f FileInfo) (int64, error) {
+	existing, exists := tenant.Files[f.Path]
+
+	var err error
+	if f.Offset > 0 && exists {
+		err = tenant.blobs.Extend(existing.Hash, f.Hash, f.Content)
+	} else {
+		err = tenant.blobs.Put(f.Hash, f.Content)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return s.commitVersion(tenant, f.Path, f.Offset > 0 && exists), nil
+}
+
+// commitVersion 在新内容保存后为文件分配新的版本号, 被替换的版本保留为历史版本 (调用者需要持有锁)
+func (s *Server) commitVersion(tenant *Tenant, path string, appendOnly bool) int64 {
+	existing, exists := tenant.Files[path]
+	tenant.markDirty(path)
+
+	// 版本号 = 写入时间 (纳秒), 保证同一文件的版本号递增
+	rev := time.Now().UnixNano()
+	if exists {
+		if err := s.archiveVersion(tenant, existing, appendOnly); err != nil {
+			fmt.Printf("[%s] [%s] 保存历史版本失败: %s: %v\n",
+				time.Now().Format("15:04:05"), tenant.Name, path, err)
+		}
+		if rev <= existing.Rev {
+			rev = existing.Rev + 1
+		}
+	}
+	return rev
+}
+
+// deleteTenantFile 删除租户文件, 删除前的版本保留为历史版本
+func (s *Server) deleteTenantFile(tenant *Tenant, path string) error {
+	existing, ok := tenant.Files[path]
+	if !ok {
+		return nil
+	}
+	if err := s.archiveVersion(tenant, existing, false); err != nil {
 		return err
 	}
-	return os.WriteFile(path, f.Content, 0644)
+	return s.recordDeletion(tenant, path, time.Now())
+}
+
+// removeTenantFile 删除文件并记录删除, 通知其他客户端删除 (调用者需要持有锁)
+func (s *Server) removeTenantFile(tenant *Tenant, path, machineID string) error {
+	existing, ok := tenant.Files[path]
+	if !ok {
+		return nil
+	}
+	if err := s.deleteTenantFile(tenant, path); err != nil {
+		return err
+	}
+	delete(tenant.Files, path)
+	tenant.markDirty(path)
+	tenant.Tombstones[path] = &Tombstone{
+		Path:      path,
+		Hash:      existing.Hash,
+		DeletedAt: time.Now().Unix(),
+		MachineID: machineID,
+	}
+	return nil
+}
+
+// gcTombstones 清理超过保留时间的删除记录 (调用者需要持有锁)
+func (s *Server) gcTombstones(tenant *Tenant) {
+	if s.tombstoneRetention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-s.tombstoneRetention).Unix()
+	for path, t := range tenant.Tombstones {
+		if t.DeletedAt < cutoff {
+			delete(tenant.Tombstones, path)
+			tenant.markDirty(path)
+		}
+	}
 }
 
 func (s *Server) handleTenantStats(w http.ResponseWriter, r *http.Request, tenant *Tenant) {
@@ -410,18 +1225,13 @@ func (s *Server) handleTenantStats(w http.ResponseWriter, r *http.Request, tenan
 		totalSize += f.Size
 	}
 
-	clients := make([]*ClientInfo, 0, len(tenant.Clients))
-	for _, c := range tenant.Clients {
-		clients = append(clients, c)
-	}
-
 	stats := TenantStats{
 		ID:          tenant.ID,
 		Name:        tenant.Name,
 		FileCount:   len(tenant.Files),
 		TotalSize:   totalSize,
 		ClientCount: len(tenant.Clients),
-		Clients:     clients,
+		Clients:     tenant.clientList(),
 		LastActive:  tenant.LastActive,
 	}
 
@@ -430,29 +1240,6 @@ func (s *Server) handleTenantStats(w http.ResponseWriter, r *http.Request, tenan
 }
 
 func (s *Server) handleAdminTenants(w http.ResponseWriter, r *http.Request) {
-	// 简单的 admin 认证 (使用 query param)
-	adminToken := r.URL.Query().Get("admin_token")
-	if adminToken == "" {
-		http.Error(w, "Admin token required", http.StatusUnauthorized)
-		return
-	}
-
-	// 验证 admin token (这里简单处理，实际应该有独立的 admin token)
-	s.mu.RLock()
-	validAdmin := false
-	for _, t := range s.tenants {
-		if t.Token == adminToken {
-			validAdmin = true
-			break
-		}
-	}
-	s.mu.RUnlock()
-
-	if !validAdmin {
-		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
-		return
-	}
-
 	switch r.Method {
 	case "GET":
 		// 列出所有租户
@@ -526,12 +1313,6 @@ func (s *Server) handleAdminTenants(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
-	adminToken := r.URL.Query().Get("admin_token")
-	if adminToken == "" {
-		http.Error(w, "Admin token required", http.StatusUnauthorized)
-		return
-	}
-
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -547,18 +1328,13 @@ func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
 		totalFiles += len(t.Files)
 		totalSize += tSize
 
-		clients := make([]*ClientInfo, 0, len(t.Clients))
-		for _, c := range t.Clients {
-			clients = append(clients, c)
-		}
-
 		tenantStats = append(tenantStats, &TenantStats{
 			ID:          t.ID,
 			Name:        t.Name,
 			FileCount:   len(t.Files),
 			TotalSize:   tSize,
 			ClientCount: len(t.Clients),
-			Clients:     clients,
+			Clients:     t.clientList(),
 			LastActive:  t.LastActive,
 		})
 	}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// blockingStorage 写入指定哈希的内容时阻塞, 直到 release 被关闭
+type blockingStorage struct {
+	Storage
+	hash    string
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStorage) Put(key string, data []byte) error {
+	if strings.HasSuffix(key, "/"+b.hash) {
+		close(b.entered)
+		<-b.release
+	}
+	return b.Storage.Put(key, data)
+}
+
+func TestUploadWritesContentOutsideLock(t *testing.T) {
+	content := []byte("v1\n")
+	store := &blockingStorage{
+		Storage: NewLocalStorage(t.TempDir()),
+		hash:    hashBytes(content),
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	s, err := NewServerWithStorage(0, store, filepath.Join(t.TempDir(), metaName), "tenant-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tenant := s.tenants["default"]
+
+	done := make(chan uploadOutcome)
+	go func() {
+		_, outcome := s.acceptUpload(tenant, FileInfo{Path: "a.md", Hash: store.hash, Content: content})
+		done <- outcome
+	}()
+	<-store.entered
+	if !s.mu.TryLock() {
+		close(store.release)
+		t.Fatal("server lock is held while writing content")
+	}
+	s.mu.Unlock()
+
+	// 写入期间其他设备更新了同一文件: 提交时发现版本已变化, 让客户端重新上传
+	other := []byte("v2\n")
+	if _, outcome := s.acceptUpload(tenant, FileInfo{Path: "a.md", Hash: hashBytes(other), Content: other}); outcome != uploadSaved {
+		t.Fatalf("concurrent upload outcome = %d", outcome)
+	}
+	close(store.release)
+	if outcome := <-done; outcome != uploadRetry {
+		t.Errorf("stale upload outcome = %d, want retry", outcome)
+	}
+
+	if f := tenant.Files["a.md"]; f.Hash != hashBytes(other) {
+		t.Errorf("server file = %+v", f)
+	}
+	if _, err := store.Get(tenant.blobs.key(store.hash)); err == nil {
+		t.Error("uncommitted content should be removed")
+	}
+	if len(tenant.blobs.pins) != 0 {
+		t.Errorf("pins = %v", tenant.blobs.pins)
+	}
+}
+
+func TestNewServerRefusesMissingMetaWithData(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewServer(0, dir, "tenant-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("session\n")
+	s.tenants["default"].blobs.Put(hashBytes(content), content)
+	s.Close()
+
+	// 元数据库丢失 (例如放在容器的临时磁盘上) 时不能用空的元数据库启动
+	if err := os.Remove(filepath.Join(dir, metaName)); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := NewServer(0, dir, "tenant-token"); err == nil {
+		s.Close()
+		t.Fatal("server started with an empty metadata store over existing data")
+	}
+	if _, err := os.Stat(filepath.Join(dir, metaName)); !os.IsNotExist(err) {
+		t.Errorf("metadata store should not be created: %v", err)
+	}
+}
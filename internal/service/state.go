@@ -0,0 +1,270 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/k0ngk0ng/claude-sync/internal/config"
+)
+
+// FileState 单个文件的本地同步状态
+type FileState struct {
+	ModTime    int64  `json:"mod_time"`    // 本地文件修改时间 (纳秒)
+	Size       int64  `json:"size"`        // 本地文件大小
+	Hash       string `json:"hash"`        // 对应 ModTime/Size 时的内容哈希, 为空表示本地文件不存在
+	WireSize   int64  `json:"wire_size"`   // Hash 对应的传输内容大小
+	SyncedHash string `json:"synced_hash"` // 上次同步成功时的内容哈希
+	SyncedSize int64  `json:"synced_size"` // 上次同步成功时的传输内容大小
+	Rev        int64  `json:"rev"`         // 上次同步成功时的服务器版本号
+	SyncedAt   int64  `json:"synced_at"`   // 上次同步成功的时间
+}
+
+// Synced 是否曾经同步成功过
+func (fs FileState) Synced() bool {
+	return fs.SyncedHash != ""
+}
+
+// Conflict 未解决的同步冲突: 原路径已是服务器版本, 本地版本另存为冲突副本
+type Conflict struct {
+	Path       string `json:"path"`        // 冲突文件 (本地相对路径)
+	CopyPath   string `json:"copy_path"`   // 本地版本的冲突副本
+	RemoteRev  int64  `json:"remote_rev"`  // 冲突时的服务器版本号
+	DetectedAt int64  `json:"detected_at"` // 发现冲突的时间
+}
+
+// StateStore 持久化的同步状态数据库 (本地相对路径 -> 状态)
+type StateStore struct {
+	path      string
+	mu        sync.Mutex
+	files     map[string]FileState
+	conflicts map[string]Conflict
+	mappings  *config.PathMappings // 生成状态时使用的路径映射, 旧版本的状态库没有记录
+	moved     []Tombstone          // 路径映射改变后等待从服务器删除的原远程路径
+	dirty     bool
+}
+
+type stateFile struct {
+	Version      int                  `json:"version"`
+	Files        map[string]FileState `json:"files"`
+	Conflicts    map[string]Conflict  `json:"conflicts,omitempty"`
+	PathMappings *config.PathMappings `json:"path_mappings,omitempty"`
+	Moved        []Tombstone          `json:"moved,omitempty"`
+}
+
+// LoadStateStore 加载状态数据库, 文件不存在时返回空库
+func LoadStateStore(path string) (*StateStore, error) {
+	st := &StateStore{
+		path:      path,
+		files:     make(map[string]FileState),
+		conflicts: make(map[string]Conflict),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return st, err
+	}
+
+	var sf stateFile
+	if err := json.Unmarshal(data, &sf); err != nil {
+		return st, err
+	}
+	if sf.Files != nil {
+		st.files = sf.Files
+	}
+	if sf.Conflicts != nil {
+		st.conflicts = sf.Conflicts
+	}
+	st.mappings = sf.PathMappings
+	st.moved = sf.Moved
+	return st, nil
+}
+
+// Get 获取文件状态
+func (st *StateStore) Get(path string) (FileState, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	fs, ok := st.files[path]
+	return fs, ok
+}
+
+// Put 更新文件状态
+func (st *StateStore) Put(path string, fs FileState) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.files[path] = fs
+	st.dirty = true
+}
+
+// Delete 删除文件状态
+func (st *StateStore) Delete(path string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.files[path]; ok {
+		delete(st.files, path)
+		st.dirty = true
+	}
+}
+
+// Reset 清除所有文件状态 (例如启用加密后传输内容全部改变), 保留冲突记录
+func (st *StateStore) Reset() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.files = make(map[string]FileState)
+	st.dirty = true
+}
+
+// Invalidate 清除缓存的本地修改时间, 下次扫描时重新读取所有文件 (例如传输内容的生成规则改变)
+func (st *StateStore) Invalidate() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for path, fs := range st.files {
+		fs.ModTime = 0
+		st.files[path] = fs
+	}
+	st.dirty = true
+}
+
+// PathMappings 生成状态时使用的路径映射; 旧版本的状态库没有记录时 ok 为 false
+func (st *StateStore) PathMappings() (config.PathMappings, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.mappings == nil {
+		return nil, false
+	}
+	return *st.mappings, true
+}
+
+// SetPathMappings 记录当前的路径映射
+func (st *StateStore) SetPathMappings(mappings config.PathMappings) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	m := append(config.PathMappings{}, mappings...)
+	st.mappings = &m
+	st.dirty = true
+}
+
+// AddMove 记录需要从服务器删除的原远程路径
+func (st *StateStore) AddMove(t Tombstone) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.moved = append(st.moved, t)
+	st.dirty = true
+}
+
+// Moves 返回等待从服务器删除的原远程路径
+func (st *StateStore) Moves() []Tombstone {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return append([]Tombstone(nil), st.moved...)
+}
+
+// ClearMoves 删除已提交给服务器的 n 条记录 (Moves 返回的前 n 条)
+func (st *StateStore) ClearMoves(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if n > len(st.moved) {
+		n = len(st.moved)
+	}
+	st.moved = append([]Tombstone(nil), st.moved[n:]...)
+	st.dirty = true
+}
+
+// Paths 返回所有已记录的路径 (有序)
+func (st *StateStore) Paths() []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	paths := make([]string, 0, len(st.files))
+	for p := range st.files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Snapshot 返回所有文件状态的副本
+func (st *StateStore) Snapshot() map[string]FileState {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	files := make(map[string]FileState, len(st.files))
+	for p, fs := range st.files {
+		files[p] = fs
+	}
+	return files
+}
+
+// PutConflict 记录冲突 (同一路径只保留最新一次)
+func (st *StateStore) PutConflict(c Conflict) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.conflicts[c.Path] = c
+	st.dirty = true
+}
+
+// GetConflict 获取指定路径的冲突
+func (st *StateStore) GetConflict(path string) (Conflict, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	c, ok := st.conflicts[path]
+	return c, ok
+}
+
+// DeleteConflict 删除冲突记录
+func (st *StateStore) DeleteConflict(path string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.conflicts[path]; ok {
+		delete(st.conflicts, path)
+		st.dirty = true
+	}
+}
+
+// Conflicts 返回所有未解决的冲突 (按路径排序)
+func (st *StateStore) Conflicts() []Conflict {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	conflicts := make([]Conflict, 0, len(st.conflicts))
+	for _, c := range st.conflicts {
+		conflicts = append(conflicts, c)
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Path < conflicts[j].Path })
+	return conflicts
+}
+
+// Save 将状态写回磁盘 (先写临时文件再重命名, 避免写到一半损坏)
+func (st *StateStore) Save() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(stateFile{
+		Version:      1,
+		Files:        st.files,
+		Conflicts:    st.conflicts,
+		PathMappings: st.mappings,
+		Moved:        st.moved,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(st.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, st.path); err != nil {
+		return err
+	}
+	st.dirty = false
+	return nil
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Storage 服务器数据存储后端。键使用 "/" 分隔 (如 tenants/<id>/manifest.json),
+// 读取不存在的键时返回的错误满足 os.IsNotExist
+type Storage interface {
+	Get(key string) ([]byte, error)
+	Open(key string) (io.ReadCloser, error)
+	Put(key string, data []byte) error
+	Delete(key string) error
+	// List 返回以 prefix 开头的所有键
+	List(prefix string) ([]string, error)
+}
+
+// copyAppender 支持在存储内部复制对象并追加内容的存储: dstKey 写入完成后才出现, srcKey 保持不变
+type copyAppender interface {
+	CopyAppend(srcKey, dstKey string, data []byte) error
+}
+
+// renamer 支持重命名的存储
+type renamer interface {
+	Rename(oldKey, newKey string) error
+}
+
+// moveKey 移动对象, 存储不支持重命名时复制后删除
+func moveKey(store Storage, oldKey, newKey string) error {
+	if r, ok := store.(renamer); ok {
+		return r.Rename(oldKey, newKey)
+	}
+	data, err := store.Get(oldKey)
+	if err != nil {
+		return err
+	}
+	if err := store.Put(newKey, data); err != nil {
+		return err
+	}
+	return store.Delete(oldKey)
+}
+
+// deletePrefix 删除以 prefix 开头的所有对象
+func deletePrefix(store Storage, prefix string) error {
+	keys, err := store.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LocalStorage 本地文件系统存储
+type LocalStorage struct {
+	root string
+}
+
+// NewLocalStorage 创建本地文件系统存储, 目录在写入时自动创建
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{root: filepath.Clean(root)}
+}
+
+func (l *LocalStorage) String() string {
+	return l.root
+}
+
+func (l *LocalStorage) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
+
+// Get 读取对象
+func (l *LocalStorage) Get(key string) ([]byte, error) {
+	return os.ReadFile(l.path(key))
+}
+
+// Open 打开对象用于流式读取
+func (l *LocalStorage) Open(key string) (io.ReadCloser, error) {
+	return os.Open(l.path(key))
+}
+
+// Put 写入对象
+func (l *LocalStorage) Put(key string, data []byte) error {
+	return l.writeAtomic(key, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeAtomic 先写临时文件并同步到磁盘, 再重命名为 key, 中途失败或崩溃不会留下不完整的内容
+func (l *LocalStorage) writeAtomic(key string, write func(w io.Writer) error) error {
+	path := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	os.Chmod(tmp.Name(), 0600)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Delete 删除对象, 并清理留下的空目录
+func (l *LocalStorage) Delete(key string) error {
+	path := l.path(key)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != l.root && strings.HasPrefix(dir, l.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// List 列出以 prefix 开头的所有对象 (不包括写入中的临时文件)
+func (l *LocalStorage) List(prefix string) ([]string, error) {
+	// 从 prefix 中最后一个完整的目录开始遍历
+	dir := l.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = l.path(prefix[:i])
+	}
+
+	var keys []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return nil
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// CopyAppend 将 srcKey 的内容加上 data 写入新对象 dstKey, srcKey 不变
+func (l *LocalStorage) CopyAppend(srcKey, dstKey string, data []byte) error {
+	src, err := os.Open(l.path(srcKey))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return l.writeAtomic(dstKey, func(w io.Writer) error {
+		if _, err := io.Copy(w, src); err != nil {
+			return err
+		}
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Rename 重命名对象
+func (l *LocalStorage) Rename(oldKey, newKey string) error {
+	newPath := l.path(newKey)
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path(oldKey), newPath); err != nil {
+		return err
+	}
+	l.Delete(oldKey) // 清理空目录
+	return nil
+}
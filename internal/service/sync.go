@@ -2,9 +2,8 @@ package service
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -48,31 +47,84 @@ type FileInfo struct {
 	Hash    string `json:"hash"`
 	ModTime int64  `json:"mod_time"`
 	Size    int64  `json:"size"`
+	Rev     int64  `json:"rev,omitempty"`      // 服务器版本号
+	BaseRev int64  `json:"base_rev,omitempty"` // 客户端上次同步时的服务器版本号, 用于检测冲突
 	Content []byte `json:"content,omitempty"`
+
+	// BaseHash 基准版本的哈希: 清单中为上次同步时的内容, 追加传输中为前 Offset 字节
+	BaseHash string `json:"base_hash,omitempty"`
+	// Offset 追加传输: Content 只包含从 Offset 开始追加的内容
+	Offset int64 `json:"offset,omitempty"`
+}
+
+// Tombstone 删除记录
+type Tombstone struct {
+	Path      string `json:"path"`
+	Hash      string `json:"hash"`       // 被删除时的内容哈希
+	DeletedAt int64  `json:"deleted_at"` // 删除时间 (Unix 秒)
+	MachineID string `json:"machine_id"` // 发起删除的机器
 }
 
-// SyncRequest 同步请求
+// SyncRequest 同步请求 (第一阶段: 只包含文件清单, 不含内容)
 type SyncRequest struct {
-	MachineID   string     `json:"machine_id"`
-	MachineName string     `json:"machine_name"`
-	Files       []FileInfo `json:"files"`
+	MachineID   string      `json:"machine_id"`
+	MachineName string      `json:"machine_name"`
+	Files       []FileInfo  `json:"files"`
+	Deleted     []Tombstone `json:"deleted"` // 上次同步后在本地删除的文件
 }
 
 // SyncResponse 同步响应
 type SyncResponse struct {
+	Success   bool        `json:"success"`
+	Message   string      `json:"message"`
+	Need      []string    `json:"need"`      // 服务器需要客户端上传的文件
+	Files     []FileInfo  `json:"files"`     // 服务器将发送给客户端的文件 (仅清单)
+	Synced    []FileInfo  `json:"synced"`    // 内容一致但客户端记录的版本号已过时的文件
+	Deleted   []Tombstone `json:"deleted"`   // 已在其他机器上删除, 客户端也应删除的文件
+	Conflicts []FileInfo  `json:"conflicts"` // 两边都有修改且无法合并的文件 (服务器版本清单)
+}
+
+// UploadRequest 上传请求 (第二阶段)
+type UploadRequest struct {
+	MachineID string     `json:"machine_id"`
+	Files     []FileInfo `json:"files"`
+}
+
+// UploadResponse 上传响应
+type UploadResponse struct {
+	Success   bool       `json:"success"`
+	Message   string     `json:"message"`
+	Saved     []FileInfo `json:"saved"`     // 已保存的文件 (仅清单, 含新版本号)
+	Retry     []string   `json:"retry"`     // 追加传输的基准不一致, 需要完整上传的文件
+	Merged    []FileInfo `json:"merged"`    // 服务器合并后的会话记录 (仅清单), 客户端需要重新下载
+	Conflicts []FileInfo `json:"conflicts"` // 上传时服务器版本已变化且无法合并的文件
+}
+
+// DownloadRequest 下载请求 (第二阶段)
+type DownloadRequest struct {
+	MachineID string `json:"machine_id"`
+	// 要下载的文件; Hash/Size 为客户端当前内容, 服务器据此决定是否只发送追加的部分
+	Files []FileInfo `json:"files"`
+}
+
+// DownloadResponse 下载响应
+type DownloadResponse struct {
 	Success bool       `json:"success"`
 	Message string     `json:"message"`
 	Files   []FileInfo `json:"files"`
 }
 
+// maxBatchSize 单次上传/下载请求的最大内容大小
+const maxBatchSize = 8 << 20
+
 // SyncStats 同步统计
 type SyncStats struct {
-	TotalFiles   int       `json:"total_files"`
-	TotalSize    int64     `json:"total_size"`
-	LastSync     time.Time `json:"last_sync"`
-	LastError    string    `json:"last_error"`
-	Uploaded     int       `json:"uploaded"`
-	Downloaded   int       `json:"downloaded"`
+	TotalFiles int       `json:"total_files"`
+	TotalSize  int64     `json:"total_size"`
+	LastSync   time.Time `json:"last_sync"`
+	LastError  string    `json:"last_error"`
+	Uploaded   int       `json:"uploaded"`
+	Downloaded int       `json:"downloaded"`
 }
 
 // StatusCallback 状态回调
@@ -80,26 +132,50 @@ type StatusCallback func(status SyncStatus, stats *SyncStats)
 
 // SyncService 同步服务
 type SyncService struct {
-	config     *config.Config
-	claudeDir  string
-	fileHashes map[string]string
-	mu         sync.RWMutex
-	stopChan   chan struct{}
-	status     SyncStatus
-	stats      SyncStats
-	callback   StatusCallback
-	running    bool
+	config    *config.Config
+	claudeDir string
+	state     *StateStore
+	syncMu    sync.Mutex // 保证同一时间只有一次同步在进行
+	mu        sync.RWMutex
+	stopChan  chan struct{}
+	status    SyncStatus
+	stats     SyncStats
+	callback  StatusCallback
+	running   bool
+
+	cipher             *contentCipher // 端到端加密, 未启用时为 nil
+	encryptionVerified bool           // 已确认与服务器的加密设置一致
+
+	redactor   *redactor             // 上传前的敏感信息过滤器, 关闭时为 nil
+	redactKey  string                // 生成 redactor 的配置
+	redactions map[string]*Redaction // 本地路径 -> 检测到的敏感信息
+
+	rules        *syncRules    // 同步范围 (同步根和包含/排除规则)
+	scopeChanged chan struct{} // 同步范围改变, 需要重新建立文件监听
 }
 
 // NewSyncService 创建同步服务
 func NewSyncService(cfg *config.Config) *SyncService {
-	return &SyncService{
-		config:     cfg,
-		claudeDir:  config.GetClaudeDir(),
-		fileHashes: make(map[string]string),
-		stopChan:   make(chan struct{}),
-		status:     StatusOffline,
+	// 状态库损坏时从空库开始, 下次同步会重新建立
+	state, err := LoadStateStore(config.GetStatePath())
+	if err != nil {
+		fmt.Printf("加载同步状态失败: %v\n", err)
+	}
+
+	s := &SyncService{
+		config:    cfg,
+		claudeDir: config.GetClaudeDir(),
+		state:     state,
+		stopChan:  make(chan struct{}),
+		status:    StatusOffline,
+
+		scopeChanged: make(chan struct{}, 1),
 	}
+	s.loadCipher()
+	s.loadRedactor()
+	s.loadRules()
+	s.loadPathMappings()
+	return s
 }
 
 // SetCallback 设置状态回调
@@ -156,21 +232,81 @@ func (s *SyncService) UpdateConfig(cfg *config.Config) {
 	s.mu.Lock()
 	s.config = cfg
 	s.mu.Unlock()
+	s.loadCipher()
+	s.loadRedactor()
+	s.loadRules()
+	s.loadPathMappings()
 }
 
 func (s *SyncService) run() {
-	// 立即执行一次
+	os.MkdirAll(s.claudeDir, 0755)
+
+	// 监听整个 ~/.claude, 但只进入同步根所在的目录
+	watcher := newWatcher(s.claudeDir, s.watchRoots(), s.watchSkip)
+	defer func() { watcher.Close() }()
+
+	// 立即执行一次全量同步
 	s.syncOnce()
+	lastFull := time.Now()
 
+	// 本地变化由文件监听触发, 定时器只负责拉取远程变化
 	ticker := time.NewTicker(time.Duration(s.config.SyncInterval) * time.Second)
 	defer ticker.Stop()
 
+	pending := make(map[string]bool)
+	needFull := false
+	var quiet, deadline *time.Timer
+	var quietC, deadlineC <-chan time.Time
+
+	flush := func() {
+		if quiet != nil {
+			quiet.Stop()
+			deadline.Stop()
+			quiet, deadline = nil, nil
+			quietC, deadlineC = nil, nil
+		}
+		if s.config.Paused {
+			return
+		}
+
+		full := needFull || time.Since(lastFull) > fullScanInterval
+		changed := make([]string, 0, len(pending))
+		for path := range pending {
+			changed = append(changed, path)
+		}
+		s.sync(full, changed)
+		if full {
+			lastFull = time.Now()
+		}
+		pending = make(map[string]bool)
+		needFull = false
+	}
+
 	for {
 		select {
-		case <-ticker.C:
-			if !s.config.Paused {
-				s.syncOnce()
+		case path := <-watcher.Changes():
+			if path == "" {
+				needFull = true
+			} else {
+				pending[path] = true
+			}
+			// 合并连续的写入: 静默一段时间后同步, 但持续写入时也不会无限推迟
+			if quiet == nil {
+				quiet = time.NewTimer(debounceDelay)
+				deadline = time.NewTimer(maxDebounceDelay)
+				quietC, deadlineC = quiet.C, deadline.C
+			} else {
+				quiet.Reset(debounceDelay)
 			}
+		case <-quietC:
+			flush()
+		case <-deadlineC:
+			flush()
+		case <-ticker.C:
+			flush()
+		case <-s.scopeChanged:
+			watcher.Close()
+			watcher = newWatcher(s.claudeDir, s.watchRoots(), s.watchSkip)
 		case <-s.stopChan:
 			return
 		}
@@ -188,64 +324,92 @@ func (s *SyncService) setStatus(status SyncStatus) {
 }
 
 func (s *SyncService) syncOnce() error {
+	return s.sync(true, nil)
+}
+
+// sync 执行一次同步; full 为 true 时全量扫描本地文件, 否则只刷新 changed 中的路径
+func (s *SyncService) sync(full bool, changed []string) error {
 	if !s.config.IsConfigured() {
 		s.setStatus(StatusOffline)
 		return fmt.Errorf("未配置服务器")
 	}
 
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	defer s.state.Save()
+
 	s.setStatus(StatusSyncing)
 
 	// 扫描本地文件
-	localFiles, totalSize, err := s.scanLocalFiles()
-	if err != nil {
-		s.mu.Lock()
-		s.stats.LastError = err.Error()
-		s.mu.Unlock()
-		s.setStatus(StatusError)
-		return err
+	if full {
+		if err := s.scanLocalFiles(); err != nil {
+			return s.syncFailed(err)
+		}
+	} else {
+		s.refreshLocalFiles(changed)
 	}
+	localFiles, totalSize := s.localManifest()
 
 	s.mu.Lock()
 	s.stats.TotalFiles = len(localFiles)
 	s.stats.TotalSize = totalSize
 	s.mu.Unlock()
 
-	// 发送同步请求
+	if err := s.ensureDevice(); err != nil {
+		return s.syncFailed(err)
+	}
+	if err := s.ensureEncryption(); err != nil {
+		return s.syncFailed(err)
+	}
+
+	// 第一阶段: 发送文件清单和本地删除记录 (包括路径映射改变后的原远程路径), 由服务器决定需要传输哪些文件
+	deleted := s.localDeletions()
+	moved := s.state.Moves()
 	req := SyncRequest{
 		MachineID:   s.config.MachineID,
 		MachineName: s.config.MachineName,
 		Files:       localFiles,
+		Deleted:     append(append([]Tombstone{}, deleted...), moved...),
+	}
+
+	var resp SyncResponse
+	if err := s.postJSON("/sync", req, &resp); err != nil {
+		return s.syncFailed(err)
+	}
+	if !resp.Success {
+		return s.syncFailed(errors.New(resp.Message))
+	}
+
+	for _, f := range resp.Synced {
+		s.markSynced(f)
+	}
+
+	// 删除记录已提交; 服务器如果拒绝删除 (文件已被其他机器修改), 会在下载列表中发回
+	for _, t := range deleted {
+		s.state.Delete(s.localPath(t.Path))
 	}
+	s.state.ClearMoves(len(moved))
+	s.applyRemoteDeletions(resp.Deleted)
 
-	respFiles, err := s.sendSyncRequest(req)
+	// 第二阶段: 上传服务器需要的文件, 下载服务器要发送的文件 (包括合并后的会话记录)
+	result, err := s.uploadFiles(resp.Need)
 	if err != nil {
-		s.mu.Lock()
-		s.stats.LastError = err.Error()
-		s.mu.Unlock()
-		s.setStatus(StatusError)
-		return err
+		return s.syncFailed(err)
 	}
+	uploaded := len(result.Saved)
 
-	// 应用远程更新
-	downloaded := 0
-	for _, f := range respFiles {
-		if len(f.Content) > 0 {
-			localPath := s.applyPathMapping(f.Path)
-			destPath := filepath.Join(s.claudeDir, localPath)
-			content := s.applyContentPathMapping(f.Content)
-
-			if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
-				continue
-			}
-			if err := os.WriteFile(destPath, content, 0644); err != nil {
-				continue
-			}
-			downloaded++
-		}
+	// 冲突的文件: 本地版本另存为冲突副本, 原路径下载服务器版本
+	conflicts := s.includedFiles(append(resp.Conflicts, result.Conflicts...))
+	toDownload := append(s.includedFiles(resp.Files), result.Merged...)
+	toDownload = append(toDownload, s.keepConflictCopies(conflicts)...)
+	downloaded, err := s.downloadFiles(toDownload)
+	if err != nil {
+		return s.syncFailed(err)
 	}
 
 	s.mu.Lock()
 	s.stats.LastSync = time.Now()
+	s.stats.Uploaded = uploaded
 	s.stats.Downloaded = downloaded
 	s.stats.LastError = ""
 	s.mu.Unlock()
@@ -254,124 +418,548 @@ func (s *SyncService) syncOnce() error {
 	return nil
 }
 
-func (s *SyncService) scanLocalFiles() ([]FileInfo, int64, error) {
-	var files []FileInfo
-	var totalSize int64
-	projectsDir := filepath.Join(s.claudeDir, "projects")
+func (s *SyncService) syncFailed(err error) error {
+	s.mu.Lock()
+	s.stats.LastError = err.Error()
+	s.mu.Unlock()
+	s.setStatus(StatusError)
+	return err
+}
 
-	err := filepath.Walk(projectsDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
+// scanLocalFiles 全量扫描同步根下的本地文件, 更新状态库中的本地文件信息
+func (s *SyncService) scanLocalFiles() error {
+	seen := make(map[string]bool)
+
+	walk := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
 			return nil
 		}
-
 		relPath, _ := filepath.Rel(s.claudeDir, path)
-		data, err := os.ReadFile(path)
-		if err != nil {
+		if s.excluded(relPath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
 			return nil
 		}
 
-		hash := sha256.Sum256(data)
-		hashStr := hex.EncodeToString(hash[:])
+		seen[relPath] = true
+		s.refreshFile(relPath, info)
+		return nil
+	}
+	for _, root := range s.SyncRoots() {
+		if err := filepath.Walk(filepath.Join(s.claudeDir, filepath.FromSlash(root)), walk); err != nil {
+			return err
+		}
+	}
 
-		s.mu.RLock()
-		oldHash := s.fileHashes[relPath]
-		s.mu.RUnlock()
+	// 状态库中有但磁盘上已不存在的文件; 被规则排除的文件只从状态库中移除, 不删除服务器上的文件
+	for _, relPath := range s.state.Paths() {
+		switch {
+		case seen[relPath]:
+		case s.excluded(relPath, false):
+			s.state.Delete(relPath)
+		default:
+			s.refreshFile(relPath, nil)
+		}
+	}
+	return nil
+}
 
-		remotePath := s.reversePathMapping(relPath)
+// refreshLocalFiles 只刷新发生变化的路径 (文件或目录)
+func (s *SyncService) refreshLocalFiles(changed []string) {
+	for _, path := range changed {
+		relPath, err := filepath.Rel(s.claudeDir, path)
+		if err != nil || strings.HasPrefix(relPath, "..") || s.excluded(relPath, false) {
+			continue
+		}
 
-		fileInfo := FileInfo{
-			Path:    remotePath,
-			Hash:    hashStr,
-			ModTime: info.ModTime().Unix(),
-			Size:    info.Size(),
+		info, err := os.Stat(path)
+		switch {
+		case err != nil:
+			// 已删除: 可能是文件, 也可能是整个目录
+			prefix := relPath + string(filepath.Separator)
+			for _, p := range s.state.Paths() {
+				if (p == relPath || strings.HasPrefix(p, prefix)) && !s.excluded(p, false) {
+					s.refreshFile(p, nil)
+				}
+			}
+		case info.IsDir():
+			filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return nil
+				}
+				rel, _ := filepath.Rel(s.claudeDir, p)
+				excluded := s.excluded(rel, fi.IsDir())
+				switch {
+				case fi.IsDir() && excluded:
+					return filepath.SkipDir
+				case !fi.IsDir() && !excluded:
+					s.refreshFile(rel, fi)
+				}
+				return nil
+			})
+		default:
+			s.refreshFile(relPath, info)
 		}
+	}
+}
+
+// refreshFile 更新单个文件的本地信息; info 为 nil 表示文件已不存在
+func (s *SyncService) refreshFile(relPath string, info os.FileInfo) {
+	st, ok := s.state.Get(relPath)
 
-		if oldHash != hashStr {
-			fileInfo.Content = s.reverseContentPathMapping(data)
-			s.mu.Lock()
-			s.fileHashes[relPath] = hashStr
-			s.mu.Unlock()
+	if info == nil {
+		if !ok {
+			return
 		}
+		if !st.Synced() {
+			s.state.Delete(relPath)
+			return
+		}
+		if st.Hash != "" {
+			st.Hash, st.ModTime, st.Size = "", 0, 0
+			s.state.Put(relPath, st)
+		}
+		return
+	}
 
-		files = append(files, fileInfo)
-		totalSize += info.Size()
-		return nil
-	})
+	// 修改时间和大小都没变时直接使用缓存的哈希, 不再读取文件
+	modTime := info.ModTime().UnixNano()
+	if st.Hash != "" && st.ModTime == modTime && st.Size == info.Size() && (st.WireSize > 0 || st.Size == 0) {
+		return
+	}
+	f, err := s.readLocalFile(relPath)
+	if err != nil {
+		return
+	}
+	st.ModTime = modTime
+	st.Size = info.Size()
+	st.Hash = f.Hash
+	st.WireSize = f.Size
+	s.state.Put(relPath, st)
+}
 
-	return files, totalSize, err
+// localManifest 根据状态库生成本地文件清单 (不含内容)
+func (s *SyncService) localManifest() ([]FileInfo, int64) {
+	var files []FileInfo
+	var totalSize int64
+	for relPath, st := range s.state.Snapshot() {
+		if st.Hash == "" {
+			continue
+		}
+		files = append(files, FileInfo{
+			Path:     s.remotePath(relPath),
+			Hash:     st.Hash,
+			ModTime:  st.ModTime / int64(time.Second),
+			Size:     st.WireSize,
+			BaseRev:  st.Rev,
+			BaseHash: st.SyncedHash,
+		})
+		totalSize += st.Size
+	}
+	return files, totalSize
 }
 
-func (s *SyncService) sendSyncRequest(req SyncRequest) ([]FileInfo, error) {
-	data, err := json.Marshal(req)
-	if err != nil {
-		return nil, err
+// markSynced 记录文件已与服务器版本一致
+func (s *SyncService) markSynced(f FileInfo) {
+	localPath := s.localPath(f.Path)
+	if localPath == "" {
+		return
 	}
+	st, _ := s.state.Get(localPath)
+	st.SyncedHash = f.Hash
+	st.SyncedSize = f.Size
+	st.Rev = f.Rev
+	st.SyncedAt = time.Now().Unix()
+	s.state.Put(localPath, st)
+}
 
-	httpReq, err := http.NewRequest("POST", s.config.ServerURL+"/sync", bytes.NewReader(data))
-	if err != nil {
-		return nil, err
+// localDeletions 根据状态库找出上次同步后在本地删除的文件
+func (s *SyncService) localDeletions() []Tombstone {
+	var deleted []Tombstone
+	now := time.Now().Unix()
+	for relPath, st := range s.state.Snapshot() {
+		if st.Synced() && st.Hash == "" {
+			deleted = append(deleted, Tombstone{
+				Path:      s.remotePath(relPath),
+				Hash:      st.SyncedHash,
+				DeletedAt: now,
+				MachineID: s.config.MachineID,
+			})
+		}
 	}
+	return deleted
+}
 
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", "Bearer "+s.config.Token)
+// applyRemoteDeletions 删除已在其他机器上删除的文件; 本地有未同步的修改时保留
+func (s *SyncService) applyRemoteDeletions(tombstones []Tombstone) {
+	for _, t := range tombstones {
+		localPath := s.localPath(t.Path)
+		st, ok := s.state.Get(localPath)
+		if !ok || st.Hash != t.Hash {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.claudeDir, localPath)); err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		s.state.Delete(localPath)
+	}
+}
 
-	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(httpReq)
+// readLocalFile 读取本地文件, 返回传输用的内容 (已过滤敏感信息并做路径映射) 及其哈希;
+// 处理方式为 block 时包含敏感信息的文件返回原内容, 由 uploadBatches 跳过
+func (s *SyncService) readLocalFile(relPath string) (FileInfo, error) {
+	path := filepath.Join(s.claudeDir, relPath)
+	info, err := os.Stat(path)
 	if err != nil {
-		return nil, err
+		return FileInfo{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return FileInfo{}, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+	data = s.redactLocal(relPath, data)
+	content := s.reverseContentPathMapping(relPath, data)
+	if s.cipher != nil {
+		content = s.cipher.encryptContent(content)
 	}
 
-	var syncResp SyncResponse
-	if err := json.NewDecoder(resp.Body).Decode(&syncResp); err != nil {
-		return nil, err
+	return FileInfo{
+		Path:    s.remotePath(relPath),
+		Hash:    hashBytes(content),
+		ModTime: info.ModTime().Unix(),
+		Size:    int64(len(content)),
+		Content: content,
+	}, nil
+}
+
+// uploadFiles 上传服务器需要的文件, 追加传输失败的文件退回完整上传
+func (s *SyncService) uploadFiles(paths []string) (UploadResponse, error) {
+	result, err := s.uploadBatches(paths, true)
+	if err != nil || len(result.Retry) == 0 {
+		return result, err
+	}
+	more, err := s.uploadBatches(result.Retry, false)
+	result.Saved = append(result.Saved, more.Saved...)
+	result.Merged = append(result.Merged, more.Merged...)
+	result.Conflicts = append(result.Conflicts, more.Conflicts...)
+	result.Retry = more.Retry
+	return result, err
+}
+
+// uploadBatches 分批上传文件, 汇总各批次的结果; allowDelta 为 true 时对追加写入的文件只上传新增部分
+func (s *SyncService) uploadBatches(paths []string, allowDelta bool) (UploadResponse, error) {
+	var result UploadResponse
+	var batch []FileInfo
+	var batchSize int64
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var resp UploadResponse
+		req := UploadRequest{MachineID: s.config.MachineID, Files: batch}
+		if err := s.postJSON("/sync/upload", req, &resp); err != nil {
+			return err
+		}
+		if !resp.Success {
+			return errors.New(resp.Message)
+		}
+		for _, f := range resp.Saved {
+			s.markSynced(f)
+		}
+		result.Saved = append(result.Saved, resp.Saved...)
+		result.Retry = append(result.Retry, resp.Retry...)
+		result.Merged = append(result.Merged, resp.Merged...)
+		result.Conflicts = append(result.Conflicts, resp.Conflicts...)
+		batch = nil
+		batchSize = 0
+		return nil
 	}
 
-	if !syncResp.Success {
-		return nil, fmt.Errorf(syncResp.Message)
+	for _, remotePath := range paths {
+		localPath := s.localPath(remotePath)
+		if localPath == "" {
+			continue
+		}
+		f, err := s.readLocalFile(localPath)
+		if err != nil || s.uploadBlocked(localPath) {
+			continue
+		}
+		if st, ok := s.state.Get(localPath); ok && st.Synced() {
+			f.BaseRev = st.Rev
+			if allowDelta {
+				f, _ = makeAppendDelta(f, st.SyncedHash, st.SyncedSize)
+			}
+		}
+
+		size := int64(len(f.Content))
+		if batchSize+size > maxBatchSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+		batch = append(batch, f)
+		batchSize += size
 	}
 
-	return syncResp.Files, nil
+	err := flush()
+	return result, err
+}
+
+// downloadFiles 下载服务器要发送的文件, 追加传输失败的文件退回完整下载
+func (s *SyncService) downloadFiles(files []FileInfo) (int, error) {
+	downloaded, retry, err := s.downloadBatches(files, true)
+	if err != nil || len(retry) == 0 {
+		return downloaded, err
+	}
+	n, _, err := s.downloadBatches(retry, false)
+	return downloaded + n, err
 }
 
-// 路径映射相关
-func (s *SyncService) applyPathMapping(path string) string {
-	for remote, local := range s.config.PathMappings {
-		if strings.Contains(path, remote) {
-			return strings.Replace(path, remote, local, 1)
+// downloadBatches 分批下载文件; allowDelta 为 true 时告知服务器本地当前内容, 以便只下载追加的部分
+func (s *SyncService) downloadBatches(files []FileInfo, allowDelta bool) (int, []FileInfo, error) {
+	downloaded := 0
+	var retry []FileInfo
+	var batch []FileInfo
+	var batchSize int64
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var resp DownloadResponse
+		req := DownloadRequest{MachineID: s.config.MachineID, Files: batch}
+		if err := s.postJSON("/sync/download", req, &resp); err != nil {
+			return err
+		}
+		if !resp.Success {
+			return errors.New(resp.Message)
+		}
+		for _, f := range resp.Files {
+			err := s.writeLocalFile(f)
+			switch {
+			case err == nil:
+				downloaded++
+			case err == errBaseMismatch:
+				retry = append(retry, FileInfo{Path: f.Path, Size: f.Size})
+			}
+		}
+		batch = nil
+		batchSize = 0
+		return nil
+	}
+
+	for _, f := range files {
+		if len(batch) > 0 && batchSize+f.Size > maxBatchSize {
+			if err := flush(); err != nil {
+				return downloaded, retry, err
+			}
+		}
+		req := FileInfo{Path: f.Path}
+		if allowDelta {
+			if st, ok := s.state.Get(s.localPath(f.Path)); ok && st.Hash != "" {
+				req.Hash = st.Hash
+				req.Size = st.WireSize
+			}
+		}
+		batch = append(batch, req)
+		if req.Size > 0 && f.Size > req.Size {
+			batchSize += f.Size - req.Size
+		} else {
+			batchSize += f.Size
 		}
 	}
-	return path
+
+	return downloaded, retry, flush()
+}
+
+// errLocalChanged 本地文件在扫描之后又被修改, 下载的内容不能覆盖它
+var errLocalChanged = errors.New("local file changed during sync")
+
+// localUnchanged 本地文件是否仍与扫描时记录的状态一致。正在运行的会话可能在扫描之后追加了记录,
+// 这时覆盖会丢失新内容: 跳过这个文件, 文件监听会触发下一次同步, 新内容上传后由服务器合并。
+// 文件不存在时 (包括冲突时已另存为副本) 写入不会丢失内容
+func (s *SyncService) localUnchanged(localPath string) bool {
+	info, err := os.Stat(filepath.Join(s.claudeDir, localPath))
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	st, ok := s.state.Get(localPath)
+	if !ok || st.Hash == "" {
+		return false
+	}
+	if st.ModTime == info.ModTime().UnixNano() && st.Size == info.Size() {
+		return true
+	}
+	// 修改时间变了但内容可能没变 (例如被重新保存), 以传输内容的哈希为准
+	f, err := s.readLocalFile(localPath)
+	return err == nil && f.Hash == st.Hash
 }
 
-func (s *SyncService) reversePathMapping(path string) string {
-	for remote, local := range s.config.PathMappings {
-		if strings.Contains(path, local) {
-			return strings.Replace(path, local, remote, 1)
+// writeLocalFile 将服务器发来的文件写入本地; 本地文件在扫描之后被修改时返回 errLocalChanged
+func (s *SyncService) writeLocalFile(f FileInfo) error {
+	localPath := s.localPath(f.Path)
+	if localPath == "" {
+		return fmt.Errorf("无法解析文件路径: %s", f.Path)
+	}
+	destPath := filepath.Join(s.claudeDir, localPath)
+
+	wire := f.Content
+	if f.Offset > 0 {
+		// 追加传输: 以本地当前内容为基准拼接
+		base, err := s.readLocalFile(localPath)
+		if err != nil {
+			return errBaseMismatch
+		}
+		if wire, err = applyAppendDelta(base.Content, f); err != nil {
+			return err
+		}
+	} else if hashBytes(wire) != f.Hash {
+		return fmt.Errorf("文件校验失败: %s", f.Path)
+	}
+
+	plain := wire
+	if s.cipher != nil {
+		var err error
+		if plain, err = s.cipher.decryptContent(wire); err != nil {
+			return fmt.Errorf("无法解密文件: %s", localPath)
 		}
 	}
-	return path
+	content := s.applyContentPathMapping(localPath, plain)
+	// 服务器发回的本机内容中敏感信息已被替换, 写入前还原为本地原文
+	if local, err := os.ReadFile(destPath); err == nil {
+		content = s.restoreRedacted(localPath, local, content)
+	}
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return err
+	}
+	if !s.localUnchanged(localPath) {
+		fmt.Printf("[%s] 本地文件在同步期间被修改, 暂不覆盖: %s\n", time.Now().Format("15:04:05"), localPath)
+		return errLocalChanged
+	}
+	if err := s.replaceLocalFile(localPath, destPath, content, f.ModTime); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(destPath)
+	if err != nil {
+		return err
+	}
+	st, _ := s.state.Get(localPath)
+	st.ModTime = info.ModTime().UnixNano()
+	st.Size = info.Size()
+	st.Hash = f.Hash
+	st.WireSize = int64(len(wire))
+	s.state.Put(localPath, st)
+
+	f.Size = int64(len(wire))
+	s.markSynced(f)
+	return nil
+}
+
+// replaceLocalFile 替换本地文件: 先写入同目录的临时文件, 重命名之前再次确认本地文件没有被修改
+// (写入临时文件期间可能正有会话在追加记录), 中途失败不会留下只写了一半的文件
+func (s *SyncService) replaceLocalFile(localPath, destPath string, content []byte, modTime int64) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(destPath); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(destPath), syncTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	// 保留来源机器的修改时间, 否则下载的文件会被当作本地新修改
+	if modTime > 0 {
+		mt := time.Unix(modTime, 0)
+		os.Chtimes(tmp.Name(), mt, mt)
+	}
+
+	if !s.localUnchanged(localPath) {
+		fmt.Printf("[%s] 本地文件在同步期间被修改, 暂不覆盖: %s\n", time.Now().Format("15:04:05"), localPath)
+		return errLocalChanged
+	}
+	return os.Rename(tmp.Name(), destPath)
+}
+
+// postJSON 向服务器发送 JSON 请求并解析响应
+func (s *SyncService) postJSON(endpoint string, req, out interface{}) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", s.config.ServerURL+endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	return s.doJSON(httpReq, out)
 }
 
-func (s *SyncService) applyContentPathMapping(content []byte) []byte {
-	result := string(content)
-	for remote, local := range s.config.PathMappings {
-		result = strings.ReplaceAll(result, remote, local)
+// getJSON 向服务器发送 GET 请求并解析 JSON 响应
+func (s *SyncService) getJSON(endpoint string, out interface{}) error {
+	httpReq, err := http.NewRequest("GET", s.config.ServerURL+endpoint, nil)
+	if err != nil {
+		return err
 	}
-	return []byte(result)
+	return s.doJSON(httpReq, out)
 }
 
-func (s *SyncService) reverseContentPathMapping(content []byte) []byte {
-	result := string(content)
-	for remote, local := range s.config.PathMappings {
-		result = strings.ReplaceAll(result, local, remote)
+// doJSON 使用设备凭据 (尚未注册时使用租户令牌) 发送请求并解析 JSON 响应
+func (s *SyncService) doJSON(httpReq *http.Request, out interface{}) error {
+	token := s.config.DeviceToken
+	if token == "" {
+		token = s.config.Token
+	}
+	if token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	httpReq.Header.Set(machineIDHeader, s.config.MachineID)
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusUnauthorized && strings.HasPrefix(string(body), "Device revoked") {
+			return fmt.Errorf("本机的设备凭据已被撤销, 请在设置中重新输入认证令牌")
+		}
+		return &httpError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
-	return []byte(result)
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// httpError 服务器返回的错误响应
+type httpError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
 }
 
 // CheckConnection 检查服务器连接
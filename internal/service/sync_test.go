@@ -0,0 +1,202 @@
+package service
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/k0ngk0ng/claude-sync/internal/config"
+)
+
+// newTestSyncService 创建使用临时目录的同步服务, 不连接服务器
+func newTestSyncService(t *testing.T, cfg *config.Config) *SyncService {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("HOME", t.TempDir()) // 保存配置时不写入真实的 ~/.claude
+	state, _ := LoadStateStore(filepath.Join(dir, "sync-state.json"))
+	s := &SyncService{
+		config:       cfg,
+		claudeDir:    dir,
+		state:        state,
+		stopChan:     make(chan struct{}),
+		scopeChanged: make(chan struct{}, 1),
+	}
+	s.loadRules()
+	s.loadPathMappings()
+	return s
+}
+
+// newTestServer 创建带默认租户的服务器并通过 httptest 提供接口
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	s, err := NewServer(0, t.TempDir(), "tenant-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(func() {
+		ts.Close()
+		s.Close()
+	})
+	return s, ts
+}
+
+// newTestClient 创建连接到测试服务器的同步服务, 使用默认租户签发的设备凭据
+func newTestClient(t *testing.T, s *Server, ts *httptest.Server, machineID string) *SyncService {
+	t.Helper()
+	token, err := s.EnrollDevice(s.tenants["default"], machineID, machineID, "", Scope{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestSyncService(t, &config.Config{
+		ServerURL:   ts.URL,
+		DeviceToken: token,
+		MachineID:   machineID,
+		MachineName: machineID,
+	})
+	c.loadRedactor()
+	return c
+}
+
+// restartTestClient 模拟程序重新启动: 从磁盘重新加载状态库, 使用新的配置
+func restartTestClient(t *testing.T, c *SyncService, cfg *config.Config) *SyncService {
+	t.Helper()
+	if err := c.state.Save(); err != nil {
+		t.Fatal(err)
+	}
+	state, err := LoadStateStore(c.state.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &SyncService{
+		config:       cfg,
+		claudeDir:    c.claudeDir,
+		state:        state,
+		stopChan:     make(chan struct{}),
+		scopeChanged: make(chan struct{}, 1),
+	}
+	s.loadRedactor()
+	s.loadRules()
+	s.loadPathMappings()
+	return s
+}
+
+func appendTestFile(t *testing.T, s *SyncService, rel, content string) {
+	t.Helper()
+	f, err := os.OpenFile(filepath.Join(s.claudeDir, rel), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestFile(t *testing.T, s *SyncService, rel, content string) {
+	t.Helper()
+	p := filepath.Join(s.claudeDir, rel)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, s *SyncService, rel string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(s.claudeDir, rel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func remoteFile(path, content string) FileInfo {
+	return FileInfo{Path: path, Content: []byte(content), Hash: hashBytes([]byte(content)), Size: int64(len(content))}
+}
+
+func TestWriteLocalFileKeepsLinesAppendedAfterScan(t *testing.T) {
+	s := newTestSyncService(t, &config.Config{})
+	rel := filepath.Join("projects", "p", "s.jsonl")
+	writeTestFile(t, s, rel, "line1\n")
+	if err := s.scanLocalFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 扫描之后正在运行的会话又追加了一行
+	writeTestFile(t, s, rel, "line1\nline2\n")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(s.claudeDir, rel), future, future)
+
+	err := s.writeLocalFile(remoteFile("projects/p/s.jsonl", "line1\nremote\n"))
+	if err != errLocalChanged {
+		t.Fatalf("err = %v, want errLocalChanged", err)
+	}
+	if got := readTestFile(t, s, rel); got != "line1\nline2\n" {
+		t.Errorf("local file overwritten: %q", got)
+	}
+}
+
+func TestWriteLocalFileOverwritesUnchangedFile(t *testing.T) {
+	s := newTestSyncService(t, &config.Config{})
+	rel := filepath.Join("projects", "p", "s.jsonl")
+	writeTestFile(t, s, rel, "line1\n")
+	if err := s.scanLocalFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.writeLocalFile(remoteFile("projects/p/s.jsonl", "line1\nremote\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, s, rel); got != "line1\nremote\n" {
+		t.Errorf("content = %q", got)
+	}
+}
+
+func TestReplaceLocalFileRechecksBeforeRename(t *testing.T) {
+	s := newTestSyncService(t, &config.Config{})
+	rel := filepath.Join("projects", "p", "s.jsonl")
+	writeTestFile(t, s, rel, "line1\n")
+	if err := s.scanLocalFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 写入临时文件期间会话追加了一行: 不能用临时文件覆盖
+	writeTestFile(t, s, rel, "line1\nline2\n")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(s.claudeDir, rel), future, future)
+	dest := filepath.Join(s.claudeDir, rel)
+	if err := s.replaceLocalFile(rel, dest, []byte("line1\nremote\n"), 0); err != errLocalChanged {
+		t.Fatalf("err = %v, want errLocalChanged", err)
+	}
+	if got := readTestFile(t, s, rel); got != "line1\nline2\n" {
+		t.Errorf("local file overwritten: %q", got)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(dest))
+	if len(entries) != 1 {
+		t.Errorf("temporary file left behind: %v", entries)
+	}
+	if !s.rules.Excluded(filepath.Join("projects", "p", syncTempPrefix+"123"), false) {
+		t.Error("temporary files should not be synced")
+	}
+}
+
+func TestWriteLocalFileCreatesMissingFile(t *testing.T) {
+	s := newTestSyncService(t, &config.Config{})
+	if err := s.writeLocalFile(remoteFile("commands/review.md", "review\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, s, filepath.Join("commands", "review.md")); got != "review\n" {
+		t.Errorf("content = %q", got)
+	}
+
+	// 扫描之后才在本地新建的同名文件不能被覆盖
+	writeTestFile(t, s, filepath.Join("agents", "a.md"), "local\n")
+	if err := s.writeLocalFile(remoteFile("agents/a.md", "remote\n")); err != errLocalChanged {
+		t.Errorf("err = %v, want errLocalChanged", err)
+	}
+}
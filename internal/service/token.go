@@ -0,0 +1,158 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultTokenGrace 轮换令牌后旧令牌默认继续有效的时间
+const DefaultTokenGrace = 7 * 24 * time.Hour
+
+// hashToken 计算令牌的加盐哈希, 格式为 "<salt>:<hash>" (十六进制)
+func hashToken(token string) string {
+	return saltDigest(newSalt(), hashBytes([]byte(token)))
+}
+
+// saltDigest 对令牌的 SHA-256 (十六进制) 加盐再哈希; 旧版只保存了 SHA-256 的值也可以直接升级
+func saltDigest(salt []byte, digest string) string {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(digest))
+	return hex.EncodeToString(salt) + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// verifyToken 以恒定时间比较令牌与加盐哈希
+func verifyToken(token, hashed string) bool {
+	saltHex, _, ok := strings.Cut(hashed, ":")
+	if token == "" || !ok {
+		return false
+	}
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(saltDigest(salt, hashBytes([]byte(token)))), []byte(hashed)) == 1
+}
+
+func newSalt() []byte {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return salt
+}
+
+// generateToken 生成随机令牌
+func generateToken() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// matchToken 判断令牌是否属于该租户: 当前令牌, 或仍在宽限期内的旧令牌
+func (t *Tenant) matchToken(token string, now time.Time) bool {
+	if verifyToken(token, t.TokenHash) {
+		return true
+	}
+	return t.PrevTokenHash != "" && now.Before(t.PrevTokenExpiresAt) && verifyToken(token, t.PrevTokenHash)
+}
+
+// tokenInUse 判断令牌是否已被任何租户或管理员使用 (调用者需要持有锁)
+func (s *Server) tokenInUse(token string) bool {
+	if verifyToken(token, s.config.AdminTokenHash) {
+		return true
+	}
+	now := time.Now()
+	for _, t := range s.tenants {
+		if t.matchToken(token, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// RotateTenantToken 轮换租户令牌, newToken 为空时随机生成; 旧令牌在 grace 时间内继续有效,
+// 以便各客户端逐步更新配置。返回新令牌
+func (s *Server) RotateTenantToken(id, newToken string, grace time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant := s.tenants[id]
+	if tenant == nil {
+		return "", fmt.Errorf("tenant not found")
+	}
+	if newToken == "" {
+		newToken = generateToken()
+	}
+	if s.tokenInUse(newToken) {
+		return "", fmt.Errorf("token already exists")
+	}
+
+	prevHash, prevExpires := tenant.PrevTokenHash, tenant.PrevTokenExpiresAt
+	if grace > 0 {
+		tenant.PrevTokenHash = tenant.TokenHash
+		tenant.PrevTokenExpiresAt = time.Now().Add(grace)
+	} else {
+		tenant.PrevTokenHash = ""
+		tenant.PrevTokenExpiresAt = time.Time{}
+	}
+	oldHash := tenant.TokenHash
+	tenant.TokenHash = hashToken(newToken)
+
+	if err := s.saveTenant(tenant); err != nil {
+		tenant.TokenHash, tenant.PrevTokenHash, tenant.PrevTokenExpiresAt = oldHash, prevHash, prevExpires
+		return "", err
+	}
+
+	fmt.Printf("[%s] [%s] 令牌已轮换, 旧令牌有效期: %v\n", time.Now().Format("15:04:05"), tenant.Name, grace)
+	return newToken, nil
+}
+
+// handleAdminRotateToken 轮换租户令牌
+func (s *Server) handleAdminRotateToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID    string `json:"id"`
+		Token string `json:"token"` // 为空时随机生成
+		Grace string `json:"grace"` // 旧令牌继续有效的时间, 如 "24h"; 为空时使用默认值, "0" 表示立即失效
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	grace := DefaultTokenGrace
+	if req.Grace != "" {
+		var err error
+		if grace, err = time.ParseDuration(req.Grace); err != nil {
+			http.Error(w, "Invalid grace period", http.StatusBadRequest)
+			return
+		}
+	}
+
+	token, err := s.RotateTenantToken(req.ID, req.Token, grace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"token":       token,
+		"grace_until": time.Now().Add(grace),
+	})
+}
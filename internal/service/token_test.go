@@ -0,0 +1,161 @@
+package service
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashTokenIsSalted(t *testing.T) {
+	a, b := hashToken("secret"), hashToken("secret")
+	if a == b {
+		t.Fatalf("same token hashed twice gives the same value %q", a)
+	}
+	if strings.Contains(a, "secret") || strings.Contains(a, hashBytes([]byte("secret"))) {
+		t.Errorf("hash %q leaks the token or its unsalted digest", a)
+	}
+	for _, h := range []string{a, b} {
+		if !verifyToken("secret", h) {
+			t.Errorf("token does not verify against %q", h)
+		}
+		if verifyToken("Secret", h) || verifyToken("secret ", h) {
+			t.Errorf("wrong token verifies against %q", h)
+		}
+		if verifyToken("", h) {
+			t.Errorf("empty token verifies against %q", h)
+		}
+	}
+
+	salt, digest, _ := strings.Cut(a, ":")
+	for _, h := range []string{
+		"",
+		"secret",                       // 旧版明文
+		hashBytes([]byte("secret")),    // 旧版未加盐的 SHA-256
+		"zz" + salt[2:] + ":" + digest, // 盐不是十六进制
+		salt + ":" + digest[:len(digest)-1] + "0", // 哈希被改动
+		b[:strings.Index(b, ":")] + ":" + digest,  // 盐与哈希不匹配
+	} {
+		if h != a && verifyToken("secret", h) {
+			t.Errorf("token verifies against malformed hash %q", h)
+		}
+	}
+	// 空令牌即使有对应的哈希也不能通过验证
+	if verifyToken("", hashToken("")) {
+		t.Error("empty token verifies")
+	}
+}
+
+func TestLegacyPlaintextTokensMigrateOnStart(t *testing.T) {
+	dir := t.TempDir()
+	createMetaV1(t, filepath.Join(dir, metaName), "tenant-secret", "admin-secret")
+
+	s, err := NewServer(0, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { s.Close() }()
+
+	tenant, device := s.getTenantByToken("tenant-secret")
+	if tenant == nil || tenant.ID != "t1" || device != nil {
+		t.Fatalf("legacy tenant token does not authenticate: %v %v", tenant, device)
+	}
+	if strings.Contains(tenant.TokenHash, "tenant-secret") || !strings.Contains(tenant.TokenHash, ":") {
+		t.Errorf("tenant token not stored as a salted hash: %q", tenant.TokenHash)
+	}
+	if !verifyToken("admin-secret", s.config.AdminTokenHash) {
+		t.Errorf("legacy admin token does not verify against %q", s.config.AdminTokenHash)
+	}
+	if tenant, _ := s.getTenantByToken("admin-secret"); tenant != nil {
+		t.Error("admin token authenticates as a tenant")
+	}
+
+	// 重启后仍使用迁移后的哈希
+	s.Close()
+	if s, err = NewServer(0, dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	if tenant, _ := s.getTenantByToken("tenant-secret"); tenant == nil {
+		t.Error("tenant token does not authenticate after restart")
+	}
+}
+
+func TestRotateTenantTokenGrace(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewServer(0, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { s.Close() }()
+	if _, err := s.CreateTenant("t1", "T1", "old-token"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateTenant("t2", "T2", "other-token"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.RotateTenantToken("t1", "other-token", time.Hour); err == nil {
+		t.Error("rotating to another tenant's token succeeded")
+	}
+	if _, err := s.RotateTenantToken("missing", "", time.Hour); err == nil {
+		t.Error("rotating an unknown tenant succeeded")
+	}
+
+	newToken, err := s.RotateTenantToken("t1", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newToken == "" || newToken == "old-token" {
+		t.Fatalf("rotated token = %q", newToken)
+	}
+	tenant := s.tenants["t1"]
+	now := time.Now()
+	if !tenant.matchToken(newToken, now) || !tenant.matchToken("old-token", now) {
+		t.Fatal("new and old tokens should both be valid during the grace period")
+	}
+	if tenant.matchToken("old-token", tenant.PrevTokenExpiresAt) {
+		t.Error("old token still valid when the grace period ends")
+	}
+	if !tenant.matchToken(newToken, tenant.PrevTokenExpiresAt.Add(time.Hour)) {
+		t.Error("new token expires with the grace period")
+	}
+
+	// 宽限期保存在元数据库中, 重启后旧令牌仍然有效, 过期后被拒绝
+	expires := tenant.PrevTokenExpiresAt
+	s.Close()
+	if s, err = NewServer(0, dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	tenant = s.tenants["t1"]
+	if !tenant.PrevTokenExpiresAt.Equal(expires) {
+		t.Errorf("grace period after restart = %v, want %v", tenant.PrevTokenExpiresAt, expires)
+	}
+	if got, _ := s.getTenantByToken("old-token"); got != tenant {
+		t.Error("old token rejected during the grace period after restart")
+	}
+	tenant.PrevTokenExpiresAt = time.Now().Add(-time.Second)
+	if got, _ := s.getTenantByToken("old-token"); got != nil {
+		t.Error("old token accepted after the grace period")
+	}
+	if got, _ := s.getTenantByToken(newToken); got != tenant {
+		t.Error("new token rejected")
+	}
+
+	// 不留宽限期时旧令牌立即失效, 上一次轮换留下的旧令牌也一并失效
+	tenant.PrevTokenExpiresAt = time.Now().Add(time.Hour)
+	latest, err := s.RotateTenantToken("t1", "latest-token", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"old-token", newToken} {
+		if got, _ := s.getTenantByToken(token); got != nil {
+			t.Errorf("token %q still accepted after rotating without grace", token)
+		}
+	}
+	if got, _ := s.getTenantByToken(latest); got != tenant {
+		t.Error("latest token rejected")
+	}
+	if tenant.PrevTokenHash != "" || !tenant.PrevTokenExpiresAt.IsZero() {
+		t.Errorf("previous token kept: %q until %v", tenant.PrevTokenHash, tenant.PrevTokenExpiresAt)
+	}
+}
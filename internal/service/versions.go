@@ -0,0 +1,413 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 历史版本默认保留策略: 每个文件至少保留最近 N 个版本, 以及时间窗口内被替换的所有版本
+const (
+	DefaultKeepVersions     = 20
+	DefaultVersionRetention = 7 * 24 * time.Hour
+)
+
+// versionIndexName 旧版每个文件的历史版本索引文件名
+const versionIndexName = "index.json"
+
+// FileVersion 文件的一个历史版本
+type FileVersion struct {
+	Rev        int64  `json:"rev"`               // 该版本的版本号 (写入时间, 纳秒); 删除记录为删除时间
+	Hash       string `json:"hash,omitempty"`    // 内容哈希
+	Size       int64  `json:"size,omitempty"`    // 内容大小
+	ArchivedAt int64  `json:"archived_at"`       // 被新版本替换的时间
+	Prefix     bool   `json:"prefix,omitempty"`  // 追加写入前的版本, 内容为下一个完整版本的前 Size 字节, 不单独存储
+	Deleted    bool   `json:"deleted,omitempty"` // 文件在此时被删除
+}
+
+// VersionList 文件的当前版本和历史版本
+type VersionList struct {
+	Path     string        `json:"path"`
+	Current  *FileInfo     `json:"current,omitempty"` // 文件已删除时为空
+	Versions []FileVersion `json:"versions"`          // 按版本号从新到旧排列
+}
+
+// RestoreRequest 恢复历史版本请求
+type RestoreRequest struct {
+	Path string `json:"path"`
+	Rev  int64  `json:"rev"`
+}
+
+// SetVersionRetention 设置历史版本保留策略; 版本在最近 keep 个之内或替换时间在 window 之内时保留
+func (s *Server) SetVersionRetention(keep int, window time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keepVersions = keep
+	s.versionRetention = window
+}
+
+// versionPrefix 获取旧版文件历史版本的存储键前缀
+func (s *Server) versionPrefix(tenant *Tenant, path string) string {
+	return "versions/" + tenant.ID + "/" + filepath.ToSlash(path) + "/"
+}
+
+// loadVersions 获取文件的历史版本 (按版本号从旧到新) 的副本
+func (s *Server) loadVersions(tenant *Tenant, path string) []FileVersion {
+	return append([]FileVersion(nil), tenant.Versions[path]...)
+}
+
+// saveVersions 按保留策略清理后更新历史版本, 在下次 saveTenant 时写入元数据库
+func (s *Server) saveVersions(tenant *Tenant, path string, versions []FileVersion) error {
+	versions = s.pruneVersions(tenant, versions)
+	if len(versions) == 0 {
+		delete(tenant.Versions, path)
+	} else {
+		tenant.Versions[path] = versions
+	}
+	tenant.markDirty(path)
+	return nil
+}
+
+// pruneVersions 删除超出保留策略的旧版本并释放其内容。追加写入前的版本没有单独的内容,
+// 它读取的完整版本即使超出保留策略也继续保留 (导入或合并的历史中替换时间不一定递增)
+func (s *Server) pruneVersions(tenant *Tenant, versions []FileVersion) []FileVersion {
+	cutoff := time.Now().Add(-s.versionRetention).Unix()
+	keep := make([]bool, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		fromNewest := len(versions) - 1 - i
+		if fromNewest < s.keepVersions || (s.versionRetention > 0 && versions[i].ArchivedAt >= cutoff) {
+			keep[i] = true
+		}
+		if keep[i] && versions[i].Prefix {
+			if src := prefixSource(versions, i); src >= 0 {
+				keep[src] = true
+			}
+		}
+	}
+
+	var kept []FileVersion
+	for i, v := range versions {
+		switch {
+		case keep[i]:
+			kept = append(kept, v)
+		case !v.Prefix && !v.Deleted:
+			tenant.blobs.Release(v.Hash)
+		}
+	}
+	return kept
+}
+
+// prefixSource 返回追加写入前的版本 i 读取内容的完整版本: 之后第一个不短于它的完整版本;
+// 没有时读取当前文件, 返回 -1
+func prefixSource(versions []FileVersion, i int) int {
+	for j := i + 1; j < len(versions); j++ {
+		if next := versions[j]; !next.Prefix && !next.Deleted && next.Size >= versions[i].Size {
+			return j
+		}
+	}
+	return -1
+}
+
+// archiveVersion 在文件被覆盖或删除后记录被替换的版本 (调用者需要持有锁)。
+// 完整版本继续持有当前版本对内容的引用; 追加写入不会破坏旧内容, 只记录版本信息
+func (s *Server) archiveVersion(tenant *Tenant, existing FileInfo, appendOnly bool) error {
+	v := FileVersion{
+		Rev:        existing.Rev,
+		Hash:       existing.Hash,
+		Size:       existing.Size,
+		ArchivedAt: time.Now().Unix(),
+		Prefix:     appendOnly,
+	}
+	versions := append(s.loadVersions(tenant, existing.Path), v)
+	return s.saveVersions(tenant, existing.Path, versions)
+}
+
+// recordDeletion 记录文件被删除的时间, 用于按时间点回滚
+func (s *Server) recordDeletion(tenant *Tenant, path string, at time.Time) error {
+	versions := append(s.loadVersions(tenant, path), FileVersion{
+		Rev:        at.UnixNano(),
+		ArchivedAt: at.Unix(),
+		Deleted:    true,
+	})
+	return s.saveVersions(tenant, path, versions)
+}
+
+// readVersion 读取历史版本的内容 (调用者需要持有锁)
+func (s *Server) readVersion(tenant *Tenant, path string, versions []FileVersion, i int) ([]byte, error) {
+	v := versions[i]
+	if v.Deleted {
+		return nil, fmt.Errorf("version %d is a deletion", v.Rev)
+	}
+
+	// 追加写入前的版本: 内容是之后某个完整版本 (或当前文件) 的前缀, 通常是第一个;
+	// 合并过的历史 (见 migrateWirePaths) 中可能是更后面的版本, 依次尝试
+	var sources []string
+	for _, next := range versions[i:] {
+		if !next.Prefix && !next.Deleted && next.Size >= v.Size {
+			sources = append(sources, next.Hash)
+		}
+	}
+	if f, ok := tenant.Files[path]; ok {
+		sources = append(sources, f.Hash)
+	}
+
+	err := fmt.Errorf("version %d is incomplete", v.Rev)
+	for _, source := range sources {
+		content, readErr := tenant.blobs.Read(source)
+		switch {
+		case readErr != nil:
+			err = readErr
+		case int64(len(content)) < v.Size:
+		case hashBytes(content[:v.Size]) != v.Hash:
+			err = fmt.Errorf("version %d is corrupted", v.Rev)
+		default:
+			return content[:v.Size], nil
+		}
+	}
+	return nil, err
+}
+
+// restoreVersion 将文件恢复为历史版本 (调用者需要持有锁); 恢复本身也会生成新版本, 可以再次撤销
+func (s *Server) restoreVersion(tenant *Tenant, path string, rev int64) (FileInfo, error) {
+	versions := s.loadVersions(tenant, path)
+	idx := -1
+	for i, v := range versions {
+		if v.Rev == rev && !v.Deleted {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return FileInfo{}, fmt.Errorf("version not found")
+	}
+	content, err := s.readVersion(tenant, path, versions, idx)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	f := FileInfo{
+		Path:    path,
+		Hash:    versions[idx].Hash,
+		ModTime: time.Now().Unix(),
+		Size:    int64(len(content)),
+		Content: content,
+	}
+	if f.Rev, err = s.saveTenantFile(tenant, f); err != nil {
+		return FileInfo{}, err
+	}
+	f.Content = nil
+	tenant.Files[path] = f
+	delete(tenant.Tombstones, path)
+	return f, nil
+}
+
+// importLegacyVersions 读取旧版的历史版本索引; 更早单独存放的历史版本文件移入内容存储
+func (s *Server) importLegacyVersions(tenant *Tenant) error {
+	root := "versions/" + tenant.ID + "/"
+	keys, err := s.store.List(root)
+	if err != nil {
+		return err
+	}
+	legacy := make(map[string]bool)
+	for _, key := range keys {
+		legacy[key] = true
+	}
+
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "/"+versionIndexName) {
+			continue
+		}
+		data, err := s.store.Get(key)
+		if err != nil {
+			return err
+		}
+		var versions []FileVersion
+		if json.Unmarshal(data, &versions) != nil {
+			continue
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i].Rev < versions[j].Rev })
+
+		prefix := strings.TrimSuffix(key, versionIndexName)
+		for _, v := range versions {
+			if v.Prefix || v.Deleted {
+				continue
+			}
+			if content := prefix + strconv.FormatInt(v.Rev, 10); legacy[content] {
+				tenant.blobs.Import(v.Hash, content)
+			}
+		}
+		path := strings.TrimSuffix(strings.TrimPrefix(prefix, root), "/")
+		tenant.Versions[path] = versions
+	}
+	return nil
+}
+
+// RollbackTenant 将租户的所有文件回滚到指定时间点, 返回恢复和删除的文件数。
+// 当时不存在 (或历史已被清理) 的文件会被删除; 回滚前的版本都会保留, 可以再次回滚
+func (s *Server) RollbackTenant(id string, at time.Time) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant := s.tenants[id]
+	if tenant == nil {
+		return 0, 0, fmt.Errorf("tenant not found")
+	}
+
+	paths := make(map[string]bool)
+	for path := range tenant.Files {
+		paths[path] = true
+	}
+	for path := range tenant.Versions {
+		paths[path] = true
+	}
+
+	target := at.UnixNano()
+	restored, deleted := 0, 0
+	for path := range paths {
+		current, exists := tenant.Files[path]
+		if exists && current.Rev <= target {
+			continue
+		}
+
+		// 找到该时间点之前最后一个版本
+		versions := s.loadVersions(tenant, path)
+		idx := -1
+		for i, v := range versions {
+			if v.Rev <= target {
+				idx = i
+			}
+		}
+
+		switch {
+		case idx < 0 || versions[idx].Deleted:
+			if !exists {
+				continue
+			}
+			if err := s.removeTenantFile(tenant, path, "admin"); err != nil {
+				return restored, deleted, err
+			}
+			deleted++
+		case exists && current.Hash == versions[idx].Hash:
+			continue
+		default:
+			if _, err := s.restoreVersion(tenant, path, versions[idx].Rev); err != nil {
+				return restored, deleted, fmt.Errorf("%s: %v", path, err)
+			}
+			restored++
+		}
+	}
+
+	s.saveTenant(tenant)
+	fmt.Printf("[%s] [%s] 回滚到 %s: 恢复 %d 个文件, 删除 %d 个文件\n",
+		time.Now().Format("15:04:05"), tenant.Name, at.Format("2006-01-02 15:04:05"), restored, deleted)
+	return restored, deleted, nil
+}
+
+// handleVersions 列出文件的历史版本
+func (s *Server) handleVersions(w http.ResponseWriter, r *http.Request, tenant *Tenant) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := syncPath(r.URL.Query().Get("path"))
+	if path == "" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if scope := requestScope(r); !scope.CanRead() || !scope.Allows(path) {
+		http.Error(w, "Token scope does not allow this path", http.StatusForbidden)
+		return
+	}
+
+	s.mu.RLock()
+	list := VersionList{Path: path, Versions: []FileVersion{}}
+	if f, ok := tenant.Files[path]; ok {
+		list.Current = &f
+	}
+	versions := s.loadVersions(tenant, path)
+	s.mu.RUnlock()
+
+	for i := len(versions) - 1; i >= 0; i-- {
+		list.Versions = append(list.Versions, versions[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleVersionRestore 将文件恢复为指定的历史版本
+func (s *Server) handleVersionRestore(w http.ResponseWriter, r *http.Request, tenant *Tenant) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Path = syncPath(req.Path); req.Path == "" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if scope := requestScope(r); !scope.CanWrite() || !scope.Allows(req.Path) {
+		http.Error(w, "Token scope does not allow this path", http.StatusForbidden)
+		return
+	}
+
+	s.mu.Lock()
+	f, err := s.restoreVersion(tenant, req.Path, req.Rev)
+	if err == nil {
+		s.saveTenant(tenant)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	fmt.Printf("[%s] [%s] 恢复历史版本: %s @ %d\n",
+		time.Now().Format("15:04:05"), tenant.Name, req.Path, req.Rev)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"file":    f,
+	})
+}
+
+// handleAdminRollback 将租户回滚到指定时间点
+func (s *Server) handleAdminRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID   string `json:"id"`
+		Time int64  `json:"time"` // Unix 时间戳 (秒)
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	restored, deleted, err := s.RollbackTenant(req.ID, time.Unix(req.Time, 0))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"restored": restored,
+		"deleted":  deleted,
+	})
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+// putTestVersion 将文件写为 content; offset > 0 时只上传 offset 之后追加的部分
+func putTestVersion(t *testing.T, s *Server, tenant *Tenant, path, content string, offset int) {
+	t.Helper()
+	f := FileInfo{
+		Path:    path,
+		Hash:    hashBytes([]byte(content)),
+		Size:    int64(len(content)),
+		Content: []byte(content[offset:]),
+		Offset:  int64(offset),
+	}
+	rev, err := s.saveTenantFile(tenant, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Rev, f.Content, f.Offset = rev, nil, 0
+	tenant.Files[path] = f
+}
+
+func newTestVersionTenant(t *testing.T, keep int, window time.Duration) (*Server, *Tenant) {
+	t.Helper()
+	s, err := NewServer(0, t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	s.SetVersionRetention(keep, window)
+	tenant, err := s.CreateTenant("t1", "T1", "tenant-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, tenant
+}
+
+// readTestVersions 读取所有历史版本的内容, 删除记录为 "-"
+func readTestVersions(t *testing.T, s *Server, tenant *Tenant, path string) []string {
+	t.Helper()
+	versions := s.loadVersions(tenant, path)
+	var contents []string
+	for i, v := range versions {
+		if v.Deleted {
+			contents = append(contents, "-")
+			continue
+		}
+		content, err := s.readVersion(tenant, path, versions, i)
+		if err != nil {
+			t.Fatalf("version %d (%+v): %v", i, v, err)
+		}
+		contents = append(contents, string(content))
+	}
+	return contents
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReadVersionReconstructsPrefix(t *testing.T) {
+	s, tenant := newTestVersionTenant(t, 10, 0)
+	const path = "projects/p/s.jsonl"
+
+	putTestVersion(t, s, tenant, path, "a\n", 0)
+	putTestVersion(t, s, tenant, path, "a\nb\n", 2)
+	putTestVersion(t, s, tenant, path, "a\nb\nc\n", 4)
+
+	// 两个追加写入前的版本都从当前文件读取
+	versions := s.loadVersions(tenant, path)
+	if len(versions) != 2 || !versions[0].Prefix || !versions[1].Prefix {
+		t.Fatalf("versions = %+v", versions)
+	}
+	if got, want := readTestVersions(t, s, tenant, path), []string{"a\n", "a\nb\n"}; !equalStrings(got, want) {
+		t.Errorf("versions = %q, want %q", got, want)
+	}
+
+	// 覆盖和删除后从被替换的完整版本读取
+	putTestVersion(t, s, tenant, path, "x\n", 0)
+	if err := s.removeTenantFile(tenant, path, "m1"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a\n", "a\nb\n", "a\nb\nc\n", "x\n", "-"}
+	if got := readTestVersions(t, s, tenant, path); !equalStrings(got, want) {
+		t.Errorf("versions = %q, want %q", got, want)
+	}
+
+	f, err := s.restoreVersion(tenant, path, s.loadVersions(tenant, path)[1].Rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := tenant.blobs.Read(f.Hash); err != nil || string(content) != "a\nb\n" {
+		t.Errorf("restored content = %q, %v", content, err)
+	}
+}
+
+func TestReadVersionRejectsMismatchedSource(t *testing.T) {
+	s, tenant := newTestVersionTenant(t, 10, 0)
+	const path = "projects/p/s.jsonl"
+
+	putTestVersion(t, s, tenant, path, "a\n", 0)
+	putTestVersion(t, s, tenant, path, "a\nb\n", 2)
+
+	// 当前文件被替换为不以旧版本开头的内容 (例如合并过的历史), 旧版本无法还原
+	putTestVersion(t, s, tenant, path, "x\ny\n", 0)
+	other := []byte("zz\n")
+	if err := tenant.blobs.Put(hashBytes(other), other); err != nil {
+		t.Fatal(err)
+	}
+	versions := s.loadVersions(tenant, path)
+	versions = []FileVersion{versions[0], {Rev: versions[1].Rev, Hash: hashBytes(other), Size: int64(len(other))}}
+	if _, err := s.readVersion(tenant, path, versions, 0); err == nil {
+		t.Error("prefix version read from unrelated content")
+	}
+}
+
+func TestPruneVersionsReleasesDroppedContent(t *testing.T) {
+	s, tenant := newTestVersionTenant(t, 2, 0)
+	const path = "projects/p/s.jsonl"
+
+	for _, content := range []string{"v1\n", "v2\n", "v3\n", "v4\n"} {
+		putTestVersion(t, s, tenant, path, content, 0)
+	}
+	if got, want := readTestVersions(t, s, tenant, path), []string{"v2\n", "v3\n"}; !equalStrings(got, want) {
+		t.Errorf("versions = %q, want %q", got, want)
+	}
+	if _, err := tenant.blobs.Read(hashBytes([]byte("v1\n"))); err == nil {
+		t.Error("pruned version content still stored")
+	}
+}
+
+func TestPruneVersionsKeepsPrefixSource(t *testing.T) {
+	s, tenant := newTestVersionTenant(t, 1, 0)
+	const path = "projects/p/s.jsonl"
+
+	// 最近一个版本是追加写入前的版本, 从当前文件读取
+	putTestVersion(t, s, tenant, path, "a\n", 0)
+	putTestVersion(t, s, tenant, path, "c\n", 0)
+	putTestVersion(t, s, tenant, path, "c\nd\n", 2)
+	if got, want := readTestVersions(t, s, tenant, path), []string{"c\n"}; !equalStrings(got, want) {
+		t.Errorf("versions = %q, want %q", got, want)
+	}
+
+	// 追加写入前的版本在保留时间内, 它读取的完整版本 (导入的旧历史) 已超出保留时间
+	s, tenant = newTestVersionTenant(t, 0, time.Hour)
+	full := "a\nb\n"
+	if err := tenant.blobs.Put(hashBytes([]byte(full)), []byte(full)); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	versions := []FileVersion{
+		{Rev: 1, Hash: hashBytes([]byte("a\n")), Size: 2, ArchivedAt: now.Unix(), Prefix: true},
+		{Rev: 2, Hash: hashBytes([]byte(full)), Size: int64(len(full)), ArchivedAt: now.Add(-2 * time.Hour).Unix()},
+		{Rev: 3, ArchivedAt: now.Add(-2 * time.Hour).Unix(), Deleted: true},
+	}
+	if err := s.saveVersions(tenant, path, versions); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readTestVersions(t, s, tenant, path), []string{"a\n", full}; !equalStrings(got, want) {
+		t.Errorf("versions = %q, want %q", got, want)
+	}
+
+	// 不再需要时随追加写入前的版本一起清理
+	s.SetVersionRetention(0, 0)
+	if err := s.saveVersions(tenant, path, s.loadVersions(tenant, path)); err != nil {
+		t.Fatal(err)
+	}
+	if versions := s.loadVersions(tenant, path); len(versions) != 0 {
+		t.Errorf("versions = %+v", versions)
+	}
+	if _, err := tenant.blobs.Read(hashBytes([]byte(full))); err == nil {
+		t.Error("pruned version content still stored")
+	}
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// debounceDelay 文件变化后等待的静默时间, 合并连续写入
+	debounceDelay = 500 * time.Millisecond
+	// maxDebounceDelay 持续写入时最多等待的时间
+	maxDebounceDelay = 2 * time.Second
+	// pollInterval 轮询模式下的扫描间隔
+	pollInterval = 2 * time.Second
+	// fullScanInterval 即使有文件监听, 也定期全量扫描一次以防漏掉事件
+	fullScanInterval = 10 * time.Minute
+)
+
+// Watcher 文件变化监听器
+type Watcher interface {
+	// Changes 返回发生变化的文件或目录的绝对路径; 空字符串表示事件丢失, 需要全量扫描
+	Changes() <-chan string
+	Close() error
+}
+
+// skipFunc 判断是否忽略 root 下的路径; 忽略的目录不会进入, 其下的变化都不报告
+type skipFunc func(path string, isDir bool) bool
+
+// newWatcher 创建监听器, 优先使用系统原生通知递归监听 root, 不支持时回退到轮询, 只遍历 roots
+// (root 下的目录或文件); skip 为 nil 时监听所有路径
+func newWatcher(root string, roots []string, skip skipFunc) Watcher {
+	if skip == nil {
+		skip = func(string, bool) bool { return false }
+	}
+	if w, err := newNativeWatcher(root, skip); err == nil {
+		return w
+	}
+	return newPollWatcher(roots, skip, pollInterval)
+}
+
+type fileStamp struct {
+	modTime int64
+	size    int64
+}
+
+// pollWatcher 轮询监听器: 只比较修改时间和大小, 不读取文件内容
+type pollWatcher struct {
+	roots     []string
+	skip      skipFunc
+	interval  time.Duration
+	snapshot  map[string]fileStamp
+	changes   chan string
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPollWatcher(roots []string, skip skipFunc, interval time.Duration) *pollWatcher {
+	w := &pollWatcher{
+		roots:    roots,
+		skip:     skip,
+		interval: interval,
+		changes:  make(chan string, 256),
+		done:     make(chan struct{}),
+	}
+	w.snapshot = w.scan()
+	go w.loop()
+	return w
+}
+
+func (w *pollWatcher) Changes() <-chan string {
+	return w.changes
+}
+
+func (w *pollWatcher) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	return nil
+}
+
+func (w *pollWatcher) scan() map[string]fileStamp {
+	snapshot := make(map[string]fileStamp)
+	walk := func(path string, info os.FileInfo, err error) error {
+		if err != nil || w.skip(path, info.IsDir()) {
+			if err == nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		snapshot[path] = fileStamp{modTime: info.ModTime().UnixNano(), size: info.Size()}
+		return nil
+	}
+	for _, root := range w.roots {
+		filepath.Walk(root, walk)
+	}
+	return snapshot
+}
+
+func (w *pollWatcher) loop() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			current := w.scan()
+			for path, stamp := range current {
+				if old, ok := w.snapshot[path]; !ok || old != stamp {
+					if !w.emit(path) {
+						return
+					}
+				}
+			}
+			for path := range w.snapshot {
+				if _, ok := current[path]; !ok {
+					if !w.emit(path) {
+						return
+					}
+				}
+			}
+			w.snapshot = current
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *pollWatcher) emit(path string) bool {
+	select {
+	case w.changes <- path:
+		return true
+	case <-w.done:
+		return false
+	}
+}
@@ -0,0 +1,161 @@
+//go:build linux
+
+package service
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_CREATE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE |
+	unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF
+
+// inotifyWatcher 基于 inotify 的递归目录监听器
+type inotifyWatcher struct {
+	file      *os.File
+	fd        int
+	skip      skipFunc
+	mu        sync.Mutex
+	watches   map[int]string // wd -> 目录
+	changes   chan string
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newNativeWatcher 创建 inotify 监听器
+func newNativeWatcher(root string, skip skipFunc) (Watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &inotifyWatcher{
+		// 非阻塞 fd 交给 Go 的 poller 管理, Close 时可以中断 Read
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		fd:      fd,
+		skip:    skip,
+		watches: make(map[int]string),
+		changes: make(chan string, 256),
+		done:    make(chan struct{}),
+	}
+
+	if err := w.addTree(root); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+
+	go w.readLoop()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Changes() <-chan string {
+	return w.changes
+}
+
+func (w *inotifyWatcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.file.Close()
+	})
+	return err
+}
+
+// addTree 递归监听目录 (跳过忽略的目录), 返回根目录的监听错误
+func (w *inotifyWatcher) addTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if w.skip(path, true) {
+			return filepath.SkipDir
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, path, inotifyMask)
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		w.mu.Lock()
+		w.watches[wd] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) readLoop() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			offset = nameEnd
+			if nameEnd > n {
+				break
+			}
+			name := string(bytes.TrimRight(buf[nameStart:nameEnd], "\x00"))
+
+			if !w.handleEvent(int(event.Wd), event.Mask, name) {
+				return
+			}
+		}
+	}
+}
+
+func (w *inotifyWatcher) handleEvent(wd int, mask uint32, name string) bool {
+	// 队列溢出, 事件已丢失
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		return w.emit("")
+	}
+
+	w.mu.Lock()
+	dir, ok := w.watches[wd]
+	if mask&unix.IN_IGNORED != 0 {
+		delete(w.watches, wd)
+	}
+	w.mu.Unlock()
+	if !ok || name == "" {
+		return true
+	}
+
+	path := filepath.Join(dir, name)
+	isDir := mask&unix.IN_ISDIR != 0
+	if w.skip(path, isDir) {
+		return true
+	}
+
+	// 新建或移入的目录需要补充监听; 监听建立前写入的文件由上层扫描目录时发现
+	if isDir && mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+		w.addTree(path)
+	}
+
+	return w.emit(path)
+}
+
+func (w *inotifyWatcher) emit(path string) bool {
+	select {
+	case w.changes <- path:
+		return true
+	case <-w.done:
+		return false
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package service
+
+import "errors"
+
+// newNativeWatcher 当前平台暂不支持原生文件通知, 使用轮询
+func newNativeWatcher(root string, skip skipFunc) (Watcher, error) {
+	return nil, errors.New("native watcher not supported")
+}
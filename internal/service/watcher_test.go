@@ -0,0 +1,59 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPollWatcherWalksOnlyRoots(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{"projects/a", "todos"} {
+		if err := os.MkdirAll(filepath.Join(dir, p), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	roots := []string{filepath.Join(dir, "projects"), filepath.Join(dir, "CLAUDE.md")}
+	skip := func(path string, isDir bool) bool { return strings.HasSuffix(path, ".log") }
+
+	w := newPollWatcher(roots, skip, 20*time.Millisecond)
+	defer w.Close()
+
+	write := func(rel string) {
+		if err := os.WriteFile(filepath.Join(dir, rel), []byte(rel), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("todos/t.json")
+	write("projects/a/debug.log")
+	write("sync.log")
+	write("projects/a/s.jsonl")
+	write("CLAUDE.md")
+
+	want := map[string]bool{
+		filepath.Join(dir, "projects/a/s.jsonl"): true,
+		filepath.Join(dir, "CLAUDE.md"):          true,
+	}
+	got := make(map[string]bool)
+	timeout := time.After(2 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case p := <-w.Changes():
+			if !want[p] {
+				t.Fatalf("unexpected change %s", p)
+			}
+			got[p] = true
+		case <-timeout:
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	// 之后的扫描不应再报告根以外或被忽略的文件
+	select {
+	case p := <-w.Changes():
+		t.Fatalf("unexpected change %s", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
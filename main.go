@@ -4,6 +4,7 @@ import (
 	"context"
 	"embed"
 	"fmt"
+	"strings"
 
 	"github.com/k0ngk0ng/claude-sync/internal/config"
 	"github.com/k0ngk0ng/claude-sync/internal/service"
@@ -101,8 +102,14 @@ func (a *App) GetConfig() *config.Config {
 
 // SaveConfig 保存配置
 func (a *App) SaveConfig(serverURL, token, machineName string, syncInterval int) error {
+	// 更换服务器或重新输入租户令牌时重新注册设备凭据
+	if serverURL != a.config.ServerURL || token != "" {
+		a.config.DeviceToken = ""
+	}
 	a.config.ServerURL = serverURL
-	a.config.Token = token
+	if token != "" || a.config.DeviceToken == "" {
+		a.config.Token = token
+	}
 	a.config.MachineName = machineName
 	if syncInterval > 0 {
 		a.config.SyncInterval = syncInterval
@@ -142,6 +149,8 @@ func (a *App) GetStatus() map[string]interface{} {
 		"uploaded":    stats.Uploaded,
 		"downloaded":  stats.Downloaded,
 		"isConnected": a.syncService.CheckConnection(),
+		"conflicts":   len(a.syncService.Conflicts()),
+		"redactions":  len(a.syncService.Redactions()),
 	}
 }
 
@@ -163,24 +172,208 @@ func (a *App) TogglePause() bool {
 	return a.config.Paused
 }
 
+// GetConflicts 获取未解决的同步冲突
+func (a *App) GetConflicts() []service.Conflict {
+	if a.syncService == nil {
+		return []service.Conflict{}
+	}
+	return a.syncService.Conflicts()
+}
+
+// ResolveConflict 解决同步冲突; keep 为 "local"、"remote" 或 "both"
+func (a *App) ResolveConflict(path, keep string) error {
+	if a.syncService == nil {
+		return fmt.Errorf("同步服务未启动")
+	}
+	if err := a.syncService.ResolveConflict(path, keep); err != nil {
+		return err
+	}
+	// 尽快把解决结果同步到服务器
+	go a.syncService.SyncNow()
+	return nil
+}
+
+// GetDevices 获取同一租户下的设备
+func (a *App) GetDevices() ([]*service.ClientInfo, error) {
+	if a.syncService == nil {
+		return nil, fmt.Errorf("同步服务未启动")
+	}
+	return a.syncService.Devices()
+}
+
+// RevokeDevice 撤销设备凭据, 被撤销的设备无法继续同步
+func (a *App) RevokeDevice(machineID string) error {
+	if a.syncService == nil {
+		return fmt.Errorf("同步服务未启动")
+	}
+	return a.syncService.RevokeDevice(machineID)
+}
+
+// CreatePairingCode 生成配对码, 新设备输入配对码即可连接; access 为 "read" 或 "write" 时新设备只能下载或只能上传
+func (a *App) CreatePairingCode(access string) (*service.PairingCodeResponse, error) {
+	if a.syncService == nil {
+		return nil, fmt.Errorf("同步服务未启动")
+	}
+	return a.syncService.CreatePairingCode(service.Scope{Access: access})
+}
+
+// PairDevice 使用其他设备或管理界面生成的配对码连接服务器
+func (a *App) PairDevice(serverURL, code, machineName string) error {
+	if a.syncService == nil {
+		return fmt.Errorf("同步服务未启动")
+	}
+	if machineName != "" {
+		a.config.MachineName = machineName
+	}
+	if err := a.syncService.Pair(serverURL, code); err != nil {
+		return err
+	}
+	go a.syncService.SyncNow()
+	return nil
+}
+
+// EnableEncryption 使用口令启用端到端加密, 同一租户的其他设备需要输入相同的口令
+func (a *App) EnableEncryption(passphrase string, encryptPaths bool) error {
+	if a.syncService == nil {
+		return fmt.Errorf("同步服务未启动")
+	}
+	if err := a.syncService.EnableEncryption(passphrase, encryptPaths); err != nil {
+		return err
+	}
+	go a.syncService.SyncNow()
+	return nil
+}
+
+// GetRedactions 获取检测到敏感信息的文件
+func (a *App) GetRedactions() []service.Redaction {
+	if a.syncService == nil {
+		return []service.Redaction{}
+	}
+	return a.syncService.Redactions()
+}
+
+// SetRedaction 设置上传前的敏感信息处理方式 ("mask"、"block" 或 "off") 和自定义正则表达式
+func (a *App) SetRedaction(mode string, patterns []string) error {
+	if err := service.ValidateRedaction(mode, patterns); err != nil {
+		return err
+	}
+	a.config.Redaction = mode
+	a.config.RedactPatterns = patterns
+	if err := a.config.Save(); err != nil {
+		return err
+	}
+	if a.syncService != nil {
+		a.syncService.UpdateConfig(a.config)
+		go a.syncService.SyncNow()
+	}
+	return nil
+}
+
+// GetProjects 获取本地的项目目录及其是否同步
+func (a *App) GetProjects() ([]service.Project, error) {
+	if a.syncService == nil {
+		return []service.Project{}, nil
+	}
+	return a.syncService.Projects()
+}
+
+// SetProjectExcluded 设置项目是否同步; 不同步的项目保留在本机和服务器上, 只是不再传输
+func (a *App) SetProjectExcluded(name string, excluded bool) error {
+	projects := []string{}
+	for _, p := range a.config.ExcludedProjects {
+		if p != name {
+			projects = append(projects, p)
+		}
+	}
+	if excluded {
+		projects = append(projects, name)
+	}
+	a.config.ExcludedProjects = projects
+	return a.applySyncScope()
+}
+
+// GetSyncRoots 获取同步的 ~/.claude 下的目录和文件
+func (a *App) GetSyncRoots() []string {
+	if len(a.config.SyncRoots) == 0 {
+		return service.DefaultSyncRoots
+	}
+	return a.config.SyncRoots
+}
+
+// SetSyncRoots 设置同步的 ~/.claude 下的目录和文件 (相对路径), 为空时恢复默认值
+func (a *App) SetSyncRoots(roots []string) error {
+	if err := service.ValidateSyncRoots(roots); err != nil {
+		return err
+	}
+	if len(roots) == 0 {
+		roots = nil
+	}
+	a.config.SyncRoots = roots
+	return a.applySyncScope()
+}
+
+// SetSyncRules 设置 gitignore 风格的同步规则 (每行一条, 相对于 ~/.claude)
+func (a *App) SetSyncRules(rules []string) error {
+	if err := service.ValidateSyncRules(rules); err != nil {
+		return err
+	}
+	a.config.SyncRules = rules
+	return a.applySyncScope()
+}
+
+// applySyncScope 保存同步范围或路径映射等影响传输内容的设置, 并立即全量扫描
+func (a *App) applySyncScope() error {
+	if err := a.config.Save(); err != nil {
+		return err
+	}
+	if a.syncService != nil {
+		a.syncService.UpdateConfig(a.config)
+		go a.syncService.SyncNow()
+	}
+	return nil
+}
+
 // GetPathMappings 获取路径映射
-func (a *App) GetPathMappings() map[string]string {
+func (a *App) GetPathMappings() config.PathMappings {
 	return a.config.PathMappings
 }
 
-// AddPathMapping 添加路径映射
+// AddPathMapping 添加路径映射, 远程路径已有映射时替换原来的映射
 func (a *App) AddPathMapping(remotePath, localPath string) error {
-	if a.config.PathMappings == nil {
-		a.config.PathMappings = make(map[string]string)
+	m := config.PathMapping{Remote: strings.TrimSpace(remotePath), Local: strings.TrimSpace(localPath)}
+	mappings := make(config.PathMappings, 0, len(a.config.PathMappings)+1)
+	replaced := false
+	for _, old := range a.config.PathMappings {
+		if old.Remote == m.Remote {
+			old, replaced = m, true
+		}
+		mappings = append(mappings, old)
+	}
+	if !replaced {
+		mappings = append(mappings, m)
 	}
-	a.config.PathMappings[remotePath] = localPath
-	return a.config.Save()
+	if err := service.ValidatePathMappings(mappings); err != nil {
+		return err
+	}
+	a.config.PathMappings = mappings
+	return a.applySyncScope()
 }
 
 // RemovePathMapping 删除路径映射
 func (a *App) RemovePathMapping(remotePath string) error {
-	delete(a.config.PathMappings, remotePath)
-	return a.config.Save()
+	mappings := make(config.PathMappings, 0, len(a.config.PathMappings))
+	for _, m := range a.config.PathMappings {
+		if m.Remote != remotePath {
+			mappings = append(mappings, m)
+		}
+	}
+	a.config.PathMappings = mappings
+	return a.applySyncScope()
+}
+
+// PreviewPathMapping 预览路径按当前的映射会转换成什么
+func (a *App) PreviewPathMapping(path string) service.PathPreview {
+	return service.PreviewPathMapping(a.config.PathMappings, strings.TrimSpace(path))
 }
 
 // CheckConnection 检查服务器连接